@@ -0,0 +1,54 @@
+package daemonize
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxCPU bounds the CPU numbers accepted in a CPU list, so that a typo
+// cannot make the affinity mask huge.
+const maxCPU = 4096
+
+var ErrInvalidCPUs = errors.New("cpus must be a list of CPU numbers and ranges such as 0,2-3")
+
+// parseCPUList parses a CPU list in the format of taskset -c and cpusets,
+// e.g. "0,2-3", into the sorted CPU numbers it names.
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for part := range strings.SplitSeq(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 || first >= maxCPU {
+			return nil, ErrInvalidCPUs
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(hi)
+			if err != nil || last < first || last >= maxCPU {
+				return nil, ErrInvalidCPUs
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	slices.Sort(cpus)
+	return slices.Compact(cpus), nil
+}
+
+// applyAffinity restricts the process pid and the descendants it already
+// forked to CPUs. It returns errors.ErrUnsupported on platforms without CPU
+// affinity.
+func applyAffinity(pid int, cpus []int) error {
+	if err := setAffinity(pid, cpus); err != nil {
+		return err
+	}
+	// Processes forked before the affinity was set do not inherit it.
+	descendants, _ := descendantProcesses(pid)
+	for _, p := range descendants {
+		_ = setAffinity(p, cpus)
+	}
+	return nil
+}
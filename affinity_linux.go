@@ -0,0 +1,22 @@
+//go:build linux
+
+package daemonize
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// setAffinity sets the CPU affinity mask of the process pid with
+// sched_setaffinity(2).
+func setAffinity(pid int, cpus []int) error {
+	mask := make([]uint64, cpus[len(cpus)-1]/64+1)
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(pid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
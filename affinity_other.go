@@ -0,0 +1,10 @@
+//go:build !linux
+
+package daemonize
+
+import "errors"
+
+// setAffinity is only supported on Linux.
+func setAffinity(pid int, cpus []int) error {
+	return errors.ErrUnsupported
+}
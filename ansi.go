@@ -0,0 +1,66 @@
+package daemonize
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// ansiEscape matches CSI sequences such as colors and cursor movement, OSC
+// sequences such as window titles and hyperlinks, and other two-byte escapes.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// stripANSI removes ANSI/VT100 escape sequences from p.
+func stripANSI(p []byte) []byte {
+	return ansiEscape.ReplaceAll(p, nil)
+}
+
+// maxPartialEscape bounds the unterminated escape sequence an ansiWriter
+// holds back. A longer one is written as it is.
+const maxPartialEscape = 4096
+
+// ansiWriter removes escape sequences from the output of a stream before
+// writing it to w. A sequence split across writes is held back until the
+// write that completes it.
+type ansiWriter struct {
+	w       io.Writer
+	partial []byte
+}
+
+func (a *ansiWriter) Write(p []byte) (int, error) {
+	out := stripANSI(append(a.partial, p...))
+	a.partial = nil
+	if i := bytes.LastIndexByte(out, 0x1b); i >= 0 && len(out)-i <= maxPartialEscape && partialEscape(out[i:]) {
+		a.partial = bytes.Clone(out[i:])
+		out = out[:i]
+	}
+	if len(out) > 0 {
+		if _, err := a.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// partialEscape reports whether b, which starts with ESC, may be the start
+// of an escape sequence that the next write completes. Complete sequences
+// have been removed from b already.
+func partialEscape(b []byte) bool {
+	if len(b) == 1 {
+		return true
+	}
+	switch b[1] {
+	case '[':
+		// Parameter and intermediate bytes, still without the final byte.
+		for _, c := range b[2:] {
+			if c < ' ' || c > '?' {
+				return false
+			}
+		}
+		return true
+	case ']':
+		// Everything up to the terminator, BEL or ESC \.
+		return bytes.IndexByte(b, 0x07) < 0
+	}
+	return false
+}
@@ -1,13 +1,28 @@
 package main
 
 import (
+	"flag"
 	"log/slog"
 
 	daemonize "github.com/mackee/mcp-daemonize"
 )
 
 func main() {
-	server := daemonize.New()
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on, e.g. 127.0.0.1:9090 (disabled when empty)")
+	stateWebhook := flag.String("state-webhook", "", "URL to POST daemon state changes to (disabled when empty)")
+	logBudget := flag.Int64("log-budget-bytes", 0, "maximum bytes of log text kept across all daemons (unlimited when 0)")
+	prefixName := flag.Bool("prefix-name", false, "prefix returned log lines with [name] of their daemon")
+	flag.Parse()
+
+	opts := []daemonize.Option{
+		daemonize.WithMetricsAddr(*metricsAddr),
+		daemonize.WithStateWebhook(*stateWebhook),
+		daemonize.WithLogBudget(*logBudget),
+	}
+	if *prefixName {
+		opts = append(opts, daemonize.WithNamePrefix())
+	}
+	server := daemonize.New(opts...)
 	if err := server.Start(); err != nil {
 		slog.Error("failed to start server", slog.Any("error", err))
 	}
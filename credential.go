@@ -0,0 +1,73 @@
+package daemonize
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var ErrCredentialNotPermitted = errors.New("running a daemon as another user or group requires root")
+
+// credential resolves the User and Group of the daemon. It returns nil when
+// neither is set.
+func (d *Daemon) credential() (*syscall.Credential, error) {
+	if d.User == "" && d.Group == "" {
+		return nil, nil
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if d.User != "" {
+		u, err := lookupUser(d.User)
+		if err != nil {
+			return nil, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, fmt.Errorf("invalid uid of user %s: %w", d.User, err)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, fmt.Errorf("invalid gid of user %s: %w", d.User, err)
+		}
+	}
+	if d.Group != "" {
+		g, err := lookupGroup(d.Group)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("invalid gid of group %s: %w", d.Group, err)
+		}
+	}
+	if os.Geteuid() != 0 && (uid != os.Getuid() || gid != os.Getgid()) {
+		return nil, ErrCredentialNotPermitted
+	}
+	// An empty Groups drops the supplementary groups of the server.
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s: %w", name, err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if g, err := user.LookupGroupId(name); err == nil {
+			return g, nil
+		}
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown group %s: %w", name, err)
+	}
+	return g, nil
+}
@@ -1,15 +1,25 @@
 package daemonize
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
 	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type DaemonStatus string
@@ -17,49 +27,655 @@ type DaemonStatus string
 const (
 	DaemonStatusRunning DaemonStatus = "running"
 	DaemonStatusStopped DaemonStatus = "stopped"
+	// DaemonStatusStarting is reported while Start waits for the launched
+	// process to become ready.
+	DaemonStatusStarting DaemonStatus = "starting"
 )
 
+// active reports whether the process of a daemon with status s exists.
+func (s DaemonStatus) active() bool {
+	return s == DaemonStatusRunning || s == DaemonStatusStarting
+}
+
 type Daemon struct {
 	Name      string
 	Commands  []string
 	Logger    Logger
 	Workdir   string
-	cmd       *exec.Cmd
-	mu        sync.Mutex
-	exitError error
-	done      chan struct{}
+	Autostart bool
+	// DependsOn names the daemons that must be running before this one is
+	// started by daemonize_start or daemonize_start_all.
+	DependsOn []string
+	// StripANSI removes ANSI escape sequences such as colors from the output
+	// before it is stored.
+	StripANSI bool
+	// TagStderr reads stderr from a pipe of its own and prefixes each of its
+	// lines with "[stderr] ". The two streams are then copied independently,
+	// so their lines may be stored out of order, and a line is only stored
+	// once it is ended, so that it is not joined with a line of the other
+	// stream. By default both share one pipe, which keeps the order in which
+	// they were written.
+	TagStderr bool
+	// Env holds KEY=value variables set on top of the environment of the
+	// server.
+	Env []string
+	// KillLeavesFirst signals the members of the process group children
+	// before parents, so that a supervisor cannot respawn a killed child.
+	// Only supported on Linux; other platforms signal the group at once.
+	KillLeavesFirst bool
+	// ReadyTCP is an address that must accept TCP connections before Start
+	// reports success. Empty means the daemon is ready once launched.
+	ReadyTCP string
+	// ReadyLog is a pattern that an output line must match before Start
+	// reports success. It is checked after ReadyTCP. Nil means no line is
+	// waited for.
+	ReadyLog *regexp.Regexp
+	// ReadyNotify sets NOTIFY_SOCKET for the daemon and makes Start wait
+	// for it to send READY=1 over the sd_notify protocol, after ReadyTCP
+	// and ReadyLog.
+	ReadyNotify bool
+	// ReadyTimeout bounds the wait for readiness. Zero means
+	// DefaultReadyTimeout.
+	ReadyTimeout time.Duration
+	// StartTimeout bounds the whole of Start, including the readiness wait
+	// and MinUptime. A daemon not started within it is stopped. Zero means no
+	// bound beyond ReadyTimeout.
+	StartTimeout time.Duration
+	// HealthCheck is a command run in Workdir every HealthInterval while the
+	// daemon runs. The daemon becomes unhealthy after HealthRetries
+	// consecutive failures, and healthy again on the next success.
+	HealthCheck    []string
+	HealthInterval time.Duration
+	HealthRetries  int
+	// MinUptime is how long the process must stay up for Start to succeed.
+	// An exit within it is recorded as ExitReasonEarlyExit.
+	MinUptime time.Duration
+	// StartGrace is how long after the first launch Start relaunches a
+	// process that exits before becoming ready or within MinUptime, for
+	// daemons that are slow to boot and may crash on the way. Zero fails the
+	// start on the first such exit.
+	StartGrace time.Duration
+	// MaxRuntime is how long the daemon may run after it is launched before
+	// it is stopped gracefully, for time-boxed jobs. Zero means no limit.
+	MaxRuntime time.Duration
+	// MaxMemoryBytes, MaxOpenFiles and MaxCPUSeconds set the address space,
+	// open file and CPU time resource limits of the daemon. Zero means
+	// unlimited. They are applied with ulimit of /bin/sh before the command
+	// is executed.
+	MaxMemoryBytes int64
+	MaxOpenFiles   int64
+	MaxCPUSeconds  int64
+	// MaxProcesses sets RLIMIT_NPROC, which caps threads and processes. The
+	// kernel counts every process of the daemon's real user, not only those
+	// of the daemon, and does not enforce it for root.
+	MaxProcesses int64
+	// Umask is the file mode creation mask of the daemon as an octal string
+	// such as "027". Empty leaves the umask inherited from the server.
+	Umask string
+	// Detached daemons are left running when the server shuts down or the
+	// context passed to Start is cancelled. Their output is written to a file
+	// in the temporary directory, which the server copies to the Logger, so
+	// that it stays writable after the server exits.
+	Detached bool
+	// ParentDeathSignal is sent to the daemon by the kernel when the server
+	// process dies, even when it crashes, so that no orphan is left behind.
+	// Zero means SIGTERM, or none for Detached daemons. It reaches the process
+	// of the daemon but not its descendants, so a daemon run by a shell only
+	// passes it on to its workload if the shell execs it. Only supported on
+	// Linux.
+	ParentDeathSignal syscall.Signal
+	// Nice is the scheduling priority of the daemon, from -20 (highest) to 19
+	// (lowest). Zero leaves the priority inherited from the server unchanged.
+	// Negative values usually require root.
+	Nice int
+	// CPUs restricts the daemon to a set of CPUs given as a list such as
+	// "0,2-3". Empty leaves the affinity inherited from the server. Only
+	// supported on Linux; other platforms start the daemon without it and log
+	// a warning.
+	CPUs string
+	// User and Group run the daemon with another user and group id, given by
+	// name or numeric id. A User alone also selects its primary group.
+	// Switching requires the server to run as root.
+	User  string
+	Group string
+	// AutoRestart makes the Server restart the daemon when its process exits
+	// without Stop being called, waiting an exponentially growing backoff
+	// between attempts.
+	AutoRestart bool
+	// StopSignals are sent in turn by Stop, evenly spaced over StopTimeout,
+	// before the process group is killed with SIGKILL. Empty means
+	// DefaultStopSignals.
+	StopSignals []syscall.Signal
+	// StopTimeout is how long Stop waits for the process to exit before it
+	// kills the process group. Zero means DefaultStopTimeout.
+	StopTimeout time.Duration
+	// Clock times the graceful stop. Nil means the system clock.
+	Clock Clock
+	// Tracer records OpenTelemetry spans around Start and Stop. Nil
+	// disables tracing.
+	Tracer trace.Tracer
+	// StateWebhook is a URL the Server POSTs a StateChange to when the
+	// daemon starts or exits. Empty means the webhook of the Server.
+	StateWebhook string
+
+	// cmd is set once the process is launched and cleared by Status when
+	// the process is found gone. It is read without holding mu, as Stop
+	// holds mu while it waits for the process. Start and reset set it under
+	// stateMu, so that Snapshot sees it together with the state of its run.
+	cmd   atomic.Pointer[exec.Cmd]
+	mu    sync.Mutex
+	logMu sync.RWMutex
+	// launchMu makes checking that the daemon is not running and launching
+	// its process one step, so that concurrent starts launch it once.
+	launchMu sync.Mutex
+	// done is closed when the process of the current run exits. Start
+	// replaces it, so it is guarded by stateMu; read it with doneCh.
+	done chan struct{}
+	// running is done once the exit of the last launched process has been
+	// recorded and its exit hooks have run.
+	running sync.WaitGroup
+
+	// stopped is set by Stop once the process is known to have exited, and
+	// is guarded by mu.
+	stopped bool
+	// stopRequested is set as soon as Stop is called, so that the exit it
+	// causes is not taken for a crash.
+	stopRequested atomic.Bool
+	// starting is set while Start waits for readiness and MinUptime.
+	starting atomic.Bool
+	// pending is set while a background start has not finished, so that the
+	// daemon is reported as starting before its process is launched.
+	pending atomic.Bool
+
+	// muted and mutedLines are guarded by logMu; mutedLines is also updated
+	// atomically by writers that only hold the read lock.
+	muted      bool
+	mutedLines atomic.Int64
+
+	// stateMu guards the fields below, which are written by Start, the exit
+	// of the process and Stop while being read by the accessors.
+	stateMu sync.Mutex
+	// env is the environment the process was launched with.
+	env []string
+	// executable is the absolute path Commands[0] resolved to at start.
+	executable string
+	startedAt  time.Time
+	exitedAt   time.Time
+	exitError  error
+	exitCode   int
+	exitSignal syscall.Signal
+	exitReason ExitReason
+	exited     bool
+	// lastStopSignal is the signal the process exited on during the last
+	// Stop, and lastStopForced is set if that was SIGKILL after the stop
+	// timeout or the context of Stop ended.
+	lastStopSignal syscall.Signal
+	lastStopForced bool
+	failure        error
+	// logErr is the last error the Logger returned for the output.
+	logErr         error
+	exitHooks      []func(*Daemon)
+	health         HealthStatus
+	healthErr      error
+	healthFailures int
+	// backoff is the delay waited before the restart that led to this
+	// daemon, or before its own restart once nextRestart is set.
+	backoff     time.Duration
+	nextRestart time.Time
+	// restarts counts the restarts that led to this daemon, carried over by
+	// clone.
+	restarts int
+	// startCancelled is set by Stop while a background start is pending, so
+	// that its process is not launched.
+	startCancelled bool
 }
 
 func NewDaemon(name string, commands []string, workdir string) *Daemon {
 	logger := NewMemoryLogger()
 	return &Daemon{
-		Name:      name,
-		Commands:  commands,
-		Logger:    logger,
-		Workdir:   workdir,
-		mu:        sync.Mutex{},
-		exitError: nil,
-		done:      make(chan struct{}),
+		Name:     name,
+		Commands: commands,
+		Logger:   logger,
+		Workdir:  workdir,
+		mu:       sync.Mutex{},
+		exitCode: -1,
+		done:     make(chan struct{}),
+	}
+}
+
+// clone returns a daemon that has not been started with the configuration
+// and logger of d.
+func (d *Daemon) clone() *Daemon {
+	c := NewDaemon(d.Name, d.Commands, d.Workdir)
+	c.Logger = d.logger()
+	c.Autostart = d.Autostart
+	c.DependsOn = d.DependsOn
+	c.StripANSI = d.StripANSI
+	c.TagStderr = d.TagStderr
+	c.Env = d.Env
+	c.KillLeavesFirst = d.KillLeavesFirst
+	c.ReadyTCP = d.ReadyTCP
+	c.ReadyLog = d.ReadyLog
+	c.ReadyNotify = d.ReadyNotify
+	c.ReadyTimeout = d.ReadyTimeout
+	c.StartTimeout = d.StartTimeout
+	c.HealthCheck = d.HealthCheck
+	c.HealthInterval = d.HealthInterval
+	c.HealthRetries = d.HealthRetries
+	c.MinUptime = d.MinUptime
+	c.StartGrace = d.StartGrace
+	c.MaxRuntime = d.MaxRuntime
+	c.MaxMemoryBytes = d.MaxMemoryBytes
+	c.MaxOpenFiles = d.MaxOpenFiles
+	c.MaxCPUSeconds = d.MaxCPUSeconds
+	c.MaxProcesses = d.MaxProcesses
+	c.Umask = d.Umask
+	c.Detached = d.Detached
+	c.ParentDeathSignal = d.ParentDeathSignal
+	c.Nice = d.Nice
+	c.CPUs = d.CPUs
+	c.User = d.User
+	c.Group = d.Group
+	c.AutoRestart = d.AutoRestart
+	c.StopSignals = d.StopSignals
+	c.StopTimeout = d.StopTimeout
+	c.Clock = d.Clock
+	c.Tracer = d.Tracer
+	c.StateWebhook = d.StateWebhook
+	d.stateMu.Lock()
+	c.restarts = d.restarts
+	d.stateMu.Unlock()
+	return c
+}
+
+// logWriter forwards process output to the current Logger of a daemon.
+type logWriter struct {
+	d *Daemon
+}
+
+// Write always consumes p. An error of the Logger is recorded rather than
+// returned, as os/exec would stop reading the output on it and the daemon
+// would then fail or block on its next write.
+func (w logWriter) Write(p []byte) (int, error) {
+	w.d.logMu.RLock()
+	defer w.d.logMu.RUnlock()
+	if w.d.muted {
+		w.d.mutedLines.Add(countLines(p))
+		return len(p), nil
+	}
+	if _, err := w.d.Logger.Write(p); err != nil {
+		w.d.setLogError(err)
+	}
+	return len(p), nil
+}
+
+// setLogError records a failed write to the Logger, logging the first one of
+// a run so that a broken log sink is noticed.
+func (d *Daemon) setLogError(err error) {
+	d.stateMu.Lock()
+	first := d.logErr == nil
+	d.logErr = err
+	d.stateMu.Unlock()
+	if first {
+		slog.Error("failed to write daemon output to its logger", slog.String("name", d.Name), slog.Any("error", err))
+	}
+}
+
+// LogError returns the last error the Logger returned for output of the
+// current run, or nil. Output that failed to be written is lost.
+func (d *Daemon) LogError() error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.logErr
+}
+
+// stderrPrefix marks the lines of stderr when Daemon.TagStderr is set.
+const stderrPrefix = "[stderr] "
+
+// stderrWriter prefixes every line written to it with stderrPrefix.
+type stderrWriter struct {
+	w io.Writer
+	// midLine is set while the last write did not end with a newline.
+	midLine bool
+}
+
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for rest := p; len(rest) > 0; {
+		if !w.midLine {
+			buf.WriteString(stderrPrefix)
+		}
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		buf.Write(line)
+		rest = rest[len(line):]
+		w.midLine = line[len(line)-1] != '\n'
+	}
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lineWriter passes only whole lines on to w and holds back the unended
+// line at the end of the output until a later write ends it. A held back
+// line longer than DefaultMaxLineBytes is passed on as it is.
+type lineWriter struct {
+	w       io.Writer
+	partial []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	n := bytes.LastIndexByte(l.partial, '\n') + 1
+	if len(l.partial)-n > DefaultMaxLineBytes {
+		n = len(l.partial)
+	}
+	if n == 0 {
+		return len(p), nil
+	}
+	out := l.partial[:n]
+	l.partial = bytes.Clone(l.partial[n:])
+	if _, err := l.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush passes on the held back line once the stream has ended.
+func (l *lineWriter) flush() {
+	if len(l.partial) > 0 {
+		_, _ = l.w.Write(l.partial)
+		l.partial = nil
 	}
 }
 
+// outputWriters returns the writers the output streams of a run are copied
+// to, and a function that stores what they hold back once the streams have
+// ended. Unless TagStderr is set, both streams share one writer.
+func (d *Daemon) outputWriters() (stdout, stderr io.Writer, flush func()) {
+	stdout = logWriter{d}
+	if !d.TagStderr {
+		if d.StripANSI {
+			stdout = &ansiWriter{w: stdout}
+		}
+		return stdout, stdout, func() {}
+	}
+	// Every stream keeps its own unended line, as the two share the log.
+	outLines := &lineWriter{w: stdout}
+	errLines := &lineWriter{w: &stderrWriter{w: logWriter{d}}}
+	stdout, stderr = outLines, errLines
+	if d.StripANSI {
+		// Every stream has its own writer, as sequences may be split across
+		// writes.
+		stdout, stderr = &ansiWriter{w: stdout}, &ansiWriter{w: stderr}
+	}
+	return stdout, stderr, func() {
+		outLines.flush()
+		errLines.flush()
+	}
+}
+
+func countLines(p []byte) int64 {
+	n := int64(bytes.Count(p, []byte{'\n'}))
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// Mute discards the output of the daemon until Unmute is called. It reports
+// false if the daemon was already muted.
+func (d *Daemon) Mute() bool {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	if d.muted {
+		return false
+	}
+	d.muted = true
+	d.mutedLines.Store(0)
+	return true
+}
+
+// Unmute resumes capturing the output of the daemon and records the number
+// of lines discarded while muted in the log. It returns that number, and
+// false if the daemon was not muted.
+func (d *Daemon) Unmute() (int64, bool) {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	if !d.muted {
+		return 0, false
+	}
+	d.muted = false
+	n := d.mutedLines.Swap(0)
+	fmt.Fprintf(d.Logger, "muted %d lines\n", n)
+	return n, true
+}
+
+// SetLogger replaces the Logger of the daemon. Output of a running process is
+// redirected to l; a write already in progress completes on the old logger, so
+// no output is lost.
+func (d *Daemon) SetLogger(l Logger) {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	d.Logger = l
+}
+
+func (d *Daemon) logger() Logger {
+	d.logMu.RLock()
+	defer d.logMu.RUnlock()
+	return d.Logger
+}
+
 func (d *Daemon) Start(ctx context.Context) error {
-	dctx := context.WithoutCancel(ctx)
-	d.cmd = exec.CommandContext(dctx, d.Commands[0], d.Commands[1:]...)
-	d.cmd.Stdout = d.Logger
-	d.cmd.Stderr = d.Logger
-	d.cmd.Dir = d.Workdir
-	d.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	if err := d.cmd.Start(); err != nil {
+	return d.traceStart(ctx, false)
+}
+
+// startPending launches a daemon pending a background start, unless Stop
+// cancelled it meanwhile.
+func (d *Daemon) startPending(ctx context.Context) error {
+	return d.traceStart(ctx, true)
+}
+
+// beginPending marks the daemon as pending a background start until
+// endPending is called.
+func (d *Daemon) beginPending() {
+	d.stateMu.Lock()
+	d.startCancelled = false
+	d.stateMu.Unlock()
+	d.pending.Store(true)
+}
+
+// endPending marks the background start of the daemon as finished, with
+// err, if any, recorded as a StartError unless a failure was recorded
+// already, and reports whether Stop cancelled it. A cancelled start records
+// no failure.
+func (d *Daemon) endPending(err error) (cancelled bool) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if err != nil && !d.startCancelled && d.failure == nil {
+		d.failure = &StartError{Err: err}
+	}
+	d.pending.Store(false)
+	return d.startCancelled
+}
+
+// cancelPending keeps a pending background start from launching the daemon
+// and waits for a launch already under way, so that Stop finds its process
+// rather than leaving it running. It reports whether a start was pending.
+func (d *Daemon) cancelPending() bool {
+	d.stateMu.Lock()
+	pending := d.pending.Load()
+	if pending {
+		d.startCancelled = true
+	}
+	d.stateMu.Unlock()
+	if pending {
+		d.launchMu.Lock()
+		d.launchMu.Unlock()
+	}
+	return pending
+}
+
+func (d *Daemon) traceStart(ctx context.Context, pending bool) error {
+	ctx, span, end := d.startSpan(ctx, SpanStart)
+	err := d.startWithGrace(ctx, pending)
+	if err == nil {
+		span.SetAttributes(attribute.Int("daemon.pid", d.PID()))
+	}
+	end(err)
+	return err
+}
+
+// startGraceRetryDelay is the pause before relaunching a daemon that
+// crashed within StartGrace.
+const startGraceRetryDelay = 100 * time.Millisecond
+
+// startWithGrace starts the daemon, relaunching it while it crashes during
+// StartGrace.
+func (d *Daemon) startWithGrace(ctx context.Context, pending bool) error {
+	graceEnd := time.Now().Add(d.StartGrace)
+	for {
+		err := d.start(ctx, pending)
+		crashed := errors.Is(err, ErrExitedEarly) || errors.Is(err, ErrEarlyExit)
+		if !crashed || !time.Now().Before(graceEnd) {
+			return err
+		}
+		slog.InfoContext(ctx, "daemon crashed within its start grace period, relaunching", slog.String("name", d.Name), slog.Any("error", err))
+		select {
+		case <-time.After(startGraceRetryDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+var ErrDaemonAlreadyRunning = errors.New("daemon already running")
+
+// ErrStartCancelled is returned by a background start that Stop cancelled
+// before the daemon was launched.
+var ErrStartCancelled = errors.New("start cancelled")
+
+func (d *Daemon) start(ctx context.Context, pending bool) error {
+	d.launchMu.Lock()
+	unlockLaunch := sync.OnceFunc(d.launchMu.Unlock)
+	defer unlockLaunch()
+	// A daemon pending a background start is only launched by that start.
+	if pending {
+		d.stateMu.Lock()
+		cancelled := d.startCancelled
+		d.stateMu.Unlock()
+		if cancelled {
+			return fmt.Errorf("failed to start daemon %s: %w", d.Name, ErrStartCancelled)
+		}
+	} else if status, err := d.Status(); err == nil && status.active() {
+		return fmt.Errorf("failed to start daemon %s: %w", d.Name, ErrDaemonAlreadyRunning)
+	}
+	if d.Nice < MinNice || d.Nice > MaxNice {
+		return fmt.Errorf("failed to start daemon %s: %w", d.Name, ErrInvalidNice)
+	}
+	if d.Umask != "" && !validUmask(d.Umask) {
+		return fmt.Errorf("failed to start daemon %s: %w", d.Name, ErrInvalidUmask)
+	}
+	var cpus []int
+	if d.CPUs != "" {
+		var err error
+		if cpus, err = parseCPUList(d.CPUs); err != nil {
+			return fmt.Errorf("failed to start daemon %s: %w", d.Name, err)
+		}
+	}
+	credential, err := d.credential()
+	if err != nil {
 		return fmt.Errorf("failed to start daemon %s: %w", d.Name, err)
 	}
+	env := d.environ()
+	// Resolve the executable with the PATH of the daemon rather than that
+	// of the server, and report a missing one before anything is launched.
+	executable, err := lookPath(d.Commands[0], d.Workdir, env)
+	if err != nil {
+		return d.spawnFailed(err)
+	}
+	dctx := context.WithoutCancel(ctx)
+	args := d.limitArgs(append([]string{executable}, d.Commands[1:]...))
+	cmd := exec.CommandContext(dctx, args[0], args[1:]...)
+	stdout, stderr, flushOutput := d.outputWriters()
+	// os/exec hands the same pipe to both streams when they share a writer.
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	var outputs []*outputFile
+	if d.Detached {
+		if outputs, err = d.outputFiles(cmd, stdout, stderr); err != nil {
+			return fmt.Errorf("failed to start daemon %s: output file: %w", d.Name, err)
+		}
+	}
+	cmd.Dir = d.Workdir
+	var notified <-chan struct{}
+	if d.ReadyNotify {
+		l, err := d.listenNotify()
+		if err != nil {
+			for _, o := range outputs {
+				o.discard()
+			}
+			return fmt.Errorf("failed to start daemon %s: %w", d.Name, err)
+		}
+		defer l.Close()
+		env = append(env, notifySocketEnv+"="+l.path())
+		notified = l.ready
+	}
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	setProcessGroup(cmd.SysProcAttr)
+	setParentDeathSignal(cmd.SysProcAttr, d.parentDeathSignal())
+	// Subscribe before launching so that an early ready line is not missed.
+	var lines <-chan string
+	if d.ReadyLog != nil {
+		var cancel func()
+		lines, cancel = d.logger().Subscribe()
+		defer cancel()
+	}
+	// Wait for the exit of a previous run to be fully recorded before its
+	// state is cleared.
+	d.running.Wait()
+	d.reset()
+	d.stateMu.Lock()
+	d.env, d.executable = env, executable
+	d.stateMu.Unlock()
+	d.starting.Store(true)
+	defer d.starting.Store(false)
+	d.running.Add(1)
+	if err := cmd.Start(); err != nil {
+		d.running.Done()
+		for _, o := range outputs {
+			o.discard()
+		}
+		return d.spawnFailed(err)
+	}
+	// The process and its start time are recorded together for Snapshot.
+	d.stateMu.Lock()
+	d.startedAt = time.Now()
+	d.cmd.Store(cmd)
+	d.stateMu.Unlock()
+	unlockLaunch()
+	waited := make(chan struct{})
+	following := followOutputFiles(outputs, waited)
+	if len(outputs) > 0 {
+		slog.InfoContext(ctx, "detached daemon writes its output to a file", slog.String("name", d.Name), slog.String("path", outputs[0].r.Name()))
+	}
+	// The goroutines keep the channel of this run, as the next Start
+	// replaces it.
+	done := d.done
 	go func() {
 		select {
 		case <-ctx.Done():
+			if d.Detached {
+				slog.InfoContext(ctx, "context cancelled, leaving detached daemon running", slog.String("name", d.Name))
+				return
+			}
 			slog.InfoContext(ctx, "context cancelled, stopping daemon", slog.String("name", d.Name))
 			if status, err := d.Status(); err != nil {
 				slog.ErrorContext(ctx, "failed to get daemon status", slog.String("name", d.Name), slog.Any("error", err))
-			} else if status != DaemonStatusRunning {
+			} else if !status.active() {
 				slog.DebugContext(ctx, "daemon already stopped", slog.String("name", d.Name), slog.String("status", string(status)))
 				return
 			}
@@ -68,104 +684,722 @@ func (d *Daemon) Start(ctx context.Context) error {
 			} else {
 				slog.InfoContext(ctx, "daemon stopped successfully", slog.String("name", d.Name))
 			}
-		case <-d.done:
+		case <-done:
 			slog.DebugContext(ctx, "daemon already stopped", slog.String("name", d.Name))
 		}
 	}()
 	go func() {
-		defer close(d.done)
-		if err := d.cmd.Wait(); err != nil {
-			var ee *exec.ExitError
-			if errors.As(err, &ee) {
-				ws, ok := ee.Sys().(syscall.WaitStatus)
-				if ok && ws.Signaled() {
-					slog.DebugContext(ctx, "daemon stopped by signal", slog.String("name", d.Name))
-					return
-				}
-				if ee.Exited() && ee.ExitCode() == 0 {
-					slog.InfoContext(ctx, "daemon exited successfully", slog.String("name", d.Name))
-					return
-				}
-				slog.ErrorContext(ctx, "daemon exited with error", slog.String("name", d.Name), slog.Any("error", err))
-				d.exitError = fmt.Errorf("daemon %s exited with error: %w", d.Name, err)
-				return
+		defer d.running.Done()
+		err := cmd.Wait()
+		close(waited)
+		following.Wait()
+		flushOutput()
+		d.recordExit(ctx, cmd, err)
+		close(done)
+		d.runExitHooks()
+	}()
+
+	if d.Nice != 0 {
+		// The priority is applied to the whole process group, so processes
+		// the daemon forked before this point are covered too.
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, cmd.Process.Pid, d.Nice); err != nil {
+			_ = kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			return fmt.Errorf("failed to set nice value of daemon %s: %w", d.Name, err)
+		}
+	}
+
+	if len(cpus) > 0 {
+		if err := applyAffinity(cmd.Process.Pid, cpus); errors.Is(err, errors.ErrUnsupported) {
+			slog.WarnContext(ctx, "CPU affinity is not supported on this platform, ignoring cpus", slog.String("name", d.Name), slog.String("cpus", d.CPUs))
+		} else if err != nil {
+			_ = kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			return fmt.Errorf("failed to set CPU affinity of daemon %s: %w", d.Name, err)
+		}
+	}
+
+	if len(d.HealthCheck) > 0 {
+		go d.runHealthChecks(context.WithoutCancel(ctx))
+	}
+
+	if d.MaxRuntime > 0 {
+		go d.stopAfterMaxRuntime(context.WithoutCancel(ctx), done)
+	}
+
+	waitCtx := ctx
+	if d.StartTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeoutCause(ctx, d.StartTimeout, fmt.Errorf("%w after %s", ErrStartTimeout, d.StartTimeout))
+		defer cancel()
+	}
+
+	if err := d.waitReady(waitCtx, lines, notified); err != nil {
+		if !errors.Is(err, ErrExitedEarly) {
+			if err := d.stopLaunched(context.WithoutCancel(ctx)); err != nil {
+				slog.ErrorContext(ctx, "failed to stop daemon that did not become ready", slog.String("name", d.Name), slog.Any("error", err))
 			}
-			slog.ErrorContext(ctx, "daemon exited with error", slog.String("name", d.Name), slog.Any("error", err))
-		} else {
-			slog.InfoContext(ctx, "daemon exited successfully", slog.String("name", d.Name))
 		}
-	}()
+		return fmt.Errorf("daemon %s did not become ready: %w", d.Name, err)
+	}
+
+	if d.MinUptime > 0 {
+		select {
+		case <-d.doneCh():
+			return fmt.Errorf("daemon %s exited within %s: %w", d.Name, d.MinUptime, ErrEarlyExit)
+		case <-time.After(time.Until(d.StartedAt().Add(d.MinUptime))):
+		case <-waitCtx.Done():
+			if err := d.stopLaunched(context.WithoutCancel(ctx)); err != nil {
+				slog.ErrorContext(ctx, "failed to stop daemon that did not reach its minimum uptime", slog.String("name", d.Name), slog.Any("error", err))
+			}
+			return fmt.Errorf("daemon %s did not reach its minimum uptime: %w", d.Name, context.Cause(waitCtx))
+		}
+	}
+
+	return nil
+}
+
+const DefaultReadyTimeout = 30 * time.Second
+
+const (
+	MinNice = -20
+	MaxNice = 19
+)
+
+var ErrInvalidNice = fmt.Errorf("nice value must be between %d and %d", MinNice, MaxNice)
+
+var ErrInvalidUmask = errors.New("umask must be an octal number between 000 and 777")
+
+// validUmask reports whether s is an octal umask accepted by Start.
+func validUmask(s string) bool {
+	m, err := strconv.ParseUint(s, 8, 32)
+	return err == nil && m <= 0o777
+}
 
+var (
+	ErrReadyTimeout = errors.New("readiness timed out")
+	ErrExitedEarly  = errors.New("daemon exited before becoming ready")
+	ErrEarlyExit    = errors.New("daemon exited before its minimum uptime")
+	ErrStartTimeout = errors.New("start timed out")
+)
+
+// readyPollInterval is the delay between readiness probes.
+const readyPollInterval = 50 * time.Millisecond
+
+// waitReady waits for ReadyTCP to accept connections, then for a line
+// matching ReadyLog to arrive on lines and then for notified to be closed.
+func (d *Daemon) waitReady(ctx context.Context, lines <-chan string, notified <-chan struct{}) error {
+	if d.ReadyTCP == "" && d.ReadyLog == nil && !d.ReadyNotify {
+		return nil
+	}
+	timeout := d.ReadyTimeout
+	if timeout <= 0 {
+		timeout = DefaultReadyTimeout
+	}
+	deadline := time.After(timeout)
+	if d.ReadyTCP != "" {
+		if err := d.waitReadyTCP(ctx, deadline, timeout); err != nil {
+			return err
+		}
+	}
+	if d.ReadyLog != nil {
+		if err := d.waitReadyLog(ctx, lines, deadline, timeout); err != nil {
+			return err
+		}
+	}
+	if d.ReadyNotify {
+		return d.waitReadyNotify(ctx, notified, deadline, timeout)
+	}
 	return nil
 }
 
+func (d *Daemon) waitReadyNotify(ctx context.Context, notified <-chan struct{}, deadline <-chan time.Time, timeout time.Duration) error {
+	select {
+	case <-notified:
+		return nil
+	case <-d.doneCh():
+		return ErrExitedEarly
+	case <-deadline:
+		return fmt.Errorf("%w: no READY=1 on the notify socket after %s", ErrReadyTimeout, timeout)
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (d *Daemon) waitReadyLog(ctx context.Context, lines <-chan string, deadline <-chan time.Time, timeout time.Duration) error {
+	for {
+		select {
+		case line := <-lines:
+			if d.ReadyLog.MatchString(line) {
+				return nil
+			}
+		case <-d.doneCh():
+			// The output is fully logged once the process has exited, so
+			// check the lines that are still queued.
+			for {
+				select {
+				case line := <-lines:
+					if d.ReadyLog.MatchString(line) {
+						return nil
+					}
+				default:
+					return ErrExitedEarly
+				}
+			}
+		case <-deadline:
+			return fmt.Errorf("%w: no output line matched %s after %s", ErrReadyTimeout, d.ReadyLog, timeout)
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+func (d *Daemon) waitReadyTCP(ctx context.Context, deadline <-chan time.Time, timeout time.Duration) error {
+	dialer := &net.Dialer{Timeout: readyPollInterval}
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", d.ReadyTCP)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-d.doneCh():
+			return ErrExitedEarly
+		case <-deadline:
+			return fmt.Errorf("%w: %s not accepting connections after %s", ErrReadyTimeout, d.ReadyTCP, timeout)
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+type ExitReason string
+
+const (
+	ExitReasonExited   ExitReason = "exited"
+	ExitReasonFailed   ExitReason = "failed"
+	ExitReasonSignaled ExitReason = "signaled"
+	// ExitReasonEarlyExit is recorded when the process exits within MinUptime.
+	ExitReasonEarlyExit ExitReason = "early_exit"
+)
+
+func (d *Daemon) recordExit(ctx context.Context, cmd *exec.Cmd, err error) {
+	exitedAt := time.Now()
+	code := -1
+	if cmd.ProcessState != nil {
+		code = cmd.ProcessState.ExitCode()
+	}
+	reason, signal, exitErr := d.exitResult(ctx, err)
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if d.MinUptime > 0 && exitedAt.Sub(d.startedAt) < d.MinUptime {
+		reason = ExitReasonEarlyExit
+	}
+	d.exitedAt = exitedAt
+	d.exitCode = code
+	d.exitReason = reason
+	d.exitSignal = signal
+	d.exitError = exitErr
+}
+
+// exitResult logs how the process ended with err from its Wait and returns
+// the reason, the signal it was terminated by and the error Wait reports.
+func (d *Daemon) exitResult(ctx context.Context, err error) (ExitReason, syscall.Signal, error) {
+	if err == nil {
+		slog.InfoContext(ctx, "daemon exited successfully", slog.String("name", d.Name))
+		return ExitReasonExited, 0, nil
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		slog.ErrorContext(ctx, "daemon exited with error", slog.String("name", d.Name), slog.Any("error", err))
+		return ExitReasonFailed, 0, nil
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		slog.DebugContext(ctx, "daemon stopped by signal", slog.String("name", d.Name))
+		return ExitReasonSignaled, ws.Signal(), nil
+	}
+	if ee.Exited() && ee.ExitCode() == 0 {
+		slog.InfoContext(ctx, "daemon exited successfully", slog.String("name", d.Name))
+		return ExitReasonExited, 0, nil
+	}
+	slog.ErrorContext(ctx, "daemon exited with error", slog.String("name", d.Name), slog.Any("error", err))
+	failure := &ExitError{Code: ee.ExitCode(), Err: err}
+	d.setFailure(failure)
+	return ExitReasonFailed, 0, fmt.Errorf("daemon %s exited with error: %w", d.Name, failure)
+}
+
+// addExitHook registers f to be called after the daemon process exits. If it
+// has already exited, f is called immediately.
+func (d *Daemon) addExitHook(f func(*Daemon)) {
+	d.stateMu.Lock()
+	if !d.exited {
+		d.exitHooks = append(d.exitHooks, f)
+		d.stateMu.Unlock()
+		return
+	}
+	d.stateMu.Unlock()
+	f(d)
+}
+
+func (d *Daemon) runExitHooks() {
+	d.stateMu.Lock()
+	d.exited = true
+	hooks := slices.Clone(d.exitHooks)
+	d.stateMu.Unlock()
+	for _, f := range hooks {
+		f(d)
+	}
+}
+
+// ExitRecord describes how a daemon process ended. Signal is zero unless the
+// process was terminated by a signal.
+type ExitRecord struct {
+	Name     string
+	ExitCode int
+	Signal   syscall.Signal
+	Reason   ExitReason
+	Duration time.Duration
+	ExitedAt time.Time
+}
+
+// exitRecord must only be called after the daemon has exited.
+func (d *Daemon) exitRecord() ExitRecord {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return ExitRecord{
+		Name:     d.Name,
+		ExitCode: d.exitCode,
+		Signal:   d.exitSignal,
+		Reason:   d.exitReason,
+		Duration: d.exitedAt.Sub(d.startedAt),
+		ExitedAt: d.exitedAt,
+	}
+}
+
 var ErrDaemonNotRunning = fmt.Errorf("daemon not running")
 
-func (d *Daemon) pgid() (int, error) {
-	if d.cmd == nil || d.cmd.Process == nil {
-		return -1, ErrDaemonNotRunning
+// Executable returns the path the command of the daemon resolved to when it
+// was last started, or "" if it has not been started.
+func (d *Daemon) Executable() string {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.executable
+}
+
+// StartedAt returns the time the process of the daemon was launched, or the
+// zero time if it has not been started.
+func (d *Daemon) StartedAt() time.Time {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.startedAt
+}
+
+// StopAt returns the time a running daemon is stopped for reaching
+// MaxRuntime, or the zero time if it has no MaxRuntime or is not running.
+func (d *Daemon) StopAt() time.Time {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if d.MaxRuntime <= 0 || d.startedAt.IsZero() {
+		return time.Time{}
+	}
+	select {
+	case <-d.done:
+		return time.Time{}
+	default:
+	}
+	return d.startedAt.Add(d.MaxRuntime)
+}
+
+// parentDeathSignal returns the signal the daemon receives when the server
+// dies, or 0 for none.
+func (d *Daemon) parentDeathSignal() syscall.Signal {
+	switch {
+	case d.ParentDeathSignal != 0:
+		return d.ParentDeathSignal
+	case d.Detached:
+		return 0
+	default:
+		return syscall.SIGTERM
+	}
+}
+
+// stopAfterMaxRuntime stops the daemon once MaxRuntime has passed since its
+// launch, unless the run that done belongs to exits first.
+func (d *Daemon) stopAfterMaxRuntime(ctx context.Context, done <-chan struct{}) {
+	timer := time.NewTimer(time.Until(d.StartedAt().Add(d.MaxRuntime)))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	slog.InfoContext(ctx, "daemon reached its maximum runtime, stopping", slog.String("name", d.Name), slog.Duration("max_runtime", d.MaxRuntime))
+	if err := d.Stop(ctx); err != nil {
+		slog.ErrorContext(ctx, "failed to stop daemon after its maximum runtime", slog.String("name", d.Name), slog.Any("error", err))
+	}
+}
+
+// Wait blocks until the process of the daemon exits and returns its exit
+// error, which is nil for a successful exit or one caused by a signal. It may
+// be called from multiple goroutines. Wait returns ErrDaemonNotRunning if the
+// daemon was never started.
+func (d *Daemon) Wait() error {
+	d.stateMu.Lock()
+	started, done := !d.startedAt.IsZero(), d.done
+	d.stateMu.Unlock()
+	if !started {
+		return ErrDaemonNotRunning
+	}
+	<-done
+	return d.exitErr()
+}
+
+// exitErr returns the exit error of the last run.
+func (d *Daemon) exitErr() error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.exitError
+}
+
+// ExitCode returns the exit code of the exited daemon, or -1 if it has not
+// exited or was terminated by a signal.
+func (d *Daemon) ExitCode() int {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	select {
+	case <-d.done:
+		return d.exitCode
+	default:
+		return -1
+	}
+}
+
+// PID returns the process id of the running daemon, or -1 if it is not
+// running.
+func (d *Daemon) PID() int {
+	select {
+	case <-d.doneCh():
+		return -1
+	default:
+	}
+	cmd := d.cmd.Load()
+	if cmd == nil || cmd.Process == nil {
+		return -1
+	}
+	return cmd.Process.Pid
+}
+
+// signalTarget is what the signals of a daemon are sent to: its process
+// group, or only its process when the group cannot be looked up.
+type signalTarget struct {
+	id    int
+	group bool
+}
+
+// kill sends a signal like syscall.Kill. Tests replace it to observe the
+// order in which processes are signalled.
+var kill = syscall.Kill
+
+// kill sends sig to every process of the target at once.
+func (t signalTarget) kill(sig syscall.Signal) error {
+	if t.group {
+		return kill(-t.id, sig)
+	}
+	return kill(t.id, sig)
+}
+
+func (d *Daemon) target() (signalTarget, error) {
+	return commandTarget(d.cmd.Load())
+}
+
+// commandTarget returns the process group of cmd. If the group cannot be
+// looked up for another reason than the process being gone, e.g. on a
+// platform without process groups, it falls back to the process itself.
+func commandTarget(cmd *exec.Cmd) (signalTarget, error) {
+	if cmd == nil || cmd.Process == nil {
+		return signalTarget{}, ErrDaemonNotRunning
+	}
+	pid := cmd.Process.Pid
+	pgid, err := getpgid(pid)
+	if errors.Is(err, syscall.ESRCH) {
+		return signalTarget{}, err
 	}
-	return syscall.Getpgid(d.cmd.Process.Pid)
+	if err != nil {
+		slog.Debug("failed to look up process group, signalling the process", slog.Int("pid", pid), slog.Any("error", err))
+		return signalTarget{id: pid}, nil
+	}
+	return signalTarget{id: pgid, group: true}, nil
+}
+
+// signal sends sig to the processes of t. Without a process group, the
+// descendants of the process are signalled first, as far as they can be
+// found, so that they do not outlive it.
+func (d *Daemon) signal(t signalTarget, sig syscall.Signal) error {
+	if !t.group {
+		pids, err := descendantProcesses(t.id)
+		if err != nil {
+			slog.Debug("failed to list descendant processes, signalling the process only", slog.String("name", d.Name), slog.Any("error", err))
+		}
+		for _, pid := range pids {
+			_ = kill(pid, sig)
+		}
+		return t.kill(sig)
+	}
+	if d.KillLeavesFirst {
+		pids, err := groupProcesses(t.id)
+		if err != nil {
+			slog.Debug("failed to list process group, signalling the group", slog.String("name", d.Name), slog.Any("error", err))
+		}
+		for _, pid := range pids {
+			_ = kill(pid, sig)
+		}
+	}
+	// Signal the whole group as well to catch processes spawned meanwhile.
+	err := t.kill(sig)
+	if d.KillLeavesFirst && errors.Is(err, syscall.ESRCH) {
+		// every member already exited on its own signal
+		return nil
+	}
+	return err
 }
 
 var ErrGracefulShutdownTimeout = errors.New("graceful shutdown timed out")
 
+// DefaultStopSignals asks the process to exit with SIGINT first and SIGTERM
+// halfway through the stop timeout.
+var DefaultStopSignals = []syscall.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+const DefaultStopTimeout = 10 * time.Second
+
+func (d *Daemon) clock() Clock {
+	if d.Clock == nil {
+		return realClock{}
+	}
+	return d.Clock
+}
+
+// Stop stops the daemon. A pending background start is cancelled, so that
+// the daemon is not launched after Stop returns.
 func (d *Daemon) Stop(ctx context.Context) error {
+	return d.traceStop(ctx, true)
+}
+
+// stopLaunched stops the process of a start that failed after launching it,
+// leaving a pending background start to record the failure.
+func (d *Daemon) stopLaunched(ctx context.Context) error {
+	return d.traceStop(ctx, false)
+}
+
+func (d *Daemon) traceStop(ctx context.Context, cancelPending bool) error {
+	ctx, span, end := d.startSpan(ctx, SpanStop)
+	err := d.stop(ctx, cancelPending)
+	span.SetAttributes(attribute.Int("daemon.exit_code", d.ExitCode()))
+	end(err)
+	return err
+}
+
+func (d *Daemon) stop(ctx context.Context, cancelPending bool) error {
+	// This waits for a launch under way, which takes mu in reset, so it is
+	// done before mu is taken.
+	cancelled := cancelPending && d.cancelPending()
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if d.cmd == nil || d.cmd.Process == nil {
+	if d.stopped {
+		return nil
+	}
+	if cmd := d.cmd.Load(); cmd == nil || cmd.Process == nil {
+		if cancelled {
+			return nil
+		}
 		return ErrDaemonNotRunning
 	}
+	d.stopRequested.Store(true)
+	select {
+	case <-d.doneCh():
+		// Do not signal a process that already exited; its pid may have
+		// been reused.
+		d.stopped = true
+		return d.exitErr()
+	default:
+	}
 
-	pgid, err := d.pgid()
+	target, err := d.target()
 	if err != nil {
 		return fmt.Errorf("pgid: %w", err)
 	}
 
-	// Graceful-stop
-	if err := syscall.Kill(-pgid, syscall.SIGINT); err != nil && !errors.Is(err, os.ErrProcessDone) {
-		return fmt.Errorf("sigterm: %w", err)
+	signals := d.StopSignals
+	if len(signals) == 0 {
+		signals = DefaultStopSignals
+	}
+	timeout := d.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
 	}
+	step := timeout / time.Duration(len(signals))
 
-	select {
-	case <-ctx.Done():
-		// 呼び出し側が辛抱切れ → SIGKILL
-		_ = syscall.Kill(-pgid, syscall.SIGKILL)
-		<-d.done
-		slog.InfoContext(ctx, "daemon %s stopped", slog.Any("error", ctx.Err()))
-		return ctx.Err()
-	case <-d.done:
-		if d.exitError != nil {
-			return d.exitError
+	// Graceful-stop, escalating through the stop signals
+	// ESRCH means the process exited meanwhile; the wait below notices.
+	if err := d.signal(target, signals[0]); err != nil && !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("%s: %w", signals[0], err)
+	}
+	// Every path below waits for the process to exit.
+	defer func() { d.stopped = true }()
+
+	for i := 1; ; i++ {
+		select {
+		case <-ctx.Done():
+			// 呼び出し側が辛抱切れ → SIGKILL
+			_ = d.signal(target, syscall.SIGKILL)
+			<-d.doneCh()
+			d.setLastStop(syscall.SIGKILL, true)
+			slog.InfoContext(ctx, "daemon %s stopped", slog.Any("error", ctx.Err()))
+			return ctx.Err()
+		case <-d.doneCh():
+			d.setLastStop(signals[i-1], false)
+			return d.exitErr()
+		case <-d.clock().After(step):
 		}
-		return nil
-	case <-time.After(10 * time.Second):
-		_ = syscall.Kill(-pgid, syscall.SIGKILL)
-		<-d.done
-		return ErrGracefulShutdownTimeout
+		if i == len(signals) {
+			_ = d.signal(target, syscall.SIGKILL)
+			<-d.doneCh()
+			d.setLastStop(syscall.SIGKILL, true)
+			return ErrGracefulShutdownTimeout
+		}
+		// The group may be exiting already; the wait above notices.
+		_ = d.signal(target, signals[i])
 	}
 }
 
+// Restart stops the daemon if it is running and starts it again with the
+// same configuration and logger. Unlike the daemonize_restart tool, it
+// reuses d rather than replacing it.
+func (d *Daemon) Restart(ctx context.Context) error {
+	status, err := d.Status()
+	if err != nil {
+		return err
+	}
+	if status.active() {
+		if err := d.Stop(ctx); err != nil {
+			return fmt.Errorf("failed to stop daemon %s: %w", d.Name, err)
+		}
+	}
+	if err := d.Start(ctx); err != nil {
+		return err
+	}
+	d.addRestart()
+	return nil
+}
+
+func (d *Daemon) addRestart() {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	d.restarts++
+}
+
+// doneCh returns the channel closed when the process of the current run
+// exits.
+func (d *Daemon) doneCh() <-chan struct{} {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.done
+}
+
+// reset clears the state of the previous run of an exited daemon, so that
+// it can be started again. Every run gets a fresh done channel.
+func (d *Daemon) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = false
+	d.stopRequested.Store(false)
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	d.cmd.Store(nil)
+	d.exitError = nil
+	d.exitCode = -1
+	d.exitSignal = 0
+	d.exitReason = ""
+	d.startedAt = time.Time{}
+	d.exitedAt = time.Time{}
+	d.done = make(chan struct{})
+	d.exited = false
+	d.failure = nil
+	d.logErr = nil
+	d.lastStopSignal = 0
+	d.lastStopForced = false
+	d.health = HealthStatusNone
+	d.healthErr = nil
+	d.healthFailures = 0
+}
+
+func (d *Daemon) setLastStop(sig syscall.Signal, forced bool) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	d.lastStopSignal = sig
+	d.lastStopForced = forced
+}
+
+// LastStopForced reports whether the process was killed with SIGKILL by the
+// last Stop, because it outlived the stop timeout or the context of Stop
+// ended, rather than exiting on a stop signal.
+func (d *Daemon) LastStopForced() bool {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.lastStopForced
+}
+
+// LastStopSignal returns the signal sent by the last Stop that the process
+// exited on, or zero if Stop did not signal it.
+func (d *Daemon) LastStopSignal() syscall.Signal {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.lastStopSignal
+}
+
 func (d *Daemon) Status() (DaemonStatus, error) {
-	if d.cmd == nil || d.cmd.Process == nil {
+	return d.status(d.cmd.Load(), d.doneCh())
+}
+
+// status returns the status of the daemon given the process and the done
+// channel of its current run.
+func (d *Daemon) status(cmd *exec.Cmd, done <-chan struct{}) (DaemonStatus, error) {
+	// A daemon pending a background start is starting until that start has
+	// finished, including before its process is launched and between the
+	// attempts of StartGrace.
+	if d.pending.Load() {
+		return DaemonStatusStarting, nil
+	}
+	if cmd == nil || cmd.Process == nil {
 		return DaemonStatusStopped, nil
 	}
-	pgid, err := d.pgid()
+	// Once Wait has returned the pid may be reused by another process, so
+	// the recorded exit is authoritative.
+	select {
+	case <-done:
+		return DaemonStatusStopped, nil
+	default:
+	}
+	target, err := commandTarget(cmd)
 	if err != nil {
 		// no such process
 		if errors.Is(err, syscall.ESRCH) {
-			d.cmd = nil
+			d.cmd.CompareAndSwap(cmd, nil)
 			return DaemonStatusStopped, nil
 		}
 		return DaemonStatusStopped, fmt.Errorf("pgid: %w", err)
 	}
-	if err := syscall.Kill(-pgid, 0); err != nil {
-		if errors.Is(err, os.ErrProcessDone) {
-			d.cmd = nil
+	if err := target.kill(0); err != nil {
+		// The group may have exited since its pgid was looked up.
+		if errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH) {
+			d.cmd.CompareAndSwap(cmd, nil)
 			return DaemonStatusStopped, nil
 		}
 		return DaemonStatusStopped, fmt.Errorf("daemon %s is not running: %w", d.Name, err)
 	}
+	if d.starting.Load() {
+		return DaemonStatusStarting, nil
+	}
 	return DaemonStatusRunning, nil
 }
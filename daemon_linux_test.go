@@ -0,0 +1,501 @@
+package daemonize_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	daemonize "github.com/mackee/mcp-daemonize"
+)
+
+// liveGroupMembers returns the pids of non-zombie processes in the process group pgid.
+func liveGroupMembers(t *testing.T, pgid int) []int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		t.Fatalf("read /proc: %v", err)
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+		if string(fields[0]) == "Z" {
+			continue
+		}
+		if pgrp, _ := strconv.Atoi(string(fields[2])); pgrp == pgid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// TestStopLeavesFirst ensures a supervisor that respawns its child on death leaves nothing behind.
+func TestStopLeavesFirst(t *testing.T) {
+	d := daemonize.NewDaemon(
+		"respawner",
+		[]string{"sh", "-c", "echo $$; while true; do sleep 100; done"},
+		t.TempDir(),
+	)
+	d.KillLeavesFirst = true
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	for range 50 {
+		if d.Logger.Lines() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines, err := d.Logger.ReadLine(0)
+	if err != nil {
+		t.Fatalf("ReadLine error: %v", err)
+	}
+	pgid, err := strconv.Atoi(lines[0])
+	if err != nil {
+		t.Fatalf("parsing pgid: %v", err)
+	}
+	// Wait for the first child to be spawned.
+	for range 50 {
+		if len(liveGroupMembers(t, pgid)) > 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pids := liveGroupMembers(t, pgid); len(pids) > 0 {
+		t.Errorf("processes %v of group %d are still running", pids, pgid)
+	}
+}
+
+// parentPID returns the parent of the process pid.
+func parentPID(t *testing.T, pid int) int {
+	t.Helper()
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		t.Fatalf("read stat of %d: %v", pid, err)
+	}
+	fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+	ppid, _ := strconv.Atoi(string(fields[1]))
+	return ppid
+}
+
+// TestStopLeavesFirstOrder ensures every process of the group is signalled before its parent.
+func TestStopLeavesFirstOrder(t *testing.T) {
+	var mu sync.Mutex
+	var signalled []int
+	restore := daemonize.SetKill(func(pid int, sig syscall.Signal) error {
+		if sig == syscall.SIGTERM && pid > 0 {
+			mu.Lock()
+			signalled = append(signalled, pid)
+			mu.Unlock()
+		}
+		return syscall.Kill(pid, sig)
+	})
+	t.Cleanup(restore)
+	d := daemonize.NewDaemon("tree", []string{"sh", "-c", "sh -c 'sleep 100 & wait' & wait"}, t.TempDir())
+	d.KillLeavesFirst = true
+	d.StopSignals = []syscall.Signal{syscall.SIGTERM}
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	root := d.PID()
+	for range 100 {
+		if len(liveGroupMembers(t, root)) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	levels := map[int]string{root: "root"}
+	for _, pid := range liveGroupMembers(t, root) {
+		switch ppid := parentPID(t, pid); {
+		case ppid == root:
+			levels[pid] = "middle"
+		case pid != root:
+			levels[pid] = "leaf"
+		}
+	}
+	if len(levels) != 3 {
+		t.Fatalf("process tree = %v, want a root, a middle and a leaf process", levels)
+	}
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var order []string
+	for _, pid := range signalled {
+		if level, ok := levels[pid]; ok {
+			order = append(order, level)
+		}
+	}
+	if want := []string{"leaf", "middle", "root"}; !slices.Equal(order, want) {
+		t.Errorf("processes signalled in order %v, want %v", order, want)
+	}
+}
+
+// TestStats ensures a running daemon reports a positive resident memory size.
+func TestStats(t *testing.T) {
+	d := daemonize.NewDaemon("stats", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatalf("Stats error: %v", err)
+	}
+	if stats.RSS <= 0 {
+		t.Errorf("RSS = %d, want positive", stats.RSS)
+	}
+	if stats.CPUPercent < 0 {
+		t.Errorf("CPUPercent = %f, want non-negative", stats.CPUPercent)
+	}
+}
+
+// TestStatsThreads ensures the thread count of a multi-threaded daemon is reported.
+func TestStatsThreads(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	script := "import threading, time\n" +
+		"for _ in range(4):\n" +
+		"    threading.Thread(target=time.sleep, args=(100,), daemon=True).start()\n" +
+		"print('started', flush=True)\n" +
+		"time.sleep(100)\n"
+	d := daemonize.NewDaemon("threads", []string{"python3", "-c", script}, t.TempDir())
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Logger.Lines() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("threads were not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatalf("Stats error: %v", err)
+	}
+	if stats.Threads < 5 || stats.Threads > 64 {
+		t.Errorf("Threads = %d, want between 5 and 64", stats.Threads)
+	}
+}
+
+// TestStartMaxProcesses ensures the process limit is applied to the daemon.
+func TestStartMaxProcesses(t *testing.T) {
+	d := daemonize.NewDaemon("nproc", []string{"grep", "Max processes", "/proc/self/limits"}, t.TempDir())
+	d.MaxProcesses = 4321
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	waitStatus(t, d, daemonize.DaemonStatusStopped)
+	lines, err := d.Logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	if len(lines) == 0 || !strings.Contains(lines[0], "4321") {
+		t.Errorf("limits = %q, want max processes of 4321", lines)
+	}
+}
+
+// TestStartNice ensures the nice value is applied to the daemon.
+func TestStartNice(t *testing.T) {
+	d := daemonize.NewDaemon("nice", []string{"sleep", "100"}, t.TempDir())
+	d.Nice = 7
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer d.Stop(context.Background())
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(d.PID()) + "/stat")
+	if err != nil {
+		t.Fatalf("read stat: %v", err)
+	}
+	// nice is the 19th field; fields after the command name start at the 3rd.
+	fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+	if got := string(fields[16]); got != "7" {
+		t.Errorf("nice = %s, want 7", got)
+	}
+}
+
+// cpusAllowed returns the Cpus_allowed_list of the process pid.
+func cpusAllowed(t *testing.T, pid string) string {
+	t.Helper()
+	status, err := os.ReadFile("/proc/" + pid + "/status")
+	if err != nil {
+		t.Fatalf("read status: %v", err)
+	}
+	for line := range strings.Lines(string(status)) {
+		if list, ok := strings.CutPrefix(line, "Cpus_allowed_list:"); ok {
+			return strings.TrimSpace(list)
+		}
+	}
+	t.Fatal("no Cpus_allowed_list in status")
+	return ""
+}
+
+// TestStartCPUs ensures the daemon is pinned to the CPUs it is given.
+func TestStartCPUs(t *testing.T) {
+	allowed, err := daemonize.ParseCPUList(cpusAllowed(t, "self"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last CPU differs from the inherited set whenever more than one is allowed.
+	cpu := strconv.Itoa(allowed[len(allowed)-1])
+	d := daemonize.NewDaemon("pinned", []string{"sleep", "100"}, t.TempDir())
+	d.CPUs = cpu
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer d.Stop(context.Background())
+	if got := cpusAllowed(t, strconv.Itoa(d.PID())); got != cpu {
+		t.Errorf("Cpus_allowed_list = %s, want %s", got, cpu)
+	}
+}
+
+// parentHelperEnv makes TestParentDeathSignalHelper act as the server.
+const parentHelperEnv = "DAEMONIZE_TEST_PARENT"
+
+// TestParentDeathSignalHelper is run in a subprocess by
+// TestParentDeathSignal. It starts a daemon, prints its pid and exits
+// without stopping it.
+func TestParentDeathSignalHelper(t *testing.T) {
+	if os.Getenv(parentHelperEnv) == "" {
+		t.Skip("helper process of TestParentDeathSignal")
+	}
+	d := daemonize.NewDaemon("orphan", []string{"sleep", "100"}, os.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	fmt.Println(d.PID())
+	os.Exit(0)
+}
+
+// TestParentDeathSignal ensures a daemon is terminated when the server process dies without stopping it.
+func TestParentDeathSignal(t *testing.T) {
+	helper := exec.Command(os.Args[0], "-test.run=^TestParentDeathSignalHelper$")
+	helper.Env = append(os.Environ(), parentHelperEnv+"=1")
+	out, err := helper.Output()
+	if err != nil {
+		t.Fatalf("helper error: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatalf("helper output %q is not a pid", out)
+	}
+	if !processGone(pid) {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+		t.Fatal("daemon still running after the server exited")
+	}
+}
+
+// processGone waits up to two seconds for the process pid to exit and
+// reports whether it did.
+func processGone(pid int) bool {
+	for range 200 {
+		stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		// The orphan may be left a zombie when nothing reaps it.
+		if err != nil || string(bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])[0]) == "Z" {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// shellParentHelperEnv makes TestParentDeathSignalShellHelper act as the
+// server, running the command line it holds.
+const shellParentHelperEnv = "DAEMONIZE_TEST_SHELL_PARENT"
+
+// TestParentDeathSignalShellHelper is run in a subprocess by
+// TestParentDeathSignalShell. It starts a daemon running a command line that
+// prints the pid of its workload, prints the pid of the daemon and that of
+// the workload and exits without stopping it.
+func TestParentDeathSignalShellHelper(t *testing.T) {
+	line := os.Getenv(shellParentHelperEnv)
+	if line == "" {
+		t.Skip("helper process of TestParentDeathSignalShell")
+	}
+	d := daemonize.NewDaemon("orphan", []string{"/bin/sh", "-c", line}, os.TempDir())
+	d.ReadyLog = regexp.MustCompile(`^\d+$`)
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	last, _ := d.Logger.Last()
+	fmt.Println(d.PID(), last.Text)
+	os.Exit(0)
+}
+
+// TestParentDeathSignalShell ensures the parent death signal reaches the
+// shell of a command line but not a workload the shell spawned, unless the
+// shell execs it.
+func TestParentDeathSignalShell(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		workloadGone bool
+	}{
+		{"spawned", "sleep 100 & echo $!; wait", false},
+		{"exec", "echo $$; exec sleep 100", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helper := exec.Command(os.Args[0], "-test.run=^TestParentDeathSignalShellHelper$")
+			helper.Env = append(os.Environ(), shellParentHelperEnv+"="+tt.line)
+			out, err := helper.Output()
+			if err != nil {
+				t.Fatalf("helper error: %v", err)
+			}
+			var shell, workload int
+			if _, err := fmt.Sscan(string(out), &shell, &workload); err != nil {
+				t.Fatalf("helper output %q is not two pids", out)
+			}
+			t.Cleanup(func() { _ = syscall.Kill(workload, syscall.SIGKILL) })
+			if !processGone(shell) {
+				t.Fatal("shell still running after the server exited")
+			}
+			if gone := processGone(workload); gone != tt.workloadGone {
+				t.Errorf("workload gone = %v after the server exited, want %v", gone, tt.workloadGone)
+			}
+		})
+	}
+}
+
+// detachedHelperEnv makes TestDetachedOutputHelper act as the server.
+const detachedHelperEnv = "DAEMONIZE_TEST_DETACHED"
+
+// TestDetachedOutputHelper is run in a subprocess by
+// TestDetachedOutputAfterServerExit. It starts a detached daemon that keeps
+// writing output, prints its pid and exits.
+func TestDetachedOutputHelper(t *testing.T) {
+	if os.Getenv(detachedHelperEnv) == "" {
+		t.Skip("helper process of TestDetachedOutputAfterServerExit")
+	}
+	d := daemonize.NewDaemon("chatty", []string{"sh", "-c", "while :; do echo tick; echo tock >&2; sleep 0.01; done"}, os.TempDir())
+	d.Detached = true
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	fmt.Println(d.PID())
+	os.Exit(0)
+}
+
+// TestDetachedOutputAfterServerExit ensures a detached daemon that writes output keeps running once the server process is gone.
+func TestDetachedOutputAfterServerExit(t *testing.T) {
+	helper := exec.Command(os.Args[0], "-test.run=^TestDetachedOutputHelper$")
+	helper.Env = append(os.Environ(), detachedHelperEnv+"=1")
+	out, err := helper.Output()
+	if err != nil {
+		t.Fatalf("helper error: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatalf("helper output %q is not a pid", out)
+	}
+	t.Cleanup(func() {
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		// The output file outlives the server and is left behind.
+		files, _ := filepath.Glob(filepath.Join(os.TempDir(), "mcp-daemonize-chatty-*.log"))
+		for _, f := range files {
+			os.Remove(f)
+		}
+	})
+	// Give the daemon time for many writes after the server exited.
+	time.Sleep(300 * time.Millisecond)
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil || string(bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])[0]) == "Z" {
+		t.Fatal("detached daemon died after the server exited")
+	}
+}
+
+// TestEnvDiff ensures a daemon that keeps its launch environment shows no differences.
+func TestEnvDiff(t *testing.T) {
+	t.Setenv("DAEMONIZE_TEST_ENV", "known")
+	d := daemonize.NewDaemon("env", []string{"sleep", "100"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer d.Stop(context.Background())
+	changes, err := d.EnvDiff()
+	if err != nil {
+		t.Fatalf("EnvDiff error: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("EnvDiff() = %+v, want no changes", changes)
+	}
+}
+
+// TestStatusAfterPIDReuse ensures a stopped daemon stays stopped when its pid
+// is taken by a new process group leader.
+func TestStatusAfterPIDReuse(t *testing.T) {
+	const lastPID = "/proc/sys/kernel/ns_last_pid"
+	if f, err := os.OpenFile(lastPID, os.O_WRONLY, 0); err != nil {
+		t.Skipf("cannot control pid allocation: %v", err)
+	} else {
+		f.Close()
+	}
+	d := daemonize.NewDaemon("reuse", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	pid := d.PID()
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	// Other processes may fork concurrently, so retry until the pid is taken.
+	for range 10 {
+		if err := os.WriteFile(lastPID, []byte(strconv.Itoa(pid-1)), 0); err != nil {
+			t.Fatalf("write %s: %v", lastPID, err)
+		}
+		cmd := exec.Command("sleep", "100")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start error: %v", err)
+		}
+		reused := cmd.Process.Pid == pid
+		if reused {
+			status, err := d.Status()
+			if err != nil {
+				t.Errorf("Status error: %v", err)
+			}
+			if status != daemonize.DaemonStatusStopped {
+				t.Errorf("Status() = %q after pid reuse, want %q", status, daemonize.DaemonStatusStopped)
+			}
+		}
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if reused {
+			return
+		}
+	}
+	t.Skip("pid was not reused")
+}
@@ -3,13 +3,29 @@ package daemonize_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	daemonize "github.com/mackee/mcp-daemonize"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TestMemoryLogger verifies that the in-memory logger records and returns lines correctly.
@@ -170,3 +186,1041 @@ func TestStopKillsDescendants(t *testing.T) {
 		t.Errorf("unexpected error checking child process: %v", err)
 	}
 }
+
+// countingLogger counts the bytes written through it.
+type countingLogger struct {
+	daemonize.Logger
+	n atomic.Int64
+}
+
+func (c *countingLogger) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return c.Logger.Write(p)
+}
+
+// TestSetLogger swaps loggers while a daemon writes and ensures no output is lost.
+func TestSetLogger(t *testing.T) {
+	const count = 2000
+	want := 0
+	for i := range count {
+		want += len(strconv.Itoa(i)) + 1
+	}
+	d := daemonize.NewDaemon(
+		"writer",
+		[]string{"sh", "-c", "i=0; while [ $i -lt " + strconv.Itoa(count) + " ]; do echo $i; i=$((i+1)); done"},
+		t.TempDir(),
+	)
+	first := &countingLogger{Logger: daemonize.NewMemoryLogger()}
+	d.SetLogger(first)
+	loggers := []*countingLogger{first}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	for range 10 {
+		l := &countingLogger{Logger: daemonize.NewMemoryLogger()}
+		d.SetLogger(l)
+		loggers = append(loggers, l)
+		time.Sleep(time.Millisecond)
+	}
+	for range 500 {
+		status, err := d.Status()
+		if err != nil {
+			t.Fatalf("Status error: %v", err)
+		}
+		if status == daemonize.DaemonStatusStopped {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var got int64
+	for _, l := range loggers {
+		got += l.n.Load()
+	}
+	if got != int64(want) {
+		t.Errorf("loggers received %d bytes, want %d", got, want)
+	}
+}
+
+// TestStartReadyTCP ensures Start waits for the readiness address to accept connections.
+func TestStartReadyTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	defer ln.Close()
+	d := daemonize.NewDaemon("ready", []string{"sleep", "100"}, t.TempDir())
+	d.ReadyTCP = ln.Addr().String()
+	d.ReadyTimeout = 5 * time.Second
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	status, err := d.Status()
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+	if status != daemonize.DaemonStatusRunning {
+		t.Errorf("After Start, Status() = %q, want %q", status, daemonize.DaemonStatusRunning)
+	}
+}
+
+// TestStartReadyTCPTimeout ensures a daemon that never becomes ready fails to start and is stopped.
+func TestStartReadyTCPTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	d := daemonize.NewDaemon("never", []string{"sleep", "100"}, t.TempDir())
+	d.ReadyTCP = addr
+	d.ReadyTimeout = 200 * time.Millisecond
+	err = d.Start(context.Background())
+	if !errors.Is(err, daemonize.ErrReadyTimeout) {
+		t.Fatalf("Start error = %v, want ErrReadyTimeout", err)
+	}
+	status, err := d.Status()
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+	if status != daemonize.DaemonStatusStopped {
+		t.Errorf("After failed Start, Status() = %q, want %q", status, daemonize.DaemonStatusStopped)
+	}
+}
+
+// TestStartReadyLog ensures Start waits for an output line matching the readiness pattern.
+func TestStartReadyLog(t *testing.T) {
+	d := daemonize.NewDaemon("ready", []string{"sh", "-c", "echo starting; sleep 0.3; echo listening on :8080; exec sleep 100"}, t.TempDir())
+	d.ReadyLog = regexp.MustCompile(`listening on`)
+	d.ReadyTimeout = 5 * time.Second
+	ctx := context.Background()
+	start := time.Now()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Start returned after %s, before the ready line was printed", elapsed)
+	}
+	last, ok := d.Logger.Last()
+	if !ok || last.Text != "listening on :8080" {
+		t.Errorf("last log line = %q, want the ready line", last.Text)
+	}
+
+	never := daemonize.NewDaemon("never", []string{"sh", "-c", "echo starting; exec sleep 100"}, t.TempDir())
+	never.ReadyLog = regexp.MustCompile(`listening on`)
+	never.ReadyTimeout = 200 * time.Millisecond
+	if err := never.Start(ctx); !errors.Is(err, daemonize.ErrReadyTimeout) {
+		t.Errorf("Start error = %v, want ErrReadyTimeout", err)
+	}
+}
+
+// TestStartReadyNotify ensures Start waits for READY=1 on the daemon's own notify socket, not the server's.
+func TestStartReadyNotify(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	// A fake notify socket of a service manager supervising the server.
+	serverSocket := filepath.Join(t.TempDir(), "notify.sock")
+	manager, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: serverSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram error: %v", err)
+	}
+	defer manager.Close()
+	t.Setenv("NOTIFY_SOCKET", serverSocket)
+
+	script := `import os, socket, time
+time.sleep(0.3)
+s = socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM)
+s.sendto(b"STATUS=up\nREADY=1", os.environ["NOTIFY_SOCKET"])
+time.sleep(100)
+`
+	d := daemonize.NewDaemon("notify", []string{"python3", "-c", script}, t.TempDir())
+	d.ReadyNotify = true
+	d.ReadyTimeout = 5 * time.Second
+	ctx := context.Background()
+	start := time.Now()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Start returned after %s, before READY=1 was sent", elapsed)
+	}
+	_ = manager.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := manager.Read(make([]byte, 64)); err == nil {
+		t.Errorf("server notify socket received %d bytes, want none", n)
+	}
+
+	never := daemonize.NewDaemon("never", []string{"sleep", "100"}, t.TempDir())
+	never.ReadyNotify = true
+	never.ReadyTimeout = 200 * time.Millisecond
+	if err := never.Start(ctx); !errors.Is(err, daemonize.ErrReadyTimeout) {
+		t.Errorf("Start error = %v, want ErrReadyTimeout", err)
+	}
+}
+
+// TestStartTimeout ensures the start timeout aborts a daemon that never becomes ready before ReadyTimeout.
+func TestStartTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	d := daemonize.NewDaemon("never", []string{"sleep", "100"}, t.TempDir())
+	d.ReadyTCP = addr
+	d.StartTimeout = 200 * time.Millisecond
+	start := time.Now()
+	err = d.Start(context.Background())
+	if !errors.Is(err, daemonize.ErrStartTimeout) {
+		t.Fatalf("Start error = %v, want ErrStartTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Start took %s, want it bounded by the start timeout", elapsed)
+	}
+	if status, _ := d.Status(); status != daemonize.DaemonStatusStopped {
+		t.Errorf("After timed out Start, Status() = %q, want %q", status, daemonize.DaemonStatusStopped)
+	}
+}
+
+// TestHealthCheck ensures the health state follows a check that flips from passing to failing.
+func TestHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "healthy")
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	d := daemonize.NewDaemon("health", []string{"sleep", "100"}, dir)
+	d.HealthCheck = []string{"test", "-f", "healthy"}
+	d.HealthInterval = 20 * time.Millisecond
+	d.HealthRetries = 2
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+
+	waitHealth := func(want daemonize.HealthStatus) {
+		t.Helper()
+		for range 100 {
+			if d.Health() == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Health() = %q, want %q", d.Health(), want)
+	}
+	waitHealth(daemonize.HealthStatusHealthy)
+	if err := os.Remove(marker); err != nil {
+		t.Fatalf("Remove error: %v", err)
+	}
+	waitHealth(daemonize.HealthStatusUnhealthy)
+}
+
+// TestHealthCheckMissingWorkdir ensures a removed workdir is reported as the cause of failing health checks.
+func TestHealthCheckMissingWorkdir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "work")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("Mkdir error: %v", err)
+	}
+	d := daemonize.NewDaemon("health", []string{"sleep", "100"}, dir)
+	d.HealthCheck = []string{"true"}
+	d.HealthInterval = 20 * time.Millisecond
+	d.HealthRetries = 1
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	if err := os.Remove(dir); err != nil {
+		t.Fatalf("Remove error: %v", err)
+	}
+	for range 100 {
+		if d.Health() == daemonize.HealthStatusUnhealthy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := d.Health(); got != daemonize.HealthStatusUnhealthy {
+		t.Fatalf("Health() = %q, want %q", got, daemonize.HealthStatusUnhealthy)
+	}
+	err := d.HealthError()
+	if !errors.Is(err, daemonize.ErrWorkdirMissing) || !strings.Contains(err.Error(), dir) {
+		t.Errorf("HealthError() = %v, want ErrWorkdirMissing naming %s", err, dir)
+	}
+}
+
+// TestPID ensures PID reports the running process and -1 once stopped.
+func TestPID(t *testing.T) {
+	d := daemonize.NewDaemon("pid", []string{"sleep", "100"}, t.TempDir())
+	if got := d.PID(); got != -1 {
+		t.Errorf("before Start PID() = %d, want -1", got)
+	}
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	pid := d.PID()
+	if pid <= 0 {
+		t.Fatalf("after Start PID() = %d, want a positive pid", pid)
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Errorf("process %d is not running: %v", pid, err)
+	}
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if got := d.PID(); got != -1 {
+		t.Errorf("after Stop PID() = %d, want -1", got)
+	}
+}
+
+// TestStartAsUser ensures the daemon runs with the uid of the configured user.
+func TestStartAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching users requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("user nobody not found: %v", err)
+	}
+	d := daemonize.NewDaemon("asuser", []string{"id", "-u"}, "/")
+	d.User = "nobody"
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	for range 100 {
+		if d.Logger.Lines() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines, err := d.Logger.PeekLines(0, 1)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	if lines[0] != nobody.Uid {
+		t.Errorf("child uid = %s, want %s", lines[0], nobody.Uid)
+	}
+}
+
+// TestStartUnknownUser ensures an unknown user is reported before launching.
+func TestStartUnknownUser(t *testing.T) {
+	d := daemonize.NewDaemon("unknown", []string{"true"}, t.TempDir())
+	d.User = "no-such-user-for-daemonize"
+	err := d.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unknown user") {
+		t.Errorf("Start error = %v, want unknown user", err)
+	}
+}
+
+// TestStartMinUptime ensures a process exiting within the minimum uptime fails the start.
+func TestStartMinUptime(t *testing.T) {
+	d := daemonize.NewDaemon("early", []string{"sh", "-c", "sleep 0.02"}, t.TempDir())
+	d.MinUptime = 200 * time.Millisecond
+	s := daemonize.New(daemonize.WithDaemon(d))
+	err := d.Start(context.Background())
+	if !errors.Is(err, daemonize.ErrEarlyExit) {
+		t.Fatalf("Start error = %v, want ErrEarlyExit", err)
+	}
+	for range 100 {
+		if len(s.History()) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	history := s.History()
+	if len(history) != 1 || history[0].Reason != daemonize.ExitReasonEarlyExit {
+		t.Errorf("History() = %+v, want one %s record", history, daemonize.ExitReasonEarlyExit)
+	}
+}
+
+// TestStartMaxOpenFiles ensures the daemon cannot open descriptors beyond its limit.
+func TestStartMaxOpenFiles(t *testing.T) {
+	d := daemonize.NewDaemon(
+		"nofile",
+		[]string{"sh", "-c", "ulimit -n; paste" + strings.Repeat(" /dev/null", 10)},
+		t.TempDir(),
+	)
+	d.MaxOpenFiles = 8
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	waitStatus(t, d, daemonize.DaemonStatusStopped)
+	lines, err := d.Logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	// Output of the shell and paste may arrive in a single write.
+	out := strings.Join(lines, "\n")
+	if !strings.HasPrefix(out, "8\n") {
+		t.Errorf("output %q does not start with ulimit -n of 8", out)
+	}
+	if !strings.Contains(out, "Too many open files") {
+		t.Errorf("child did not hit the open files limit: %q", out)
+	}
+	if code := d.ExitCode(); code == 0 {
+		t.Errorf("ExitCode() = %d, want non-zero", code)
+	}
+}
+
+// TestStartUmask ensures files created by the daemon get permissions restricted by its umask.
+func TestStartUmask(t *testing.T) {
+	dir := t.TempDir()
+	d := daemonize.NewDaemon("umask", []string{"touch", "created"}, dir)
+	d.Umask = "027"
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if err := d.Wait(); err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "created"))
+	if err != nil {
+		t.Fatalf("Stat error: %v", err)
+	}
+	if got := info.Mode().Perm(); got != 0o640 {
+		t.Errorf("created file mode = %o, want 640", got)
+	}
+}
+
+// TestStartInvalidUmask ensures a umask that is not an octal mode is rejected before starting.
+func TestStartInvalidUmask(t *testing.T) {
+	d := daemonize.NewDaemon("umask", []string{"sleep", "100"}, t.TempDir())
+	d.Umask = "0999"
+	if err := d.Start(context.Background()); !errors.Is(err, daemonize.ErrInvalidUmask) {
+		t.Errorf("Start error = %v, want ErrInvalidUmask", err)
+	}
+}
+
+// TestFailureSpawnError ensures a missing binary is reported as a spawn failure.
+func TestFailureSpawnError(t *testing.T) {
+	d := daemonize.NewDaemon("missing", []string{"/nonexistent/daemonize-test-binary"}, t.TempDir())
+	err := d.Start(context.Background())
+	var spawnErr *daemonize.SpawnError
+	if !errors.As(err, &spawnErr) {
+		t.Fatalf("Start error = %v, want a SpawnError", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Start error = %v, want it to wrap ErrNotExist", err)
+	}
+	if !errors.As(d.Failure(), &spawnErr) {
+		t.Errorf("Failure() = %v, want a SpawnError", d.Failure())
+	}
+}
+
+// TestFailureExitError ensures a program that runs and exits non-zero is reported as an exit failure.
+func TestFailureExitError(t *testing.T) {
+	d := daemonize.NewDaemon("exit2", []string{"sh", "-c", "exit 2"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	err := d.Wait()
+	var exitErr *daemonize.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 2 {
+		t.Fatalf("Wait error = %v, want an ExitError with code 2", err)
+	}
+	if !errors.As(d.Failure(), &exitErr) || exitErr.Code != 2 {
+		t.Errorf("Failure() = %v, want an ExitError with code 2", d.Failure())
+	}
+	var spawnErr *daemonize.SpawnError
+	if errors.As(d.Failure(), &spawnErr) {
+		t.Errorf("Failure() = %v, want no SpawnError", d.Failure())
+	}
+}
+
+// TestStartInvalidNice ensures out of range nice values are rejected before starting.
+func TestStartInvalidNice(t *testing.T) {
+	d := daemonize.NewDaemon("nice", []string{"sleep", "100"}, t.TempDir())
+	d.Nice = 20
+	err := d.Start(context.Background())
+	if !errors.Is(err, daemonize.ErrInvalidNice) {
+		t.Fatalf("Start error = %v, want ErrInvalidNice", err)
+	}
+	if pid := d.PID(); pid != -1 {
+		t.Errorf("PID() = %d after rejected start, want -1", pid)
+	}
+}
+
+// TestStartInvalidCPUs ensures a malformed CPU list is rejected before launch.
+func TestStartInvalidCPUs(t *testing.T) {
+	for _, cpus := range []string{"a", "3-1", "0,", "-1"} {
+		d := daemonize.NewDaemon("cpus", []string{"sleep", "100"}, t.TempDir())
+		d.CPUs = cpus
+		if err := d.Start(context.Background()); !errors.Is(err, daemonize.ErrInvalidCPUs) {
+			t.Errorf("Start with cpus %q error = %v, want ErrInvalidCPUs", cpus, err)
+		}
+		if pid := d.PID(); pid != -1 {
+			t.Errorf("PID() = %d after rejected start, want -1", pid)
+		}
+	}
+}
+
+// TestStopTwice ensures concurrent and repeated Stop calls succeed without signalling again.
+func TestStopTwice(t *testing.T) {
+	d := daemonize.NewDaemon("twice", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() { errs <- d.Stop(ctx) }()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Errorf("concurrent Stop error: %v", err)
+		}
+	}
+	if err := d.Stop(ctx); err != nil {
+		t.Errorf("Stop after stop error: %v", err)
+	}
+}
+
+// TestStopKillsAfterTimeout ensures Stop kills a daemon ignoring the stop signals once the graceful stop timeout elapses on its clock.
+func TestStopKillsAfterTimeout(t *testing.T) {
+	d := daemonize.NewDaemon("stubborn", []string{"sh", "-c", "trap '' INT TERM; echo ready; exec sleep 100"}, t.TempDir())
+	d.Clock = &fakeClock{fires: 2}
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	for i := 0; d.Logger.Lines() == 0; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for the daemon to ignore SIGINT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := d.Stop(ctx); !errors.Is(err, daemonize.ErrGracefulShutdownTimeout) {
+		t.Errorf("Stop error = %v, want ErrGracefulShutdownTimeout", err)
+	}
+	if got := d.Clock.(*fakeClock).Delays(); !slices.Equal(got, []time.Duration{5 * time.Second, 5 * time.Second}) {
+		t.Errorf("Stop waited on %v, want [5s 5s]", got)
+	}
+	waitStatus(t, d, daemonize.DaemonStatusStopped)
+}
+
+// TestStopEscalatesToSIGTERM ensures a daemon ignoring SIGINT is stopped by SIGTERM before the SIGKILL stage.
+func TestStopEscalatesToSIGTERM(t *testing.T) {
+	d := daemonize.NewDaemon("termonly", []string{"sh", "-c", "trap '' INT; echo ready; exec sleep 100"}, t.TempDir())
+	d.StopTimeout = 4 * time.Second
+	clock := &fakeClock{fires: 1}
+	d.Clock = clock
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	for i := 0; d.Logger.Lines() == 0; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for the daemon to ignore SIGINT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := d.Stop(ctx); err != nil {
+		t.Errorf("Stop error = %v, want the daemon to exit on SIGTERM", err)
+	}
+	// The first half of the timeout elapsed before SIGTERM; the wait for
+	// the second half never fired.
+	if got := clock.Delays(); len(got) == 0 || got[0] != 2*time.Second {
+		t.Errorf("Stop waited on %v, want SIGTERM after 2s", got)
+	}
+	if d.LastStopForced() || d.LastStopSignal() != syscall.SIGTERM {
+		t.Errorf("LastStopForced() = %v, LastStopSignal() = %v, want a graceful stop on SIGTERM", d.LastStopForced(), d.LastStopSignal())
+	}
+}
+
+// TestStatusDuringStop ensures Status can be called concurrently with Start and Stop; run it with -race.
+func TestStatusDuringStop(t *testing.T) {
+	d := daemonize.NewDaemon("racy", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := d.Status(); err != nil {
+					t.Errorf("Status error: %v", err)
+					return
+				}
+				_ = d.PID()
+			}
+		}()
+	}
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if err := d.Stop(ctx); err != nil {
+		t.Errorf("Stop error: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusStopped {
+		t.Errorf("Status() = %q, %v, want stopped", status, err)
+	}
+}
+
+// TestWait ensures Wait returns the exit error to every waiter after the process exits.
+func TestWait(t *testing.T) {
+	d := daemonize.NewDaemon("wait", []string{"sh", "-c", "sleep 0.2; exit 2"}, t.TempDir())
+	if err := d.Wait(); !errors.Is(err, daemonize.ErrDaemonNotRunning) {
+		t.Errorf("Wait before Start = %v, want ErrDaemonNotRunning", err)
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() { errs <- d.Wait() }()
+	}
+	for range 2 {
+		err := <-errs
+		var ee *exec.ExitError
+		if !errors.As(err, &ee) || ee.ExitCode() != 2 {
+			t.Errorf("Wait() = %v, want exit status 2", err)
+		}
+	}
+	if status, _ := d.Status(); status != daemonize.DaemonStatusStopped {
+		t.Errorf("after Wait Status() = %q, want %q", status, daemonize.DaemonStatusStopped)
+	}
+}
+
+// TestStartStripANSI ensures escape sequences are removed from stored output.
+func TestStartStripANSI(t *testing.T) {
+	d := daemonize.NewDaemon(
+		"ansi",
+		[]string{"printf", `\033[1;31merror\033[0m: \033]0;title\007failed\033[K\n`},
+		t.TempDir(),
+	)
+	d.StripANSI = true
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	_ = d.Wait()
+	last, ok := d.Logger.Last()
+	if !ok {
+		t.Fatal("no output captured")
+	}
+	if want := "error: failed"; last.Text != want {
+		t.Errorf("stored line = %q, want %q", last.Text, want)
+	}
+}
+
+// TestStartStripANSISplit ensures an escape sequence split across writes is
+// removed as well.
+func TestStartStripANSISplit(t *testing.T) {
+	d := daemonize.NewDaemon(
+		"ansi",
+		[]string{"sh", "-c", `printf 'error\033[1;'; sleep 0.2; printf '31m: failed\033'; sleep 0.2; printf '[0m\n'`},
+		t.TempDir(),
+	)
+	d.StripANSI = true
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	_ = d.Wait()
+	last, ok := d.Logger.Last()
+	if !ok {
+		t.Fatal("no output captured")
+	}
+	if want := "error: failed"; last.Text != want {
+		t.Errorf("stored line = %q, want %q", last.Text, want)
+	}
+}
+
+// alternatingOutput writes to stdout and stderr in turn.
+const alternatingOutput = `for i in 1 2 3 4 5 6 7 8; do echo out$i; echo err$i >&2; done`
+
+// TestStartMergedOutputOrder verifies that stdout and stderr lines are stored in the order they were written.
+func TestStartMergedOutputOrder(t *testing.T) {
+	d := daemonize.NewDaemon("merged", []string{"sh", "-c", alternatingOutput}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	_ = d.Wait()
+	var want []string
+	for i := 1; i <= 8; i++ {
+		want = append(want, fmt.Sprintf("out%d", i), fmt.Sprintf("err%d", i))
+	}
+	if got, _ := d.Logger.PeekLines(0, 100); !slices.Equal(got, want) {
+		t.Errorf("stored lines = %q, want %q", got, want)
+	}
+}
+
+// TestStartTagStderr verifies that stderr lines are prefixed when captured separately.
+func TestStartTagStderr(t *testing.T) {
+	d := daemonize.NewDaemon("tagged", []string{"sh", "-c", alternatingOutput}, t.TempDir())
+	d.TagStderr = true
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	_ = d.Wait()
+	var stdout, stderr []string
+	lines, _ := d.Logger.PeekLines(0, 100)
+	for _, line := range lines {
+		if text, ok := strings.CutPrefix(line, "[stderr] "); ok {
+			stderr = append(stderr, text)
+		} else {
+			stdout = append(stdout, line)
+		}
+	}
+	var wantOut, wantErr []string
+	for i := 1; i <= 8; i++ {
+		wantOut = append(wantOut, fmt.Sprintf("out%d", i))
+		wantErr = append(wantErr, fmt.Sprintf("err%d", i))
+	}
+	if !slices.Equal(stdout, wantOut) || !slices.Equal(stderr, wantErr) {
+		t.Errorf("stdout = %q, stderr = %q, want %q and %q", stdout, stderr, wantOut, wantErr)
+	}
+}
+
+// TestStartTagStderrPartialLines verifies that an unended line of one stream is not joined with a line of the other.
+func TestStartTagStderrPartialLines(t *testing.T) {
+	d := daemonize.NewDaemon("tagged", []string{"sh", "-c", `printf abc; sleep 0.1; echo err >&2; sleep 0.1; echo def; printf tail`}, t.TempDir())
+	d.TagStderr = true
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	_ = d.Wait()
+	lines, _ := d.Logger.PeekLines(0, 100)
+	if want := []string{"[stderr] err", "abcdef", "tail"}; !slices.Equal(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
+
+// newRecordingTracer returns a tracer whose ended spans are kept by the
+// returned exporter.
+func newRecordingTracer(t *testing.T) (trace.Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	return provider.Tracer("daemonize_test"), exporter
+}
+
+// spanAttrs returns the attributes of a recorded span by key.
+func spanAttrs(s tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(s.Attributes))
+	for _, kv := range s.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+// TestStartStopSpans verifies that Start and Stop record spans with the daemon attributes.
+func TestStartStopSpans(t *testing.T) {
+	tracer, exporter := newRecordingTracer(t)
+	d := daemonize.NewDaemon("traced", []string{"sleep", "100"}, t.TempDir())
+	d.Tracer = tracer
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	pid := d.PID()
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	start, stop := spans[0], spans[1]
+	if start.Name != daemonize.SpanStart || stop.Name != daemonize.SpanStop {
+		t.Errorf("span names = %q, %q, want %q, %q", start.Name, stop.Name, daemonize.SpanStart, daemonize.SpanStop)
+	}
+	for _, s := range []tracetest.SpanStub{start, stop} {
+		if s.Status.Code == codes.Error {
+			t.Errorf("span %s has error status %q", s.Name, s.Status.Description)
+		}
+		attrs := spanAttrs(s)
+		if got := attrs["daemon.name"].AsString(); got != "traced" {
+			t.Errorf("span %s daemon.name = %q, want traced", s.Name, got)
+		}
+		if got := attrs["daemon.command"].AsString(); got != "sleep 100" {
+			t.Errorf("span %s daemon.command = %q, want sleep 100", s.Name, got)
+		}
+		if got, ok := attrs["daemon.duration_seconds"]; !ok || got.AsFloat64() < 0 {
+			t.Errorf("span %s daemon.duration_seconds = %v, want a non-negative duration", s.Name, got.Emit())
+		}
+	}
+	if got := spanAttrs(start)["daemon.pid"].AsInt64(); got != int64(pid) {
+		t.Errorf("start span daemon.pid = %d, want %d", got, pid)
+	}
+	if got := spanAttrs(stop)["daemon.exit_code"].AsInt64(); got != int64(d.ExitCode()) {
+		t.Errorf("stop span daemon.exit_code = %d, want %d", got, d.ExitCode())
+	}
+}
+
+// TestStartSpanRecordsError verifies that a failed start is recorded on its span.
+func TestStartSpanRecordsError(t *testing.T) {
+	tracer, exporter := newRecordingTracer(t)
+	d := daemonize.NewDaemon("traced", []string{"sleep", "100"}, t.TempDir())
+	d.Nice = 20
+	d.Tracer = tracer
+	err := d.Start(context.Background())
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	if got := spans[0].Status; got.Code != codes.Error || got.Description != err.Error() {
+		t.Errorf("span status = %v %q, want error %q", got.Code, got.Description, err)
+	}
+	if len(spans[0].Events) != 1 || spans[0].Events[0].Name != "exception" {
+		t.Errorf("span events = %v, want the recorded error", spans[0].Events)
+	}
+}
+
+// TestRestart verifies that Restart relaunches a running daemon with a new process and start time.
+func TestRestart(t *testing.T) {
+	d := daemonize.NewDaemon("sleeper", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	pid, startedAt := d.PID(), d.StartedAt()
+	if err := d.Restart(ctx); err != nil {
+		t.Fatalf("Restart error: %v", err)
+	}
+	defer d.Stop(ctx)
+	if got := d.PID(); got == -1 || got == pid {
+		t.Errorf("after Restart PID() = %d, want a new process other than %d", got, pid)
+	}
+	if !d.StartedAt().After(startedAt) {
+		t.Errorf("after Restart StartedAt() = %v, want after %v", d.StartedAt(), startedAt)
+	}
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusRunning {
+		t.Errorf("after Restart Status() = %q, %v, want %q", status, err, daemonize.DaemonStatusRunning)
+	}
+	if code := d.ExitCode(); code != -1 {
+		t.Errorf("after Restart ExitCode() = %d, want -1", code)
+	}
+}
+
+// TestSnapshot verifies that a snapshot reflects the state of a running and then an exited daemon.
+func TestSnapshot(t *testing.T) {
+	command := []string{"sleep", "100"}
+	d := daemonize.NewDaemon("snap", command, t.TempDir())
+	if info := d.Snapshot(); info.Status != daemonize.DaemonStatusStopped || info.PID != -1 || !info.StartedAt.IsZero() {
+		t.Errorf("Snapshot() before Start = %+v, want a stopped daemon never started", info)
+	}
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if err := d.Restart(ctx); err != nil {
+		t.Fatalf("Restart error: %v", err)
+	}
+	defer d.Stop(ctx)
+	time.Sleep(10 * time.Millisecond)
+	info := d.Snapshot()
+	if info.Name != "snap" || !slices.Equal(info.Command, command) {
+		t.Errorf("Snapshot() name and command = %q, %q, want %q, %q", info.Name, info.Command, "snap", command)
+	}
+	if info.Status != daemonize.DaemonStatusRunning || info.PID != d.PID() || info.PID <= 0 {
+		t.Errorf("Snapshot() status and pid = %q, %d, want running with pid %d", info.Status, info.PID, d.PID())
+	}
+	if !info.StartedAt.Equal(d.StartedAt()) || info.Uptime < 10*time.Millisecond {
+		t.Errorf("Snapshot() started at %v with uptime %s, want %v and at least 10ms", info.StartedAt, info.Uptime, d.StartedAt())
+	}
+	if info.RestartCount != 1 || info.LastExitCode != -1 {
+		t.Errorf("Snapshot() restarts and exit code = %d, %d, want 1, -1", info.RestartCount, info.LastExitCode)
+	}
+
+	exited := daemonize.NewDaemon("exited", []string{"sh", "-c", "exit 3"}, t.TempDir())
+	if err := exited.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	_ = exited.Wait()
+	if info := exited.Snapshot(); info.Status != daemonize.DaemonStatusStopped || info.Uptime != 0 || info.LastExitCode != 3 {
+		t.Errorf("Snapshot() of an exited daemon = %+v, want stopped with exit code 3", info)
+	}
+}
+
+// TestSnapshotConsistent ensures a snapshot taken while the daemon is restarted never mixes the state of two runs.
+func TestSnapshotConsistent(t *testing.T) {
+	d := daemonize.NewDaemon("flapping", []string{"true"}, t.TempDir())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 20 {
+			if err := d.Start(context.Background()); err != nil {
+				t.Errorf("Start error: %v", err)
+				return
+			}
+			_ = d.Wait()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		info := d.Snapshot()
+		if info.PID != -1 && (info.LastExitCode != -1 || info.StartedAt.IsZero()) {
+			t.Fatalf("Snapshot() = %+v, want no exit code and a start time with a pid", info)
+		}
+	}
+}
+
+// TestDetachedOutput ensures the output of a detached daemon, which goes through a file, reaches its log in order.
+func TestDetachedOutput(t *testing.T) {
+	d := daemonize.NewDaemon("detached", []string{"sh", "-c", "echo one; echo two >&2; sleep 0.2; echo three"}, t.TempDir())
+	d.Detached = true
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if err := d.Wait(); err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+	lines, err := d.Logger.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot error: %v", err)
+	}
+	if want := []string{"one", "two", "three"}; !slices.Equal(lines, want) {
+		t.Errorf("logged lines = %q, want %q", lines, want)
+	}
+}
+
+// failingLogger rejects every write, like a log file on a full disk.
+type failingLogger struct {
+	daemonize.Logger
+}
+
+func (failingLogger) Write(p []byte) (int, error) {
+	return 0, syscall.ENOSPC
+}
+
+// TestLogError verifies that a failing logger is reported by LogError while the daemon's output is still drained.
+func TestLogError(t *testing.T) {
+	d := daemonize.NewDaemon("failing", []string{"seq", "100000"}, t.TempDir())
+	d.Logger = failingLogger{daemonize.NewMemoryLogger()}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if err := d.Wait(); err != nil {
+		t.Errorf("Wait error = %v, want the output drained despite the failing logger", err)
+	}
+	if err := d.LogError(); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("LogError() = %v, want %v", err, syscall.ENOSPC)
+	}
+}
+
+// TestStartAgain verifies that a stopped daemon can be started again and that Stop and Wait work for the second run.
+func TestStartAgain(t *testing.T) {
+	d := daemonize.NewDaemon("catproc", []string{"cat"}, t.TempDir())
+	ctx := context.Background()
+	for run := 1; run <= 2; run++ {
+		if err := d.Start(ctx); err != nil {
+			t.Fatalf("run %d: Start error: %v", run, err)
+		}
+		if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusRunning {
+			t.Fatalf("run %d: Status() = %q, %v, want %q", run, status, err, daemonize.DaemonStatusRunning)
+		}
+		if err := d.Stop(ctx); err != nil {
+			t.Fatalf("run %d: Stop error: %v", run, err)
+		}
+		if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusStopped {
+			t.Fatalf("run %d: after Stop Status() = %q, %v, want %q", run, status, err, daemonize.DaemonStatusStopped)
+		}
+		if err := d.Wait(); err != nil {
+			t.Fatalf("run %d: Wait error: %v", run, err)
+		}
+	}
+}
+
+// TestStartRunning ensures a running daemon cannot be started twice.
+func TestStartRunning(t *testing.T) {
+	d := daemonize.NewDaemon("catproc", []string{"cat"}, t.TempDir())
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer d.Stop(ctx)
+	if err := d.Start(ctx); !errors.Is(err, daemonize.ErrDaemonAlreadyRunning) {
+		t.Errorf("second Start error = %v, want ErrDaemonAlreadyRunning", err)
+	}
+}
+
+// TestStartConcurrent ensures concurrent starts of a daemon launch one process.
+func TestStartConcurrent(t *testing.T) {
+	d := daemonize.NewDaemon("sleeper", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	defer d.Stop(ctx)
+	errs := make(chan error, 8)
+	for range cap(errs) {
+		go func() { errs <- d.Start(ctx) }()
+	}
+	started := 0
+	for range cap(errs) {
+		switch err := <-errs; {
+		case err == nil:
+			started++
+		case !errors.Is(err, daemonize.ErrDaemonAlreadyRunning):
+			t.Errorf("Start error = %v, want nil or ErrDaemonAlreadyRunning", err)
+		}
+	}
+	if started != 1 {
+		t.Errorf("%d concurrent starts succeeded, want 1", started)
+	}
+}
+
+// TestStartGrace verifies that a daemon crashing once within its start grace period is relaunched and the start succeeds.
+func TestStartGrace(t *testing.T) {
+	workdir := t.TempDir()
+	// The first launch crashes; the second one becomes ready.
+	script := "if [ -e booted ]; then echo ready; exec sleep 100; fi; touch booted; echo crashing; exit 1"
+	d := daemonize.NewDaemon("slow", []string{"sh", "-c", script}, workdir)
+	d.ReadyLog = regexp.MustCompile(`^ready$`)
+	d.ReadyTimeout = 5 * time.Second
+	d.StartGrace = 5 * time.Second
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusRunning {
+		t.Errorf("Status() = %q, %v, want %q", status, err, daemonize.DaemonStatusRunning)
+	}
+	lines, _ := d.Logger.PeekLines(0, 10)
+	if want := []string{"crashing", "ready"}; !slices.Equal(lines, want) {
+		t.Errorf("log = %q, want %q", lines, want)
+	}
+
+	// Without a grace period the crash fails the start.
+	again := daemonize.NewDaemon("slow", []string{"sh", "-c", script}, t.TempDir())
+	again.ReadyLog = regexp.MustCompile(`^ready$`)
+	if err := again.Start(ctx); !errors.Is(err, daemonize.ErrExitedEarly) {
+		t.Errorf("Start error without grace = %v, want ErrExitedEarly", err)
+	}
+}
+
+// TestStopWithoutProcessGroup ensures Stop and Status fall back to signalling the process when its group cannot be looked up.
+func TestStopWithoutProcessGroup(t *testing.T) {
+	restore := daemonize.SetGetpgid(func(int) (int, error) { return 0, errors.ErrUnsupported })
+	t.Cleanup(restore)
+	d := daemonize.NewDaemon("sleeper", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusRunning {
+		t.Fatalf("Status() = %q, %v, want %q", status, err, daemonize.DaemonStatusRunning)
+	}
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if d.LastStopForced() || d.LastStopSignal() != syscall.SIGINT {
+		t.Errorf("LastStopForced() = %v, LastStopSignal() = %v, want a graceful stop on SIGINT", d.LastStopForced(), d.LastStopSignal())
+	}
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusStopped {
+		t.Errorf("after Stop Status() = %q, %v, want %q", status, err, daemonize.DaemonStatusStopped)
+	}
+}
@@ -4,201 +4,543 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"maps"
 	"os"
 	"os/signal"
 	"slices"
-	"strings"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Server struct {
-	Daemons map[string]*Daemon
+	Daemons     map[string]*Daemon
+	mu          sync.Mutex
+	history     []ExitRecord
+	historySize int
+	location    *time.Location
+	transform   LogTransform
+	prefixName  bool
+	clock       Clock
+	tracer      trace.Tracer
+
+	maxResultBytes int
+
+	subscriptions map[subscriptionKey]func()
+
+	// retired keeps the loggers of removed daemons, oldest first, so that
+	// their logs can still be read. It is bounded by historySize.
+	retired []retiredLogs
+
+	// metricsAddr is where Prometheus metrics are served, and restarts
+	// counts the restarts of each daemon for them.
+	metricsAddr string
+	restarts    map[string]int64
+
+	// logBudget bounds the log text kept across daemons.
+	logBudget *logBudget
+
+	// stateWebhook receives state changes of daemons without their own.
+	stateWebhook string
+
+	// mcp receives daemon state notifications once the server is registered.
+	mcp *server.MCPServer
+
+	// ctx is cancelled by Shutdown, which ends pending automatic restarts.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func New() *Server {
-	return &Server{
-		Daemons: make(map[string]*Daemon),
+type Option func(*Server)
+
+// WithDaemon registers a predefined daemon. It is launched on server startup
+// when its Autostart flag is set.
+func WithDaemon(d *Daemon) Option {
+	return func(s *Server) {
+		s.addDaemon(d)
 	}
 }
 
-func (s *Server) Start() error {
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	})))
-	signal.Ignore(syscall.SIGPIPE)
+// WithHistorySize sets the number of exited daemons kept in the history.
+func WithHistorySize(n int) Option {
+	return func(s *Server) {
+		s.historySize = n
+	}
+}
 
-	ms := server.NewMCPServer(
-		"Daemonize",
-		"1.0.0",
-		server.WithResourceCapabilities(true, true),
-		server.WithLogging(),
-		server.WithRecovery(),
-	)
+// WithTimezone sets the time zone used to display timestamps.
+func WithTimezone(loc *time.Location) Option {
+	return func(s *Server) {
+		s.location = loc
+	}
+}
 
-	startTool := mcp.NewTool("daemonize_start",
-		mcp.WithDescription("Start a daemon"),
-		mcp.WithString("name",
-			mcp.Required(),
-			mcp.Description("Name of the daemon"),
-		),
-		mcp.WithArray("command",
-			mcp.Description("Command to run"),
-			mcp.Items(map[string]any{
-				"type": "string",
-			}),
-		),
-		mcp.WithString("workdir",
-			mcp.Required(),
-			mcp.Description("Working directory of the daemon in absolute path"),
-		),
-	)
-	stopTool := mcp.NewTool("daemonize_stop",
-		mcp.WithDescription("Stop a daemon"),
-		mcp.WithString("name",
-			mcp.Required(),
-			mcp.Description("Name of the daemon"),
-		),
-	)
-	listTool := mcp.NewTool("daemonize_list",
-		mcp.WithDescription("List running daemons"),
-	)
-	logsTool := mcp.NewTool("daemonize_logs",
-		mcp.WithDescription("Get logs of a daemon"),
-		mcp.WithString("name",
-			mcp.Required(),
-			mcp.Description("Name of the daemon"),
-		),
-		mcp.WithNumber("tail",
-			mcp.Required(),
-			mcp.Description("Number of lines to read from the end of the log"),
-		),
-	)
+// LogTransform rewrites a log line of the named daemon before it is returned
+// by daemonize_logs. The stored line is left untouched.
+type LogTransform func(name, line string) string
 
-	ms.AddTool(startTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		name, err := request.RequireString("name")
-		if err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid name parameter", err), nil
-		}
-		command, err := request.RequireStringSlice("command")
-		if err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid command parameter", err), nil
-		}
-		workdir, err := request.RequireString("workdir")
-		if err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid workdir parameter", err), nil
-		}
-		daemon := NewDaemon(name, command, workdir)
-		if err := daemon.Start(ctx); err != nil {
-			return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to start daemon %s", name), err), nil
-		}
-		s.Daemons[name] = daemon
-		return mcp.NewToolResultText("Daemon started successfully"), nil
-	})
-	ms.AddTool(stopTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		name, err := request.RequireString("name")
+// WithLogTransform sets a transform applied to lines returned by
+// daemonize_logs, e.g. to mask secrets or reformat them.
+func WithLogTransform(f LogTransform) Option {
+	return func(s *Server) {
+		s.transform = f
+	}
+}
+
+// WithNamePrefix prepends "[name] " to the lines returned by daemonize_logs
+// and the log resources, after the log transform, so that the lines of
+// several daemons can be told apart once combined.
+func WithNamePrefix() Option {
+	return func(s *Server) {
+		s.prefixName = true
+	}
+}
+
+// displayLine applies the log transform and name prefix of the server to a
+// line of the named daemon before it is returned.
+func (s *Server) displayLine(name, line string) string {
+	if s.transform != nil {
+		line = s.transform(name, line)
+	}
+	if s.prefixName {
+		line = "[" + name + "] " + line
+	}
+	return line
+}
+
+// WithMaxResultBytes truncates the text of every tool result to n bytes,
+// appending a notice that the output was truncated. Results requested in JSON
+// format are not truncated, as they would no longer parse. Zero means no
+// limit.
+func WithMaxResultBytes(n int) Option {
+	return func(s *Server) {
+		s.maxResultBytes = n
+	}
+}
+
+const defaultHistorySize = 32
+
+func New(opts ...Option) *Server {
+	s := &Server{
+		Daemons:     make(map[string]*Daemon),
+		historySize: defaultHistorySize,
+		location:    time.Local,
+		clock:       realClock{},
+	}
+	s.logBudget = &logBudget{loggers: s.memoryLoggers}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Server) daemon(name string) (*Daemon, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.Daemons[name]
+	return d, ok
+}
+
+func (s *Server) addDaemon(d *Daemon) {
+	s.mu.Lock()
+	if d.Tracer == nil {
+		d.Tracer = s.tracer
+	}
+	s.Daemons[d.Name] = d
+	ms := s.mcp
+	s.mu.Unlock()
+	if ms != nil {
+		s.addLogsResource(ms, d.Name)
+	}
+	s.attachLogBudget(d)
+	s.watchExit(d)
+}
+
+// watchExit registers the exit hooks of the server on d.
+func (s *Server) watchExit(d *Daemon) {
+	d.addExitHook(s.recordHistory)
+	d.addExitHook(s.notifyExited)
+	d.addExitHook(s.autoRestart)
+}
+
+// replaceStopped registers next, a clone of d, in place of d. It fails if d
+// is running or no longer registered, so that a concurrent start or restart
+// of d is not overwritten.
+func (s *Server) replaceStopped(d, next *Daemon) error {
+	// next is not visible to others before the swap, so that its exit is
+	// always watched.
+	s.watchExit(next)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Daemons[d.Name] != d {
+		return fmt.Errorf("daemon %s was replaced meanwhile", d.Name)
+	}
+	if status, err := d.Status(); err != nil {
+		return err
+	} else if status.active() {
+		return fmt.Errorf("daemon %s: %w", d.Name, ErrDaemonAlreadyRunning)
+	}
+	s.Daemons[d.Name] = next
+	return nil
+}
+
+func (s *Server) recordHistory(d *Daemon) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, d.exitRecord())
+	if over := len(s.history) - s.historySize; over > 0 {
+		s.history = slices.Delete(s.history, 0, over)
+	}
+}
+
+// History returns the recorded exits of daemons, most recent first.
+func (s *Server) History() []ExitRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := slices.Clone(s.history)
+	slices.Reverse(history)
+	return history
+}
+
+// unregisterFailed removes d, which failed to start, and puts back the
+// daemon it replaced, if any.
+func (s *Server) unregisterFailed(d, prev *Daemon, hadPrev bool) {
+	s.mu.Lock()
+	current := s.Daemons[d.Name]
+	if current == d && hadPrev {
+		s.Daemons[d.Name] = prev
+	}
+	s.mu.Unlock()
+	if current == d && !hadPrev {
+		s.removeDaemon(d.Name)
+	}
+}
+
+var ErrDaemonNotFound = errors.New("daemon not found")
+
+// AddDaemon starts command in workdir as a daemon registered under name,
+// replacing a stopped daemon of that name. Configure the daemon further by
+// building it with NewDaemon and calling StartDaemon instead.
+func (s *Server) AddDaemon(ctx context.Context, name string, command []string, workdir string) (*Daemon, error) {
+	if !daemonNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid daemon name %q: only letters, digits, '_', '.' and '-' are allowed", name)
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("failed to start daemon %s: command is empty", name)
+	}
+	d := NewDaemon(name, command, workdir)
+	if err := s.StartDaemon(ctx, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// StartDaemon starts the daemons d depends on, registers d and starts it.
+// d is reported as starting while Start waits for readiness. If it fails to
+// start, d is unregistered again and the daemon it replaced is restored.
+func (s *Server) StartDaemon(ctx context.Context, d *Daemon) error {
+	if err := s.startDependencies(ctx, d); err != nil {
+		return fmt.Errorf("failed to start daemon %s: %w", d.Name, err)
+	}
+	prev, hadPrev := s.daemon(d.Name)
+	s.addDaemon(d)
+	if err := d.Start(ctx); err != nil {
+		s.unregisterFailed(d, prev, hadPrev)
+		return err
+	}
+	s.notifyStarted(d)
+	return nil
+}
+
+// StartDaemonBackground registers d and returns at once, while the
+// dependencies of d are started and d is launched and waited for in the
+// background. The daemon is reported as starting until then. A daemon that
+// fails to start stays registered as stopped, with the error in its Failure.
+// Stopping the daemon meanwhile, also by Shutdown, cancels the start.
+func (s *Server) StartDaemonBackground(ctx context.Context, d *Daemon) {
+	s.startBackground(ctx, d, func() {})
+}
+
+// startBackground starts d like StartDaemonBackground and calls failed if
+// the start fails other than by being cancelled.
+func (s *Server) startBackground(ctx context.Context, d *Daemon, failed func()) {
+	d.beginPending()
+	s.addDaemon(d)
+	go func() {
+		err := s.startDependencies(ctx, d)
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid name parameter", err), nil
+			err = fmt.Errorf("failed to start daemon %s: %w", d.Name, err)
+		} else {
+			err = d.startPending(ctx)
 		}
-		daemon, ok := s.Daemons[name]
-		if !ok {
-			return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+		// The failure is recorded as the daemon stops being reported as
+		// starting.
+		if cancelled := d.endPending(err); cancelled {
+			// Whoever stopped the daemon owns it and its logger now.
+			slog.InfoContext(ctx, "background start of daemon cancelled", slog.String("name", d.Name))
+			return
 		}
-		status, err := daemon.Status()
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to stop daemon %s", name), err), nil
-		}
-		if status != DaemonStatusRunning {
-			delete(s.Daemons, name)
-			return mcp.NewToolResultText("Daemon already stopped"), nil
+			slog.ErrorContext(ctx, "background start of daemon failed", slog.String("name", d.Name), slog.Any("error", err))
+			failed()
+			return
 		}
-		if err := daemon.Stop(ctx); err != nil {
-			return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to stop daemon %s", name), err), nil
-		}
-		delete(s.Daemons, name)
-		return mcp.NewToolResultText("Daemon stopped successfully"), nil
-	})
-	ms.AddTool(listTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		if len(s.Daemons) == 0 {
-			return mcp.NewToolResultText("No daemons running"), nil
+		s.notifyStarted(d)
+	}()
+}
+
+// StopDaemon stops the named daemon and removes it; its logs stay readable.
+// A daemon that had already stopped is removed and ErrDaemonNotRunning is
+// returned. When ctx ends first, the daemon is killed, removed, and the
+// error of ctx is returned.
+func (s *Server) StopDaemon(ctx context.Context, name string) error {
+	d, ok := s.daemon(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrDaemonNotFound, name)
+	}
+	status, err := d.Status()
+	if err != nil {
+		return err
+	}
+	if !status.active() {
+		s.removeDaemon(name)
+		return ErrDaemonNotRunning
+	}
+	err = d.Stop(ctx)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	// An error here means Stop killed the daemon when ctx ended.
+	s.removeDaemon(name)
+	return err
+}
+
+// retiredLogs is the logger of a removed daemon.
+type retiredLogs struct {
+	name   string
+	logger Logger
+}
+
+// loggerInUse reports whether l is the logger of a registered daemon or kept
+// for a removed one. The caller holds s.mu.
+func (s *Server) loggerInUse(l Logger) bool {
+	for _, d := range s.Daemons {
+		if d.logger() == l {
+			return true
 		}
-		names := slices.Collect(maps.Keys(s.Daemons))
-		slices.Sort(names)
-		result := &strings.Builder{}
-		result.WriteString("Running daemons:\n")
-		for _, name := range names {
-			d := s.Daemons[name]
-			status, err := d.Status()
-			if err != nil {
-				return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to get status of daemon %s", name), err), nil
+	}
+	return slices.ContainsFunc(s.retired, func(r retiredLogs) bool { return r.logger == l })
+}
+
+// logsKept reports whether the logs of the named daemon can be read, as it
+// is registered or was removed recently. The caller holds s.mu.
+func (s *Server) logsKept(name string) bool {
+	if _, ok := s.Daemons[name]; ok {
+		return true
+	}
+	return slices.ContainsFunc(s.retired, func(r retiredLogs) bool { return r.name == name })
+}
+
+// closeRetired closes a logger that is no longer kept for a removed daemon.
+func closeRetired(r retiredLogs) {
+	if err := r.logger.Close(); err != nil {
+		slog.Error("Failed to close daemon logger", slog.String("name", r.name), slog.Any("error", err))
+	}
+}
+
+// logger returns the logger of the named daemon, or of the most recently
+// removed daemon of that name.
+func (s *Server) logger(name string) (Logger, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.Daemons[name]; ok {
+		return d.logger(), true
+	}
+	i := slices.IndexFunc(s.retired, func(r retiredLogs) bool { return r.name == name })
+	if i < 0 {
+		return nil, false
+	}
+	return s.retired[i].logger, true
+}
+
+func (s *Server) removeDaemon(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Loggers no longer kept are closed, unless still used by a daemon.
+	var dropped []retiredLogs
+	defer func() {
+		for _, r := range dropped {
+			if !s.loggerInUse(r.logger) {
+				closeRetired(r)
 			}
-			fmt.Fprintf(result, "  - %s[%s]:[%s]: %s\n", name, strings.Join(d.Commands, " "), d.Workdir, status)
-		}
-		return mcp.NewToolResultText(result.String()), nil
-	})
-	ms.AddTool(logsTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		name, err := request.RequireString("name")
-		if err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid name parameter", err), nil
-		}
-		daemon, ok := s.Daemons[name]
-		if !ok {
-			return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
 		}
-		_tail, err := request.RequireInt("tail")
-		if err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid tail parameter", err), nil
+	}()
+	if d, ok := s.Daemons[name]; ok {
+		s.retired = slices.DeleteFunc(s.retired, func(r retiredLogs) bool {
+			if r.name == name {
+				dropped = append(dropped, r)
+				return true
+			}
+			return false
+		})
+		s.retired = append(s.retired, retiredLogs{name: name, logger: d.logger()})
+		if over := len(s.retired) - s.historySize; over > 0 {
+			dropped = append(dropped, s.retired[:over]...)
+			s.retired = slices.Delete(s.retired, 0, over)
 		}
-		tail := int64(_tail)
-		if tail < 0 {
-			return mcp.NewToolResultError("tail parameter must be non-negative"), nil
+	}
+	delete(s.Daemons, name)
+	if s.mcp != nil {
+		// A logs resource stays while the logs of its daemon are kept.
+		for _, r := range append(dropped, retiredLogs{name: name}) {
+			if !s.logsKept(r.name) {
+				s.mcp.RemoveResource(logsResourceURI(r.name))
+			}
 		}
-		if tail == 0 {
-			return mcp.NewToolResultText("No logs available"), nil
+	}
+	for key, cancel := range s.subscriptions {
+		if key.name == name {
+			delete(s.subscriptions, key)
+			cancel()
 		}
-		if tail > daemon.Logger.Lines() {
-			tail = daemon.Logger.Lines()
+	}
+}
+
+// daemons returns the registered daemons sorted by name.
+func (s *Server) daemons() []*Daemon {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := slices.Collect(maps.Keys(s.Daemons))
+	slices.Sort(names)
+	ds := make([]*Daemon, 0, len(names))
+	for _, name := range names {
+		ds = append(ds, s.Daemons[name])
+	}
+	return ds
+}
+
+// Autostart launches every registered daemon marked as Autostart that is not
+// already running.
+func (s *Server) Autostart(ctx context.Context) error {
+	var errs []error
+	for _, d := range s.daemons() {
+		name := d.Name
+		if !d.Autostart {
+			continue
 		}
-		offset := daemon.Logger.Lines() - tail
-		offset = max(0, offset)
-		lines, err := daemon.Logger.ReadLine(offset)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return mcp.NewToolResultText("No logs available"), nil
-			}
-			return mcp.NewToolResultErrorFromErr("failed to read logs", err), nil
+		if status, err := d.Status(); err != nil {
+			errs = append(errs, err)
+			continue
+		} else if status.active() {
+			continue
 		}
-		result := &strings.Builder{}
-		result.WriteString("Daemon logs:\n")
-		for i, line := range lines {
-			fmt.Fprintf(result, "  %d: %s\n", int64(i)+1+offset, line)
+		if err := d.Start(ctx); err != nil {
+			errs = append(errs, err)
+			continue
 		}
-		return mcp.NewToolResultText(result.String()), nil
-	})
+		slog.InfoContext(ctx, "daemon autostarted", slog.String("name", name))
+		s.notifyStarted(d)
+	}
+	return errors.Join(errs...)
+}
+
+// Register adds the tools of s to ms, exposes the logs of every daemon as a
+// resource and sends daemon state notifications to the clients of ms.
+func (s *Server) Register(ms *server.MCPServer) {
+	s.mu.Lock()
+	s.mcp = ms
+	names := slices.Collect(maps.Keys(s.Daemons))
+	s.mu.Unlock()
+	ms.AddTools(s.Tools()...)
+	for _, name := range names {
+		s.addLogsResource(ms, name)
+	}
+}
+
+func (s *Server) Start() error {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	})))
+	signal.Ignore(syscall.SIGPIPE)
+
+	if err := s.Autostart(context.Background()); err != nil {
+		slog.Error("failed to autostart daemons", slog.Any("error", err))
+	}
+	s.serveMetrics()
+
+	ms := server.NewMCPServer(
+		"Daemonize",
+		"1.0.0",
+		server.WithResourceCapabilities(true, true),
+		server.WithLogging(),
+		server.WithRecovery(),
+	)
+
+	s.Register(ms)
+	if err := notifySystemd("READY=1"); err != nil {
+		slog.Error("failed to notify systemd", slog.Any("error", err))
+	}
 
 	if err := server.ServeStdio(ms); err != nil {
 		slog.Error("Server error", slog.Any("error", err))
 	}
 	slog.Info("Server stop successfully")
-	for name, daemon := range s.Daemons {
+	s.Shutdown(context.Background())
+
+	return nil
+}
+
+// Shutdown cancels pending automatic restarts and background starts, stops
+// every running daemon except detached ones, which are left running, and
+// closes the loggers of the stopped and removed daemons.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.cancel()
+	for _, daemon := range s.daemons() {
+		name := daemon.Name
+		if daemon.Detached {
+			// A detached daemon whose background start is pending is not
+			// launched anymore, while one launched is left running.
+			daemon.cancelPending()
+			slog.Info("Leaving detached daemon running", slog.String("name", name))
+			continue
+		}
 		if status, err := daemon.Status(); err != nil {
 			slog.Error("Failed to get daemon status", slog.String("name", name), slog.Any("error", err))
 			continue
-		} else if status != DaemonStatusRunning {
+		} else if !status.active() {
 			slog.Debug("Daemon already stopped", slog.String("name", name), slog.String("status", string(status)))
-			delete(s.Daemons, name)
+			// Its logger is retired and closed with the others below.
+			s.removeDaemon(name)
 			continue
 		}
-		if err := daemon.Stop(context.Background()); err != nil {
+		if err := daemon.Stop(ctx); err != nil {
 			slog.Error("Failed to stop daemon", slog.String("name", name), slog.Any("error", err))
 			continue
 		}
+		closeLogger(daemon)
 	}
+	// The loggers kept for removed daemons are closed, unless still used by
+	// a daemon left running.
+	s.mu.Lock()
+	retired := s.retired
+	s.retired = nil
+	for _, r := range retired {
+		if !s.loggerInUse(r.logger) {
+			closeRetired(r)
+		}
+	}
+	s.mu.Unlock()
+}
 
-	return nil
+// closeLogger closes the logger of a stopped daemon so that buffered output
+// is flushed.
+func closeLogger(d *Daemon) {
+	if err := d.logger().Close(); err != nil {
+		slog.Error("Failed to close daemon logger", slog.String("name", d.Name), slog.Any("error", err))
+	}
 }
@@ -0,0 +1,2670 @@
+package daemonize_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	daemonize "github.com/mackee/mcp-daemonize"
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// callTool invokes the named tool handler of s and returns its result and text content.
+func callTool(t *testing.T, s *daemonize.Server, name string, args map[string]any) (*mcp.CallToolResult, string) {
+	t.Helper()
+	for _, tool := range s.Tools() {
+		if tool.Tool.Name != name {
+			continue
+		}
+		var req mcp.CallToolRequest
+		req.Params.Name = name
+		req.Params.Arguments = args
+		result, err := tool.Handler(context.Background(), req)
+		if err != nil {
+			t.Fatalf("%s handler error: %v", name, err)
+		}
+		var text strings.Builder
+		for _, c := range result.Content {
+			if tc, ok := c.(mcp.TextContent); ok {
+				text.WriteString(tc.Text)
+			}
+		}
+		return result, text.String()
+	}
+	t.Fatalf("tool %s not found", name)
+	return nil, ""
+}
+
+// waitStatus polls d until it reports want or the timeout elapses. A daemon
+// whose process group is gone is reported as stopped before its remaining
+// output is logged, so for stopped it also waits for the exit to be recorded.
+func waitStatus(t *testing.T, d *daemonize.Daemon, want daemonize.DaemonStatus) {
+	t.Helper()
+	for range 100 {
+		status, err := d.Status()
+		if err != nil {
+			t.Fatalf("Status error: %v", err)
+		}
+		if status == want {
+			if want == daemonize.DaemonStatusStopped {
+				_ = d.Wait()
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for daemon %s to be %s", d.Name, want)
+}
+
+// waitPending waits for the background start of d to finish.
+func waitPending(t *testing.T, d *daemonize.Daemon) {
+	t.Helper()
+	for range 100 {
+		if !d.Pending() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for the background start of daemon %s", d.Name)
+}
+
+// TestAutostart ensures daemons registered with Autostart are launched and others are left stopped.
+func TestAutostart(t *testing.T) {
+	auto := daemonize.NewDaemon("auto", []string{"sleep", "100"}, t.TempDir())
+	auto.Autostart = true
+	manual := daemonize.NewDaemon("manual", []string{"sleep", "100"}, t.TempDir())
+	s := daemonize.New(
+		daemonize.WithDaemon(auto),
+		daemonize.WithDaemon(manual),
+	)
+	ctx := context.Background()
+	if err := s.Autostart(ctx); err != nil {
+		t.Fatalf("Autostart error: %v", err)
+	}
+	t.Cleanup(func() { _ = auto.Stop(ctx) })
+
+	status, err := auto.Status()
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+	if status != daemonize.DaemonStatusRunning {
+		t.Errorf("autostart daemon Status() = %q, want %q", status, daemonize.DaemonStatusRunning)
+	}
+	status, err = manual.Status()
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+	if status != daemonize.DaemonStatusStopped {
+		t.Errorf("manual daemon Status() = %q, want %q", status, daemonize.DaemonStatusStopped)
+	}
+}
+
+// TestRemoveCrashed ensures a daemon that exited on its own can be removed.
+func TestRemoveCrashed(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "crash",
+		"command": []any{"sh", "-c", "exit 1"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	waitStatus(t, s.Daemons["crash"], daemonize.DaemonStatusStopped)
+
+	result, text = callTool(t, s, "daemonize_remove", map[string]any{"name": "crash"})
+	if result.IsError {
+		t.Fatalf("daemonize_remove failed: %s", text)
+	}
+	if _, ok := s.Daemons["crash"]; ok {
+		t.Error("daemon crash is still registered after remove")
+	}
+}
+
+// TestRemoveRunning ensures removing a running daemon is refused.
+func TestRemoveRunning(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "running",
+		"command": []any{"sleep", "100"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["running"]
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+
+	result, text = callTool(t, s, "daemonize_remove", map[string]any{"name": "running"})
+	if !result.IsError {
+		t.Fatalf("daemonize_remove on running daemon succeeded: %s", text)
+	}
+	if !strings.Contains(text, "daemonize_stop") {
+		t.Errorf("error %q does not suggest stopping first", text)
+	}
+	if _, ok := s.Daemons["running"]; !ok {
+		t.Error("running daemon was removed")
+	}
+}
+
+// TestStopAll ensures daemonize_stop_all stops and removes every daemon.
+func TestStopAll(t *testing.T) {
+	s := daemonize.New()
+	names := []string{"one", "two", "three"}
+	for _, name := range names {
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":    name,
+			"command": []any{"sleep", "100"},
+			"workdir": t.TempDir(),
+		})
+		if result.IsError {
+			t.Fatalf("daemonize_start %s failed: %s", name, text)
+		}
+	}
+	daemons := make([]*daemonize.Daemon, 0, len(names))
+	for _, name := range names {
+		daemons = append(daemons, s.Daemons[name])
+	}
+
+	result, text := callTool(t, s, "daemonize_stop_all", nil)
+	if result.IsError {
+		t.Fatalf("daemonize_stop_all failed: %s", text)
+	}
+	for _, name := range names {
+		if !strings.Contains(text, name+": stopped") {
+			t.Errorf("summary %q does not report %s as stopped", text, name)
+		}
+	}
+	if len(s.Daemons) != 0 {
+		t.Errorf("Daemons has %d entries after stop_all, want 0", len(s.Daemons))
+	}
+	for _, d := range daemons {
+		status, err := d.Status()
+		if err != nil {
+			t.Fatalf("Status error: %v", err)
+		}
+		if status != daemonize.DaemonStatusStopped {
+			t.Errorf("daemon %s Status() = %q, want %q", d.Name, status, daemonize.DaemonStatusStopped)
+		}
+	}
+}
+
+// TestWatch ensures daemonize_watch returns a short command's output and exit code.
+func TestWatch(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "short",
+		"command": []any{"sh", "-c", "echo hello; exit 3"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	result, text = callTool(t, s, "daemonize_watch", map[string]any{
+		"name":            "short",
+		"timeout_seconds": 5,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_watch failed: %s", text)
+	}
+	if !strings.Contains(text, "1: hello") {
+		t.Errorf("watch output %q does not contain the command output", text)
+	}
+	if !strings.Contains(text, "exited with code 3") {
+		t.Errorf("watch output %q does not contain the exit code", text)
+	}
+}
+
+// TestLogsPattern ensures daemonize_logs filters lines by pattern and keeps their original line numbers.
+func TestLogsPattern(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	for _, line := range []string{"starting", "error: boom", "ready", "error: again"} {
+		fmt.Fprintln(d.Logger, line)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name":    "logs",
+		"tail":    10,
+		"pattern": "error",
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_logs failed: %s", text)
+	}
+	want := "Daemon logs:\n  2: error: boom\n  4: error: again\n"
+	if text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+}
+
+// TestLogsInvalidPattern ensures an invalid regular expression is reported as an error.
+func TestLogsInvalidPattern(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	fmt.Fprintln(d.Logger, "line")
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name":    "logs",
+		"tail":    10,
+		"pattern": "(",
+	})
+	if !result.IsError {
+		t.Fatalf("daemonize_logs with invalid pattern succeeded: %s", text)
+	}
+	if !strings.Contains(text, "pattern must be a valid regular expression") {
+		t.Errorf("error %q does not mention the invalid pattern", text)
+	}
+}
+
+// TestStartReportsAllInvalidParams ensures every invalid parameter is reported in a single error.
+func TestStartReportsAllInvalidParams(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"command":               "sleep 100",
+		"workdir":               "relative/dir",
+		"ready_timeout_seconds": -1,
+	})
+	if !result.IsError {
+		t.Fatalf("daemonize_start with invalid parameters succeeded: %s", text)
+	}
+	for _, want := range []string{
+		"name required",
+		"command must be an array of strings",
+		"workdir must be absolute",
+		"ready_timeout_seconds must be non-negative",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("error %q does not report %q", text, want)
+		}
+	}
+}
+
+// TestStartValidatesName ensures daemonize_start accepts safe names and rejects empty ones and ones with a slash.
+func TestStartValidatesName(t *testing.T) {
+	s := daemonize.New()
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{name: "web-1.dev_server"},
+		{name: "web/1", want: "name must contain only letters, digits"},
+		{name: "", want: "name must not be empty"},
+	} {
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":    tt.name,
+			"command": []any{"sleep", "100"},
+			"workdir": t.TempDir(),
+		})
+		if tt.want == "" {
+			if result.IsError {
+				t.Errorf("daemonize_start with name %q failed: %s", tt.name, text)
+				continue
+			}
+			_ = s.Daemons[tt.name].Stop(context.Background())
+			continue
+		}
+		if !result.IsError {
+			t.Errorf("daemonize_start with name %q succeeded: %s", tt.name, text)
+		} else if !strings.Contains(text, tt.want) {
+			t.Errorf("error %q for name %q does not report %q", text, tt.name, tt.want)
+		}
+	}
+}
+
+// TestStartFailureShowsOutput ensures the error of a failed start includes what the command printed.
+func TestStartFailureShowsOutput(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":               "broken",
+		"command_line":       "echo 'error: config.yaml not found' >&2; exit 1",
+		"workdir":            t.TempDir(),
+		"min_uptime_seconds": 1,
+	})
+	if !result.IsError {
+		t.Fatalf("daemonize_start of a failing command succeeded: %s", text)
+	}
+	if !strings.Contains(text, "Last output:\n  1: error: config.yaml not found") {
+		t.Errorf("error %q does not contain the command output", text)
+	}
+}
+
+// TestStartReportsStarting ensures daemonize_list shows a daemon as starting while its readiness probe is pending.
+func TestStartReportsStarting(t *testing.T) {
+	s := daemonize.New()
+	done := make(chan string, 1)
+	go func() {
+		_, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":         "slow",
+			"command_line": "sleep 0.5; echo ready; exec sleep 100",
+			"workdir":      t.TempDir(),
+			"ready_log":    "ready",
+		})
+		done <- text
+	}()
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for the daemon to be listed as starting")
+		}
+		if _, text := callTool(t, s, "daemonize_list", nil); strings.Contains(text, ": starting") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if text := <-done; text != "Daemon started successfully" {
+		t.Fatalf("daemonize_start = %q", text)
+	}
+	d := s.Daemons["slow"]
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	if status, _ := d.Status(); status != daemonize.DaemonStatusRunning {
+		t.Errorf("status after start = %s, want running", status)
+	}
+}
+
+// TestLogsAfterStop ensures the logs of a stopped daemon can still be read.
+func TestLogsAfterStop(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":         "crashing",
+		"command_line": "echo panic: something broke; exec sleep 100",
+		"workdir":      t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["crashing"]
+	for i := 0; d.Logger.Lines() == 0; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for daemon output")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	result, text = callTool(t, s, "daemonize_stop", map[string]any{"name": "crashing"})
+	if result.IsError {
+		t.Fatalf("daemonize_stop failed: %s", text)
+	}
+
+	result, text = callTool(t, s, "daemonize_logs", map[string]any{"name": "crashing", "tail": 10})
+	if result.IsError {
+		t.Fatalf("daemonize_logs after stop failed: %s", text)
+	}
+	if want := "Daemon logs:\n  1: panic: something broke\n"; text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+}
+
+// TestLogsHead ensures head mode returns the earliest lines with their line numbers.
+func TestLogsHead(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	for i := range 5 {
+		fmt.Fprintf(d.Logger, "line %d\n", i+1)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name": "logs",
+		"tail": 2,
+		"head": true,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_logs failed: %s", text)
+	}
+	want := "Daemon logs:\n  1: line 1\n  2: line 2\n"
+	if text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+	if got := d.Logger.Lines(); got != 5 {
+		t.Errorf("after head read Lines() = %d, want 5", got)
+	}
+}
+
+// TestLogsTailKeepsLogfile ensures a tail read hides the lines it returns without modifying the files of a logfile.
+func TestLogsTailKeepsLogfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	// Every line is 8 bytes, so each segment holds 4 lines.
+	logger, err := daemonize.NewFileLogger(path, daemonize.WithRotateBytes(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	d.Logger = logger
+	for i := range 10 {
+		fmt.Fprintf(d.Logger, "line %02d\n", i)
+	}
+	files := func() map[string]string {
+		matches, err := filepath.Glob(path + "*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := make(map[string]string)
+		for _, name := range matches {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[name] = string(data)
+		}
+		return contents
+	}
+	before := files()
+	if len(before) != 3 {
+		t.Fatalf("files before = %d, want 3", len(before))
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	// The tail reaches into the newest rotated segment.
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{"name": "logs", "tail": 5})
+	if result.IsError {
+		t.Fatalf("daemonize_logs failed: %s", text)
+	}
+	want := "Daemon logs:\n  6: line 05\n  7: line 06\n  8: line 07\n  9: line 08\n  10: line 09\n"
+	if text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+	if after := files(); !maps.Equal(after, before) {
+		t.Errorf("files after tail = %q, want %q", after, before)
+	}
+	if got := d.Logger.Lines(); got != 5 {
+		t.Errorf("after tail Lines() = %d, want 5", got)
+	}
+	fmt.Fprintln(d.Logger, "line 10")
+	lines, err := d.Logger.PeekLines(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lines, ","); got != "line 00,line 01,line 02,line 03,line 04,line 10" {
+		t.Errorf("after tail and write PeekLines() = %q", lines)
+	}
+}
+
+// TestLogTransform ensures the transform changes returned lines but not stored ones.
+func TestLogTransform(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	fmt.Fprintln(d.Logger, "line 1")
+	fmt.Fprintln(d.Logger, "line 2")
+	s := daemonize.New(
+		daemonize.WithDaemon(d),
+		daemonize.WithLogTransform(func(name, line string) string {
+			return line + " [" + name + "]"
+		}),
+	)
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name": "logs",
+		"tail": 2,
+		"head": true,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_logs failed: %s", text)
+	}
+	want := "Daemon logs:\n  1: line 1 [logs]\n  2: line 2 [logs]\n"
+	if text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+	stored, err := d.Logger.PeekLines(0, 2)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	if stored[0] != "line 1" || stored[1] != "line 2" {
+		t.Errorf("stored lines = %q, want them untransformed", stored)
+	}
+}
+
+// TestNamePrefix ensures WithNamePrefix marks returned lines with the daemon name.
+func TestNamePrefix(t *testing.T) {
+	d := daemonize.NewDaemon("api", []string{"true"}, t.TempDir())
+	fmt.Fprintln(d.Logger, "listening on :8080")
+	s := daemonize.New(daemonize.WithDaemon(d), daemonize.WithNamePrefix())
+	_, text := callTool(t, s, "daemonize_logs", map[string]any{"name": "api", "tail": 1, "head": true})
+	if want := "Daemon logs:\n  1: [api] listening on :8080\n"; text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+}
+
+// TestClearLogs ensures daemonize_clear_logs empties the daemon's logger.
+func TestClearLogs(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	for i := range 3 {
+		fmt.Fprintf(d.Logger, "line %d\n", i)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_clear_logs", map[string]any{"name": "logs"})
+	if result.IsError {
+		t.Fatalf("daemonize_clear_logs failed: %s", text)
+	}
+	if got := d.Logger.Lines(); got != 0 {
+		t.Errorf("after clear Lines() = %d, want 0", got)
+	}
+}
+
+// TestHistory ensures exited daemons stay in the history after removal until evicted.
+func TestHistory(t *testing.T) {
+	s := daemonize.New(daemonize.WithHistorySize(2))
+	run := func(name, script string) {
+		t.Helper()
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":    name,
+			"command": []any{"sh", "-c", script},
+			"workdir": t.TempDir(),
+		})
+		if result.IsError {
+			t.Fatalf("daemonize_start %s failed: %s", name, text)
+		}
+		d := s.Daemons[name]
+		for range 100 {
+			if slices.ContainsFunc(s.History(), func(r daemonize.ExitRecord) bool { return r.Name == name }) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		waitStatus(t, d, daemonize.DaemonStatusStopped)
+		if result, text := callTool(t, s, "daemonize_remove", map[string]any{"name": name}); result.IsError {
+			t.Fatalf("daemonize_remove %s failed: %s", name, text)
+		}
+	}
+
+	run("first", "exit 3")
+	run("second", "exit 0")
+	_, text := callTool(t, s, "daemonize_history", nil)
+	if !strings.Contains(text, "first: failed with code 3") {
+		t.Errorf("history %q does not contain the failed daemon", text)
+	}
+	if !strings.Contains(text, "second: exited with code 0") {
+		t.Errorf("history %q does not contain the exited daemon", text)
+	}
+
+	run("third", "exit 0")
+	history := s.History()
+	names := make([]string, 0, len(history))
+	for _, r := range history {
+		names = append(names, r.Name)
+	}
+	if want := []string{"third", "second"}; !slices.Equal(names, want) {
+		t.Errorf("history names = %v, want %v", names, want)
+	}
+}
+
+// TestRemoveClosesDroppedLoggers ensures the logger of a removed daemon is closed once its logs are no longer kept.
+func TestRemoveClosesDroppedLoggers(t *testing.T) {
+	var opts []daemonize.Option
+	loggers := map[string]daemonize.Logger{}
+	for _, name := range []string{"first", "second"} {
+		logger, err := daemonize.NewFileLogger(filepath.Join(t.TempDir(), name+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { logger.Close() })
+		d := daemonize.NewDaemon(name, []string{"true"}, t.TempDir())
+		d.Logger = logger
+		loggers[name] = logger
+		opts = append(opts, daemonize.WithDaemon(d))
+	}
+	s := daemonize.New(append(opts, daemonize.WithHistorySize(1))...)
+	for _, name := range []string{"first", "second"} {
+		if result, text := callTool(t, s, "daemonize_remove", map[string]any{"name": name}); result.IsError {
+			t.Fatalf("daemonize_remove %s failed: %s", name, text)
+		}
+	}
+	if _, err := loggers["first"].Write([]byte("late\n")); err == nil {
+		t.Error("logger of first is still open after its logs were dropped")
+	}
+	if _, err := loggers["second"].Write([]byte("kept\n")); err != nil {
+		t.Errorf("logger of second, whose logs are kept, was closed: %v", err)
+	}
+}
+
+// TestListTimezone ensures the last log timestamp in daemonize_list uses the configured time zone.
+func TestListTimezone(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	fmt.Fprintln(d.Logger, "hello")
+	s := daemonize.New(
+		daemonize.WithDaemon(d),
+		daemonize.WithTimezone(time.FixedZone("UTC+9", 9*60*60)),
+	)
+	_, text := callTool(t, s, "daemonize_list", nil)
+	if !strings.Contains(text, "+09:00: hello)") {
+		t.Errorf("daemonize_list = %q, want last log timestamp in +09:00", text)
+	}
+}
+
+// TestGC ensures daemonize_gc removes a daemon whose process was killed externally and keeps one never started.
+func TestGC(t *testing.T) {
+	s := daemonize.New(daemonize.WithDaemon(daemonize.NewDaemon("defined", []string{"sleep", "100"}, t.TempDir())))
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "vanish",
+		"command": []any{"sh", "-c", "echo $$; exec sleep 100"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["vanish"]
+	for range 50 {
+		if d.Logger.Lines() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines, err := d.Logger.PeekLines(0, 1)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil {
+		t.Fatalf("parsing pid: %v", err)
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatalf("Kill error: %v", err)
+	}
+
+	for range 100 {
+		_, text = callTool(t, s, "daemonize_gc", nil)
+		if _, ok := s.Daemons["vanish"]; !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := s.Daemons["vanish"]; ok {
+		t.Fatal("daemon vanish is still registered after gc")
+	}
+	if !strings.Contains(text, "- vanish") {
+		t.Errorf("gc output %q does not report the removed daemon", text)
+	}
+	if _, ok := s.Daemons["defined"]; !ok || strings.Contains(text, "defined") {
+		t.Errorf("gc removed the never started daemon defined: %q", text)
+	}
+}
+
+// TestListPID ensures daemonize_list reports the pid of a running daemon.
+func TestListPID(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "pid",
+		"command": []any{"sleep", "100"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["pid"]
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	_, text = callTool(t, s, "daemonize_list", nil)
+	if want := fmt.Sprintf("(pid %d, executable %s)", d.PID(), d.Executable()); !strings.Contains(text, want) {
+		t.Errorf("daemonize_list = %q, want it to contain %q", text, want)
+	}
+}
+
+// TestStopTimeout ensures a short timeout_seconds kills a daemon that ignores SIGINT without waiting for the stop timeout.
+func TestStopTimeout(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "stubborn",
+		"command": []any{"sh", "-c", "trap '' INT; echo ready; while :; do sleep 0.1; done"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["stubborn"]
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	// Wait for the trap to be installed.
+	for i := 0; d.Logger.Lines() == 0; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for daemon output")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	result, text = callTool(t, s, "daemonize_stop", map[string]any{
+		"name":            "stubborn",
+		"timeout_seconds": 0.2,
+	})
+	if result.IsError || !strings.Contains(text, "was killed") {
+		t.Fatalf("daemonize_stop = %q, want the daemon killed", text)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("daemonize_stop took %s, want the timeout to cut it short", elapsed)
+	}
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusStopped {
+		t.Errorf("Status() = %s, %v, want stopped", status, err)
+	}
+	if _, ok := s.Daemons["stubborn"]; ok {
+		t.Error("killed daemon is still registered")
+	}
+
+	result, text = callTool(t, s, "daemonize_stop", map[string]any{
+		"name":            "stubborn",
+		"timeout_seconds": -1,
+	})
+	if !result.IsError || !strings.Contains(text, "timeout_seconds must be non-negative") {
+		t.Errorf("daemonize_stop = %q, want a validation error", text)
+	}
+}
+
+// TestAddStopDaemon ensures daemons can be managed through the Go API without the MCP layer.
+func TestAddStopDaemon(t *testing.T) {
+	s := daemonize.New()
+	ctx := context.Background()
+	d, err := s.AddDaemon(ctx, "api", []string{"sh", "-c", "echo hello; sleep 100"}, t.TempDir())
+	if err != nil {
+		t.Fatalf("AddDaemon error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	if s.Daemons["api"] != d {
+		t.Fatal("AddDaemon did not register the daemon")
+	}
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusRunning {
+		t.Fatalf("Status() = %s, %v, want running", status, err)
+	}
+	for i := 0; d.Logger.Lines() == 0; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for daemon output")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.StopDaemon(ctx, "api"); err != nil {
+		t.Fatalf("StopDaemon error: %v", err)
+	}
+	if status, err := d.Status(); err != nil || status != daemonize.DaemonStatusStopped {
+		t.Errorf("Status() after StopDaemon = %s, %v, want stopped", status, err)
+	}
+	if _, ok := s.Daemons["api"]; ok {
+		t.Error("StopDaemon did not remove the daemon")
+	}
+	if _, text := callTool(t, s, "daemonize_logs", map[string]any{"name": "api", "tail": 10}); !strings.Contains(text, "hello") {
+		t.Errorf("daemonize_logs after StopDaemon = %q, want the retained output", text)
+	}
+	if err := s.StopDaemon(ctx, "api"); !errors.Is(err, daemonize.ErrDaemonNotFound) {
+		t.Errorf("StopDaemon of a removed daemon error = %v, want ErrDaemonNotFound", err)
+	}
+}
+
+// TestAddDaemonErrors ensures AddDaemon rejects bad names and leaves nothing registered when the start fails.
+func TestAddDaemonErrors(t *testing.T) {
+	s := daemonize.New()
+	ctx := context.Background()
+	if _, err := s.AddDaemon(ctx, "bad name", []string{"sleep", "100"}, t.TempDir()); err == nil {
+		t.Error("AddDaemon with an invalid name succeeded")
+	}
+	_, err := s.AddDaemon(ctx, "missing", []string{"no-such-command-for-daemonize"}, t.TempDir())
+	var spawnErr *daemonize.SpawnError
+	if !errors.As(err, &spawnErr) {
+		t.Errorf("AddDaemon error = %v, want a SpawnError", err)
+	}
+	if _, ok := s.Daemons["missing"]; ok {
+		t.Error("a daemon that failed to start is registered")
+	}
+}
+
+// TestStopDaemonAlreadyStopped ensures StopDaemon removes an exited daemon and reports it was not running.
+func TestStopDaemonAlreadyStopped(t *testing.T) {
+	s := daemonize.New()
+	ctx := context.Background()
+	d, err := s.AddDaemon(ctx, "done", []string{"true"}, t.TempDir())
+	if err != nil {
+		t.Fatalf("AddDaemon error: %v", err)
+	}
+	_ = d.Wait()
+	if err := s.StopDaemon(ctx, "done"); !errors.Is(err, daemonize.ErrDaemonNotRunning) {
+		t.Errorf("StopDaemon error = %v, want ErrDaemonNotRunning", err)
+	}
+	if _, ok := s.Daemons["done"]; ok {
+		t.Error("StopDaemon did not remove the exited daemon")
+	}
+}
+
+// TestListFailure ensures daemonize_list reports the exit code of a daemon that failed.
+func TestListFailure(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "exit2",
+		"command": []any{"sh", "-c", "exit 2"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	_ = s.Daemons["exit2"].Wait()
+	_, text = callTool(t, s, "daemonize_list", nil)
+	if !strings.Contains(text, "exited with code 2)") {
+		t.Errorf("daemonize_list = %q, want the exit code", text)
+	}
+}
+
+// TestStartResolvesExecutable ensures a command given by bare name is reported with its resolved path.
+func TestStartResolvesExecutable(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "bare",
+		"command": []any{"sleep", "100"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["bare"]
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Fatalf("LookPath error: %v", err)
+	}
+	if got := d.Executable(); got != sleep {
+		t.Errorf("Executable() = %q, want %q", got, sleep)
+	}
+	_, text = callTool(t, s, "daemonize_list", map[string]any{"format": "json"})
+	var records []daemonize.DaemonRecord
+	if err := json.Unmarshal([]byte(text), &records); err != nil {
+		t.Fatalf("failed to decode daemonize_list: %v", err)
+	}
+	if len(records) != 1 || records[0].Executable != sleep {
+		t.Errorf("daemonize_list records = %+v, want executable %s", records, sleep)
+	}
+}
+
+// TestStartExecutableNotFound ensures a missing executable is reported clearly before launching.
+func TestStartExecutableNotFound(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "missing",
+		"command": []any{"no-such-command-for-daemonize"},
+		"workdir": t.TempDir(),
+		"env":     []any{"PATH=/nonexistent"},
+	})
+	if !result.IsError || !strings.Contains(text, "failed to start daemon missing: no-such-command-for-daemonize: executable file not found") {
+		t.Errorf("daemonize_start = %q, want an executable not found error", text)
+	}
+}
+
+// TestListQuotesCommand ensures arguments with spaces and quotes are shell-quoted in daemonize_list.
+func TestListQuotesCommand(t *testing.T) {
+	d := daemonize.NewDaemon("quoted", []string{"sh", "-c", "echo 'hi there'"}, t.TempDir())
+	s := daemonize.New(daemonize.WithDaemon(d))
+	_, text := callTool(t, s, "daemonize_list", nil)
+	want := `quoted[sh -c 'echo '\''hi there'\''']`
+	if !strings.Contains(text, want) {
+		t.Errorf("daemonize_list = %q, want it to contain %q", text, want)
+	}
+}
+
+// startClient serves the tools of s over an in-process stdio transport and returns an initialized client.
+func startClient(t *testing.T, s *daemonize.Server) *client.Client {
+	t.Helper()
+	ms := server.NewMCPServer("test", "1.0.0")
+	s.Register(ms)
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.NewStdioServer(ms).Listen(ctx, serverReader, serverWriter)
+	}()
+	c := client.NewClient(transport.NewIO(clientReader, clientWriter, io.NopCloser(strings.NewReader(""))))
+	t.Cleanup(func() {
+		_ = c.Close()
+		cancel()
+		_ = serverWriter.Close()
+		<-done
+	})
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("client Start error: %v", err)
+	}
+	var initReq mcp.InitializeRequest
+	initReq.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	if _, err := c.Initialize(ctx, initReq); err != nil {
+		t.Fatalf("client Initialize error: %v", err)
+	}
+	return c
+}
+
+// TestSubscribeLogs ensures a subscribed client receives pushed log lines until it unsubscribes.
+func TestSubscribeLogs(t *testing.T) {
+	d := daemonize.NewDaemon("pushed", []string{"true"}, t.TempDir())
+	s := daemonize.New(daemonize.WithDaemon(d))
+	c := startClient(t, s)
+	ctx := context.Background()
+
+	received := make(chan string, 10)
+	c.OnNotification(func(n mcp.JSONRPCNotification) {
+		if n.Method != "notifications/message" {
+			return
+		}
+		if data, ok := n.Params.AdditionalFields["data"].(string); ok {
+			received <- data
+		}
+	})
+	call := func(name string) {
+		t.Helper()
+		var req mcp.CallToolRequest
+		req.Params.Name = name
+		req.Params.Arguments = map[string]any{"name": "pushed"}
+		result, err := c.CallTool(ctx, req)
+		if err != nil {
+			t.Fatalf("%s error: %v", name, err)
+		}
+		if result.IsError {
+			t.Fatalf("%s failed: %v", name, result.Content)
+		}
+	}
+
+	call("daemonize_subscribe_logs")
+	fmt.Fprintln(d.Logger, "first")
+	fmt.Fprintln(d.Logger, "second")
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	call("daemonize_unsubscribe_logs")
+	fmt.Fprintln(d.Logger, "after")
+	select {
+	case got := <-received:
+		t.Errorf("received %q after unsubscribe", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestMuteLogs ensures output written while muted is counted but not stored.
+func TestMuteLogs(t *testing.T) {
+	d := daemonize.NewDaemon("mute", []string{"sh", "-c", "sleep 0.5; printf 'a\nb\nc\n'"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	if result, text := callTool(t, s, "daemonize_mute_logs", map[string]any{"name": "mute"}); result.IsError {
+		t.Fatalf("daemonize_mute_logs error: %s", text)
+	}
+	waitStatus(t, d, daemonize.DaemonStatusStopped)
+	_, text := callTool(t, s, "daemonize_unmute_logs", map[string]any{"name": "mute"})
+	if want := "Logs unmuted; muted 3 lines"; text != want {
+		t.Errorf("daemonize_unmute_logs = %q, want %q", text, want)
+	}
+	lines, err := d.Logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	if len(lines) != 1 || lines[0] != "muted 3 lines" {
+		t.Errorf("stored lines = %q, want only the muted marker", lines)
+	}
+}
+
+// TestShutdownLeavesDetached ensures Shutdown stops attached daemons while detached ones keep running.
+func TestShutdownLeavesDetached(t *testing.T) {
+	detached := daemonize.NewDaemon("detached", []string{"sleep", "100"}, t.TempDir())
+	detached.Detached = true
+	attached := daemonize.NewDaemon("attached", []string{"sleep", "100"}, t.TempDir())
+	for _, d := range []*daemonize.Daemon{detached, attached} {
+		if err := d.Start(context.Background()); err != nil {
+			t.Fatalf("Start %s error: %v", d.Name, err)
+		}
+	}
+	defer detached.Stop(context.Background())
+	s := daemonize.New(daemonize.WithDaemon(detached), daemonize.WithDaemon(attached))
+	s.Shutdown(context.Background())
+
+	if status, _ := attached.Status(); status != daemonize.DaemonStatusStopped {
+		t.Errorf("attached daemon status = %s, want stopped", status)
+	}
+	pid := detached.PID()
+	if pid <= 0 {
+		t.Fatalf("detached daemon PID() = %d, want a running process", pid)
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Errorf("detached daemon process %d is not alive: %v", pid, err)
+	}
+}
+
+// closeCountingLogger counts the calls to Close of a memory logger.
+type closeCountingLogger struct {
+	daemonize.Logger
+	closes atomic.Int32
+}
+
+func (l *closeCountingLogger) Close() error {
+	l.closes.Add(1)
+	return l.Logger.Close()
+}
+
+// TestShutdownClosesLoggers ensures Shutdown closes the logger of every stopped daemon exactly once.
+func TestShutdownClosesLoggers(t *testing.T) {
+	running := daemonize.NewDaemon("running", []string{"sleep", "100"}, t.TempDir())
+	exited := daemonize.NewDaemon("exited", []string{"true"}, t.TempDir())
+	failed := daemonize.NewDaemon("failed", []string{"false"}, t.TempDir())
+	loggers := map[string]*closeCountingLogger{}
+	for _, d := range []*daemonize.Daemon{running, exited, failed} {
+		l := &closeCountingLogger{Logger: daemonize.NewMemoryLogger()}
+		d.SetLogger(l)
+		loggers[d.Name] = l
+		if err := d.Start(context.Background()); err != nil {
+			t.Fatalf("Start %s error: %v", d.Name, err)
+		}
+	}
+	_ = exited.Wait()
+	_ = failed.Wait()
+	// Removing the second stopped daemon drops the logger kept for the first.
+	s := daemonize.New(daemonize.WithDaemon(running), daemonize.WithDaemon(exited), daemonize.WithDaemon(failed), daemonize.WithHistorySize(1))
+	s.Shutdown(context.Background())
+
+	for name, l := range loggers {
+		if got := l.closes.Load(); got != 1 {
+			t.Errorf("logger of %s closed %d times, want 1", name, got)
+		}
+	}
+}
+
+// TestRun ensures a command that succeeds returns its output and exit code.
+func TestRun(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_run", map[string]any{
+		"command": []any{"sh", "-c", "echo hello"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_run error: %s", text)
+	}
+	want := "Command output:\n  1: hello\nCommand exited with code 0\n"
+	if text != want {
+		t.Errorf("daemonize_run = %q, want %q", text, want)
+	}
+}
+
+// TestRunEchoNotRegistered ensures a one-shot command returns its output without being registered as a daemon.
+func TestRunEchoNotRegistered(t *testing.T) {
+	s := daemonize.New()
+	_, text := callTool(t, s, "daemonize_run", map[string]any{
+		"command": []any{"echo", "hi"},
+		"workdir": t.TempDir(),
+	})
+	want := "Command output:\n  1: hi\nCommand exited with code 0\n"
+	if text != want {
+		t.Errorf("daemonize_run = %q, want %q", text, want)
+	}
+	if len(s.Daemons) != 0 {
+		t.Errorf("Daemons = %v, want the command not registered", s.Daemons)
+	}
+}
+
+// TestRunFailure ensures the exit code and stderr of a failing command are returned.
+func TestRunFailure(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_run", map[string]any{
+		"command": []any{"sh", "-c", "echo oops >&2; exit 3"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_run error: %s", text)
+	}
+	want := "Command output:\n  1: oops\nCommand exited with code 3\n"
+	if text != want {
+		t.Errorf("daemonize_run = %q, want %q", text, want)
+	}
+}
+
+// TestRunTimeout ensures a command running past its timeout is stopped and reported as an error.
+func TestRunTimeout(t *testing.T) {
+	s := daemonize.New()
+	start := time.Now()
+	result, text := callTool(t, s, "daemonize_run", map[string]any{
+		"command":         []any{"sh", "-c", "echo started; exec sleep 100"},
+		"workdir":         t.TempDir(),
+		"timeout_seconds": 0.2,
+	})
+	if !result.IsError {
+		t.Fatalf("daemonize_run did not time out: %s", text)
+	}
+	if !strings.Contains(text, "1: started") || !strings.Contains(text, "Command timed out after 200ms") {
+		t.Errorf("daemonize_run = %q, want partial output and timeout", text)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("daemonize_run took %s, want the command stopped promptly", elapsed)
+	}
+}
+
+// TestRestartDelay ensures the restarted process starts only after the delay.
+func TestRestartDelay(t *testing.T) {
+	d := daemonize.NewDaemon("restart", []string{"sleep", "100"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	called := time.Now()
+	result, text := callTool(t, s, "daemonize_restart", map[string]any{
+		"name":                  "restart",
+		"restart_delay_seconds": 0.3,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_restart error: %s", text)
+	}
+	next := s.Daemons["restart"]
+	defer next.Stop(context.Background())
+	if next == d {
+		t.Fatal("daemon was not replaced by a new process")
+	}
+	if status, _ := d.Status(); status != daemonize.DaemonStatusStopped {
+		t.Errorf("old daemon status = %s, want stopped", status)
+	}
+	// The stop happens during the call, so the new process must start at
+	// least the delay after the call began.
+	if gap := next.StartedAt().Sub(called); gap < 300*time.Millisecond {
+		t.Errorf("new process started %s after restart was called, want at least 300ms", gap)
+	}
+	if next.PID() == -1 {
+		t.Error("restarted daemon is not running")
+	}
+}
+
+// TestSignals ensures the common Unix signals are listed.
+func TestSignals(t *testing.T) {
+	s := daemonize.New()
+	_, text := callTool(t, s, "daemonize_signals", map[string]any{})
+	for _, want := range []string{
+		fmt.Sprintf("SIGTERM (%d)", int(syscall.SIGTERM)),
+		fmt.Sprintf("SIGHUP (%d)", int(syscall.SIGHUP)),
+		fmt.Sprintf("SIGUSR1 (%d)", int(syscall.SIGUSR1)),
+		fmt.Sprintf("SIGKILL (%d)", int(syscall.SIGKILL)),
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("daemonize_signals = %q, missing %q", text, want)
+		}
+	}
+}
+
+// TestSignal ensures a listed signal is delivered to the daemon.
+func TestSignal(t *testing.T) {
+	d := daemonize.NewDaemon("sig", []string{"sleep", "100"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer d.Stop(context.Background())
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_signal", map[string]any{"name": "sig", "signal": "term"})
+	if result.IsError {
+		t.Fatalf("daemonize_signal error: %s", text)
+	}
+	// History is recorded by an exit hook that runs after the status changes.
+	for range 100 {
+		if len(s.History()) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := s.History(); len(r) == 0 || r[0].Signal != syscall.SIGTERM {
+		t.Errorf("History() = %+v, want an exit by SIGTERM", r)
+	}
+	result, text = callTool(t, s, "daemonize_signal", map[string]any{"name": "sig", "signal": "SIGBOGUS"})
+	if !result.IsError || !strings.Contains(text, "signal SIGBOGUS is not supported") {
+		t.Errorf("daemonize_signal with unknown signal = %q, want unsupported error", text)
+	}
+}
+
+// TestListJSON ensures the JSON list output decodes into daemon records.
+func TestListJSON(t *testing.T) {
+	d := daemonize.NewDaemon("json", []string{"sleep", "100"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer d.Stop(context.Background())
+	fmt.Fprintln(d.Logger, "hello")
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_list", map[string]any{"format": "json"})
+	if result.IsError {
+		t.Fatalf("daemonize_list error: %s", text)
+	}
+	var records []daemonize.DaemonRecord
+	if err := json.Unmarshal([]byte(text), &records); err != nil {
+		t.Fatalf("unmarshal %q: %v", text, err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("records = %+v, want one daemon", records)
+	}
+	r := records[0]
+	if r.Name != "json" || !slices.Equal(r.Command, d.Commands) || r.Workdir != d.Workdir {
+		t.Errorf("record = %+v, want the configuration of the daemon", r)
+	}
+	if r.Status != daemonize.DaemonStatusRunning || r.PID != d.PID() {
+		t.Errorf("record = %+v, want running with pid %d", r, d.PID())
+	}
+	if r.LastLog == nil || r.LastLog.Text != "hello" || r.LastLog.Time.IsZero() {
+		t.Errorf("LastLog = %+v, want hello with a time", r.LastLog)
+	}
+}
+
+// TestLogsJSON ensures the JSON logs output decodes into log records with line numbers.
+func TestLogsJSON(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	for i := range 3 {
+		fmt.Fprintf(d.Logger, "line %d\n", i+1)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name":   "logs",
+		"tail":   2,
+		"format": "json",
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_logs error: %s", text)
+	}
+	var records []daemonize.LogRecord
+	if err := json.Unmarshal([]byte(text), &records); err != nil {
+		t.Fatalf("unmarshal %q: %v", text, err)
+	}
+	want := []daemonize.LogRecord{{Line: 2, Text: "line 2"}, {Line: 3, Text: "line 3"}}
+	if !slices.Equal(records, want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+
+	_, text = callTool(t, s, "daemonize_logs", map[string]any{
+		"name":    "logs",
+		"tail":    10,
+		"pattern": "nothing",
+		"format":  "json",
+	})
+	if text != "[]" {
+		t.Errorf("daemonize_logs without matches = %q, want []", text)
+	}
+}
+
+// TestMaxResultBytes ensures large tool results are truncated with a notice.
+func TestMaxResultBytes(t *testing.T) {
+	opts := []daemonize.Option{daemonize.WithMaxResultBytes(200)}
+	for i := range 50 {
+		d := daemonize.NewDaemon(fmt.Sprintf("daemon-%02d", i), []string{"sleep", "100"}, t.TempDir())
+		opts = append(opts, daemonize.WithDaemon(d))
+	}
+	s := daemonize.New(opts...)
+	_, text := callTool(t, s, "daemonize_list", map[string]any{})
+	body, notice, ok := strings.Cut(text, "\n... output truncated")
+	if !ok {
+		t.Fatalf("daemonize_list = %q, want a truncation notice", text)
+	}
+	if len(body) > 200 {
+		t.Errorf("truncated output is %d bytes, want at most 200", len(body))
+	}
+	if !strings.HasPrefix(body, "Running daemons:\n  - daemon-00[") {
+		t.Errorf("truncated output %q does not start with the list", body)
+	}
+	if !strings.Contains(notice, fmt.Sprintf("(%d of", len(body))) {
+		t.Errorf("notice %q does not report the shown size %d", notice, len(body))
+	}
+
+	_, text = callTool(t, s, "daemonize_list", map[string]any{"format": "json"})
+	if !json.Valid([]byte(text)) {
+		t.Errorf("daemonize_list in JSON format = %q, want it left whole", text)
+	}
+}
+
+// TestMaxResultBytesRuneBoundary ensures truncation does not split a multi-byte character.
+func TestMaxResultBytesRuneBoundary(t *testing.T) {
+	d := daemonize.NewDaemon("utf8", []string{"true"}, t.TempDir())
+	fmt.Fprintln(d.Logger, strings.Repeat("あ", 100))
+	s := daemonize.New(daemonize.WithDaemon(d), daemonize.WithMaxResultBytes(50))
+	_, text := callTool(t, s, "daemonize_logs", map[string]any{"name": "utf8", "tail": 1})
+	body, _, ok := strings.Cut(text, "\n... output truncated")
+	if !ok {
+		t.Fatalf("daemonize_logs = %q, want a truncation notice", text)
+	}
+	if !utf8.ValidString(body) || len(body) > 50 {
+		t.Errorf("truncated output %q is not valid UTF-8 of at most 50 bytes", body)
+	}
+}
+
+// TestLogsWindow ensures offset and limit select a window in the middle of the log and report the total.
+func TestLogsWindow(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	for i := range 10 {
+		fmt.Fprintf(d.Logger, "line %d\n", i+1)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name":   "logs",
+		"offset": 3,
+		"limit":  3,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_logs error: %s", text)
+	}
+	want := "Daemon logs (lines 4-6 of 10):\n  4: line 4\n  5: line 5\n  6: line 6\n"
+	if text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+	if got := d.Logger.Lines(); got != 10 {
+		t.Errorf("after window read Lines() = %d, want 10", got)
+	}
+
+	_, text = callTool(t, s, "daemonize_logs", map[string]any{
+		"name":   "logs",
+		"offset": 8,
+		"format": "json",
+	})
+	var page daemonize.LogPage
+	if err := json.Unmarshal([]byte(text), &page); err != nil {
+		t.Fatalf("unmarshal %q: %v", text, err)
+	}
+	wantLines := []daemonize.LogRecord{{Line: 9, Text: "line 9"}, {Line: 10, Text: "line 10"}}
+	if page.Total != 10 || !slices.Equal(page.Lines, wantLines) {
+		t.Errorf("page = %+v, want total 10 and lines %+v", page, wantLines)
+	}
+}
+
+// TestLogsWindowConcurrentWrites ensures a window read while lines are written and evicted numbers every line correctly.
+func TestLogsWindowConcurrentWrites(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	s := daemonize.New(daemonize.WithDaemon(d))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				fmt.Fprintf(d.Logger, "line %d\n", i)
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+	for range 50 {
+		_, text := callTool(t, s, "daemonize_logs", map[string]any{
+			"name":   "logs",
+			"offset": 0,
+			"limit":  5,
+			"format": "json",
+		})
+		var page daemonize.LogPage
+		if err := json.Unmarshal([]byte(text), &page); err != nil {
+			t.Fatalf("unmarshal %q: %v", text, err)
+		}
+		for _, r := range page.Lines {
+			if want := fmt.Sprintf("line %d", r.Line); r.Text != want || r.Line > page.Total {
+				t.Fatalf("page = %+v, want line %d to read %q and not exceed the total", page, r.Line, want)
+			}
+		}
+	}
+}
+
+// TestLogsWindowOutOfRange ensures an offset past the end returns no lines without an error.
+func TestLogsWindowOutOfRange(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	fmt.Fprintln(d.Logger, "only")
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name":   "logs",
+		"offset": 5,
+		"limit":  10,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_logs error: %s", text)
+	}
+	if want := "No logs in range (1 lines total)"; text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+	_, text = callTool(t, s, "daemonize_logs", map[string]any{
+		"name":   "logs",
+		"offset": 5,
+		"format": "json",
+	})
+	if want := `{"total":1,"lines":[]}`; text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+}
+
+// TestUpdate ensures an updated command and env of a stopped daemon are used on the next start.
+func TestUpdate(t *testing.T) {
+	d := daemonize.NewDaemon("update", []string{"echo", "old"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	waitStatus(t, d, daemonize.DaemonStatusStopped)
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_update", map[string]any{
+		"name":    "update",
+		"command": []any{"sh", "-c", "echo new $GREETING"},
+		"env":     []any{"GREETING=hello"},
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_update error: %s", text)
+	}
+	if result, text := callTool(t, s, "daemonize_restart", map[string]any{"name": "update"}); result.IsError {
+		t.Fatalf("daemonize_restart error: %s", text)
+	}
+	next := s.Daemons["update"]
+	waitStatus(t, next, daemonize.DaemonStatusStopped)
+	lines, err := next.Logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	want := []string{"old", "new hello"}
+	if !slices.Equal(lines, want) {
+		t.Errorf("logs = %q, want %q", lines, want)
+	}
+}
+
+// TestUpdateRunning ensures a running daemon is not updated.
+func TestUpdateRunning(t *testing.T) {
+	d := daemonize.NewDaemon("update", []string{"sleep", "100"}, t.TempDir())
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer d.Stop(context.Background())
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_update", map[string]any{
+		"name":    "update",
+		"command": []any{"true"},
+	})
+	if !result.IsError || !strings.Contains(text, "still running") {
+		t.Errorf("daemonize_update on running daemon = %q, want a still running error", text)
+	}
+	if !slices.Equal(d.Commands, []string{"sleep", "100"}) {
+		t.Errorf("Commands = %q, want unchanged", d.Commands)
+	}
+}
+
+// TestUpdateMissingWorkdir ensures a daemon is not updated to a working directory that does not exist.
+func TestUpdateMissingWorkdir(t *testing.T) {
+	dir := t.TempDir()
+	d := daemonize.NewDaemon("update", []string{"true"}, dir)
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_update", map[string]any{
+		"name":    "update",
+		"workdir": filepath.Join(dir, "missing"),
+	})
+	if !result.IsError || !strings.Contains(text, "workdir") {
+		t.Errorf("daemonize_update to a missing workdir = %q, want a workdir error", text)
+	}
+	if s.Daemons["update"] != d || d.Workdir != dir {
+		t.Errorf("daemon was updated to workdir %q", s.Daemons["update"].Workdir)
+	}
+}
+
+// TestRunCommandLine ensures a command line is run by the shell, so pipelines work.
+func TestRunCommandLine(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_run", map[string]any{
+		"command_line": "echo hi | cat",
+		"workdir":      t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_run error: %s", text)
+	}
+	want := "Command output:\n  1: hi\nCommand exited with code 0\n"
+	if text != want {
+		t.Errorf("daemonize_run = %q, want %q", text, want)
+	}
+}
+
+// TestStartCommandLine ensures daemonize_start accepts a command line and rejects it combined with command.
+func TestStartCommandLine(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":         "pipe",
+		"command_line": "echo hi | cat; sleep 100",
+		"workdir":      t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start error: %s", text)
+	}
+	d := s.Daemons["pipe"]
+	defer d.Stop(context.Background())
+	for range 100 {
+		if d.Logger.Lines() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if last, ok := d.Logger.Last(); !ok || last.Text != "hi" {
+		t.Errorf("Last() = %q, want hi", last.Text)
+	}
+
+	result, text = callTool(t, s, "daemonize_start", map[string]any{
+		"name":         "both",
+		"command":      []any{"true"},
+		"command_line": "true",
+		"workdir":      t.TempDir(),
+	})
+	if !result.IsError || !strings.Contains(text, "only one of command or command_line allowed") {
+		t.Errorf("daemonize_start with both = %q, want a validation error", text)
+	}
+}
+
+// TestTailFollow ensures daemonize_tail_follow returns only lines written during the window, up to max_lines.
+func TestTailFollow(t *testing.T) {
+	d := daemonize.NewDaemon("tail", []string{"true"}, t.TempDir())
+	fmt.Fprintln(d.Logger, "old")
+	s := daemonize.New(daemonize.WithDaemon(d))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		for _, line := range []string{"new 1", "new 2", "new 3"} {
+			fmt.Fprintln(d.Logger, line)
+		}
+	}()
+	result, text := callTool(t, s, "daemonize_tail_follow", map[string]any{
+		"name":             "tail",
+		"duration_seconds": 5,
+		"max_lines":        2,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_tail_follow failed: %s", text)
+	}
+	if want := "New daemon logs:\n  1: new 1\n  2: new 2\n"; text != want {
+		t.Errorf("tail follow output = %q, want %q", text, want)
+	}
+
+	result, text = callTool(t, s, "daemonize_tail_follow", map[string]any{
+		"name":             "tail",
+		"duration_seconds": 0.2,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_tail_follow failed: %s", text)
+	}
+	if !strings.HasPrefix(text, "No new logs") {
+		t.Errorf("tail follow output = %q, want no new logs", text)
+	}
+}
+
+// TestStateNotifications ensures clients are notified when a daemon starts and crashes.
+func TestStateNotifications(t *testing.T) {
+	s := daemonize.New()
+	c := startClient(t, s)
+	received := make(chan map[string]any, 10)
+	c.OnNotification(func(n mcp.JSONRPCNotification) {
+		if n.Method == daemonize.StateNotificationMethod {
+			received <- n.Params.AdditionalFields
+		}
+	})
+
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "crash",
+		"command": []any{"sh", "-c", "sleep 0.2; exit 3"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	for _, want := range []string{"running", daemonize.StateCrashed} {
+		select {
+		case params := <-received:
+			if params["name"] != "crash" || params["status"] != want {
+				t.Fatalf("notification = %v, want status %s for crash", params, want)
+			}
+			if want == daemonize.StateCrashed && params["exit_code"] != float64(3) {
+				t.Errorf("crash notification exit_code = %v, want 3", params["exit_code"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s notification", want)
+		}
+	}
+}
+
+// TestStateWebhook ensures a crash is POSTed to the state webhook, retrying failed deliveries.
+func TestStateWebhook(t *testing.T) {
+	var requests atomic.Int32
+	received := make(chan daemonize.StateChange, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var change daemonize.StateChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			t.Errorf("failed to decode webhook payload: %v", err)
+		}
+		received <- change
+	}))
+	t.Cleanup(hook.Close)
+
+	s := daemonize.New(daemonize.WithStateWebhook(hook.URL))
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "crash",
+		"command": []any{"sh", "-c", "sleep 0.2; exit 3"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for len(got) < 2 {
+		select {
+		case change := <-received:
+			got = append(got, change.OldStatus+"->"+change.NewStatus)
+			if change.Name != "crash" || change.Timestamp.IsZero() {
+				t.Errorf("webhook payload = %+v, want name crash and a timestamp", change)
+			}
+			if change.NewStatus == daemonize.StateCrashed && (change.ExitCode == nil || *change.ExitCode != 3) {
+				t.Errorf("crash payload exit_code = %v, want 3", change.ExitCode)
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for webhooks, got %v", got)
+		}
+	}
+	slices.Sort(got)
+	if want := []string{"running->crashed", "stopped->running"}; !slices.Equal(got, want) {
+		t.Errorf("webhook transitions = %v, want %v", got, want)
+	}
+}
+
+// TestStartInvalidStateWebhook ensures a state_webhook that is not an http URL is rejected.
+func TestStartInvalidStateWebhook(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":          "web",
+		"command":       []any{"sleep", "100"},
+		"workdir":       t.TempDir(),
+		"state_webhook": "ftp://example.com/hook",
+	})
+	if !result.IsError || !strings.Contains(text, "state_webhook must be an http or https URL") {
+		t.Errorf("daemonize_start = %q, want state_webhook error", text)
+	}
+}
+
+// TestStartDryRun ensures a dry run resolves the command and reports the environment without starting it.
+func TestStartDryRun(t *testing.T) {
+	t.Setenv("FOO_TOKEN", "server-secret")
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "web",
+		"command": []any{"sleep", "100"},
+		"workdir": t.TempDir(),
+		"env":     []any{"PORT=8080", "API_SECRET=daemon-secret"},
+		"dry_run": true,
+	})
+	if result.IsError {
+		t.Fatalf("dry run failed: %s", text)
+	}
+	for _, secret := range []string{"server-secret", "daemon-secret"} {
+		if strings.Contains(text, secret) {
+			t.Errorf("dry run result = %q, want %q redacted", text, secret)
+		}
+	}
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Fatalf("LookPath error: %v", err)
+	}
+	for _, want := range []string{"nothing was started", "Executable: " + sleep + "\n", "  PORT=8080\n", "  FOO_TOKEN=[redacted]\n", "  API_SECRET=[redacted]\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("dry run result = %q, want it to contain %q", text, want)
+		}
+	}
+	if _, ok := s.Daemons["web"]; ok {
+		t.Error("dry run registered the daemon")
+	}
+}
+
+// TestStartDryRunNotFound ensures a dry run reports a command that does not resolve.
+func TestStartDryRunNotFound(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "web",
+		"command": []any{"no-such-command-for-daemonize"},
+		"workdir": t.TempDir(),
+		"dry_run": true,
+	})
+	if !result.IsError || !strings.Contains(text, "no-such-command-for-daemonize: executable file not found") {
+		t.Errorf("dry run result = %q, want a not found error", text)
+	}
+	if _, ok := s.Daemons["web"]; ok {
+		t.Error("dry run registered the daemon")
+	}
+}
+
+// TestLogBudget ensures the logs of several verbose daemons are evicted down to the server's budget.
+func TestLogBudget(t *testing.T) {
+	// Each daemon alone keeps about 6KiB of its last 1024 lines.
+	const budget = 8 * 1024
+	s := daemonize.New(daemonize.WithLogBudget(budget))
+	var daemons []*daemonize.Daemon
+	for i := range 4 {
+		name := fmt.Sprintf("verbose%d", i)
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":    name,
+			"command": []any{"seq", "1", "20000"},
+			"workdir": t.TempDir(),
+		})
+		if result.IsError {
+			t.Fatalf("daemonize_start failed: %s", text)
+		}
+		daemons = append(daemons, s.Daemons[name])
+	}
+	for _, d := range daemons {
+		_ = d.Wait()
+	}
+	var used int64
+	for i := 0; ; i++ {
+		if used, _ = s.LogBytes(); used <= budget {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("log bytes = %d, want at most %d", used, budget)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, d := range daemons {
+		last, ok := d.Logger.Last()
+		if !ok || last.Text != "20000" {
+			t.Errorf("last line of %s = %q, want the newest line kept", d.Name, last.Text)
+		}
+	}
+	_, text := callTool(t, s, "daemonize_list", nil)
+	if !strings.Contains(text, fmt.Sprintf("of %d bytes", budget)) {
+		t.Errorf("daemonize_list = %q, want the log memory usage", text)
+	}
+}
+
+// TestLogsByteWindow ensures daemonize_logs reads a byte range and reports where to continue.
+func TestLogsByteWindow(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "bytes",
+		"command": []any{"printf", "first\nsecond\nthird\n"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	_ = s.Daemons["bytes"].Wait()
+	_, text = callTool(t, s, "daemonize_logs", map[string]any{
+		"name":        "bytes",
+		"byte_offset": 3,
+		"byte_limit":  8,
+		"format":      "json",
+	})
+	var chunk daemonize.LogChunk
+	if err := json.Unmarshal([]byte(text), &chunk); err != nil {
+		t.Fatalf("failed to decode %q: %v", text, err)
+	}
+	if want := (daemonize.LogChunk{Offset: 3, NextOffset: 11, Data: "st\nsecon"}); chunk != want {
+		t.Errorf("daemonize_logs chunk = %+v, want %+v", chunk, want)
+	}
+	_, text = callTool(t, s, "daemonize_logs", map[string]any{"name": "bytes", "byte_offset": 11})
+	if want := "Daemon log bytes 11-19:\nd\nthird\n"; text != want {
+		t.Errorf("daemonize_logs = %q, want %q", text, want)
+	}
+	result, text = callTool(t, s, "daemonize_logs", map[string]any{"name": "bytes", "byte_offset": 0, "tail": 1})
+	if !result.IsError || !strings.Contains(text, "tail cannot be combined with byte_offset or byte_limit") {
+		t.Errorf("daemonize_logs = %q, want a validation error", text)
+	}
+}
+
+// TestLogsResource ensures a started daemon's logs are listed and readable as a resource.
+func TestLogsResource(t *testing.T) {
+	s := daemonize.New()
+	c := startClient(t, s)
+	ctx := context.Background()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "web",
+		"command": []any{"sh", "-c", "echo hello; sleep 100"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["web"]
+	t.Cleanup(func() { _ = d.Stop(ctx) })
+	for i := 0; d.Logger.Lines() == 0; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for daemon output")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	list, err := c.ListResources(ctx, mcp.ListResourcesRequest{})
+	if err != nil {
+		t.Fatalf("ListResources error: %v", err)
+	}
+	uris := make([]string, 0, len(list.Resources))
+	for _, r := range list.Resources {
+		uris = append(uris, r.URI)
+	}
+	if !slices.Contains(uris, "daemon://web/logs") {
+		t.Fatalf("resources %v do not include daemon://web/logs", uris)
+	}
+
+	var req mcp.ReadResourceRequest
+	req.Params.URI = "daemon://web/logs"
+	read, err := c.ReadResource(ctx, req)
+	if err != nil {
+		t.Fatalf("ReadResource error: %v", err)
+	}
+	if len(read.Contents) != 1 {
+		t.Fatalf("ReadResource returned %d contents, want 1", len(read.Contents))
+	}
+	tc, ok := read.Contents[0].(mcp.TextResourceContents)
+	if !ok {
+		t.Fatalf("ReadResource returned %T, want text contents", read.Contents[0])
+	}
+	if tc.Text != "hello\n" {
+		t.Errorf("logs resource text = %q, want %q", tc.Text, "hello\n")
+	}
+}
+
+// TestLogsResourceAfterRemove ensures the logs resource of a removed daemon stays readable like daemonize_logs.
+func TestLogsResourceAfterRemove(t *testing.T) {
+	s := daemonize.New()
+	c := startClient(t, s)
+	ctx := context.Background()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "once",
+		"command": []any{"echo", "hello"},
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	_ = s.Daemons["once"].Wait()
+	if result, text := callTool(t, s, "daemonize_remove", map[string]any{"name": "once"}); result.IsError {
+		t.Fatalf("daemonize_remove failed: %s", text)
+	}
+	var req mcp.ReadResourceRequest
+	req.Params.URI = "daemon://once/logs"
+	read, err := c.ReadResource(ctx, req)
+	if err != nil {
+		t.Fatalf("ReadResource error: %v", err)
+	}
+	if tc, ok := read.Contents[0].(mcp.TextResourceContents); !ok || tc.Text != "hello\n" {
+		t.Errorf("logs resource after remove = %v, want %q", read.Contents[0], "hello\n")
+	}
+}
+
+// fakeClock records the delays waited on. The first fires delays elapse
+// immediately and later ones never do.
+type fakeClock struct {
+	mu     sync.Mutex
+	fires  int
+	delays []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delays = append(c.delays, d)
+	if len(c.delays) > c.fires {
+		return nil
+	}
+	ch := make(chan time.Time, 1)
+	ch <- c.Now().Add(d)
+	return ch
+}
+
+func (c *fakeClock) Delays() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.delays)
+}
+
+// TestAutoRestartBackoff ensures a crash-looping daemon is restarted with exponentially growing delays.
+func TestAutoRestartBackoff(t *testing.T) {
+	clock := &fakeClock{fires: 5}
+	s := daemonize.New(daemonize.WithClock(clock))
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":         "crashy",
+		"command":      []any{"sh", "-c", "exit 1"},
+		"workdir":      t.TempDir(),
+		"auto_restart": true,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	// After five restarts the sixth is scheduled 32s later and never fires.
+	for i := 0; !strings.Contains(text, "restarting at 2025-01-01T00:00:32Z"); i++ {
+		if i == 500 {
+			t.Fatalf("timeout waiting for the sixth restart to be scheduled: %q", text)
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, text = callTool(t, s, "daemonize_list", nil)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}
+	if got := clock.Delays(); !slices.Equal(got, want) {
+		t.Errorf("restart delays = %v, want %v", got, want)
+	}
+}
+
+// TestShutdownCancelsRestart ensures Shutdown ends a pending automatic restart.
+func TestShutdownCancelsRestart(t *testing.T) {
+	s := daemonize.New(daemonize.WithClock(&fakeClock{}))
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":         "crashy",
+		"command":      []any{"sh", "-c", "exit 1"},
+		"workdir":      t.TempDir(),
+		"auto_restart": true,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["crashy"]
+	for i := 0; d.NextRestart().IsZero(); i++ {
+		if i == 500 {
+			t.Fatal("timeout waiting for the restart to be scheduled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Shutdown(context.Background())
+	for i := 0; !d.NextRestart().IsZero(); i++ {
+		if i == 500 {
+			t.Fatal("restart still pending after Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestStartAll ensures daemonize_start_all starts stopped daemons after their dependencies and skips running ones.
+func TestStartAll(t *testing.T) {
+	app := daemonize.NewDaemon("app", []string{"sleep", "100"}, t.TempDir())
+	app.DependsOn = []string{"db"}
+	db := daemonize.NewDaemon("db", []string{"sleep", "100"}, t.TempDir())
+	running := daemonize.NewDaemon("running", []string{"sleep", "100"}, t.TempDir())
+	ctx := context.Background()
+	if err := running.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	s := daemonize.New(daemonize.WithDaemon(app), daemonize.WithDaemon(db), daemonize.WithDaemon(running))
+	t.Cleanup(func() {
+		for _, d := range s.Daemons {
+			_ = d.Stop(ctx)
+		}
+	})
+
+	result, text := callTool(t, s, "daemonize_start_all", nil)
+	if result.IsError {
+		t.Fatalf("daemonize_start_all failed: %s", text)
+	}
+	want := "Started daemons:\n  - app: started\n  - db: started\n  - running: already running\n"
+	if text != want {
+		t.Errorf("daemonize_start_all = %q, want %q", text, want)
+	}
+	if !s.Daemons["db"].StartedAt().Before(s.Daemons["app"].StartedAt()) {
+		t.Errorf("app started at %v, not after its dependency db at %v", s.Daemons["app"].StartedAt(), s.Daemons["db"].StartedAt())
+	}
+}
+
+// TestStartAllDependencyCycle ensures daemons in a dependency cycle are reported as failed.
+func TestStartAllDependencyCycle(t *testing.T) {
+	a := daemonize.NewDaemon("a", []string{"sleep", "100"}, t.TempDir())
+	a.DependsOn = []string{"b"}
+	b := daemonize.NewDaemon("b", []string{"sleep", "100"}, t.TempDir())
+	b.DependsOn = []string{"a"}
+	s := daemonize.New(daemonize.WithDaemon(a), daemonize.WithDaemon(b))
+
+	result, text := callTool(t, s, "daemonize_start_all", nil)
+	if !result.IsError {
+		t.Fatalf("daemonize_start_all with a cycle succeeded: %s", text)
+	}
+	if strings.Count(text, "dependency cycle") != 2 {
+		t.Errorf("daemonize_start_all = %q, want both daemons reported in a cycle", text)
+	}
+}
+
+// TestStartDependsOn ensures daemonize_start starts stopped dependencies and refuses to start when one cannot run.
+func TestStartDependsOn(t *testing.T) {
+	db := daemonize.NewDaemon("db", []string{"sleep", "100"}, t.TempDir())
+	broken := daemonize.NewDaemon("broken", []string{"/nonexistent/command"}, t.TempDir())
+	s := daemonize.New(daemonize.WithDaemon(db), daemonize.WithDaemon(broken))
+	ctx := context.Background()
+	t.Cleanup(func() {
+		for _, d := range s.Daemons {
+			_ = d.Stop(ctx)
+		}
+	})
+
+	for _, dep := range []string{"broken", "unknown"} {
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":       "app",
+			"command":    []any{"sleep", "100"},
+			"workdir":    t.TempDir(),
+			"depends_on": []any{dep},
+		})
+		if !result.IsError {
+			t.Fatalf("daemonize_start depending on %s succeeded: %s", dep, text)
+		}
+		if !strings.Contains(text, "dependency "+dep) {
+			t.Errorf("error %q does not name dependency %s", text, dep)
+		}
+		if _, ok := s.Daemons["app"]; ok {
+			t.Fatalf("app was registered although dependency %s is not running", dep)
+		}
+	}
+
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":       "app",
+		"command":    []any{"sleep", "100"},
+		"workdir":    t.TempDir(),
+		"depends_on": []any{"db"},
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	for _, name := range []string{"db", "app"} {
+		if status, _ := s.Daemons[name].Status(); status != daemonize.DaemonStatusRunning {
+			t.Errorf("daemon %s status = %s, want running", name, status)
+		}
+	}
+}
+
+// TestStartTransitiveDependencies ensures daemonize_start starts the dependencies of dependencies first and rejects cycles.
+func TestStartTransitiveDependencies(t *testing.T) {
+	db := daemonize.NewDaemon("db", []string{"sleep", "100"}, t.TempDir())
+	cache := daemonize.NewDaemon("cache", []string{"sleep", "100"}, t.TempDir())
+	cache.DependsOn = []string{"db"}
+	ping := daemonize.NewDaemon("ping", []string{"sleep", "100"}, t.TempDir())
+	ping.DependsOn = []string{"pong"}
+	pong := daemonize.NewDaemon("pong", []string{"sleep", "100"}, t.TempDir())
+	pong.DependsOn = []string{"ping"}
+	s := daemonize.New(daemonize.WithDaemon(db), daemonize.WithDaemon(cache), daemonize.WithDaemon(ping), daemonize.WithDaemon(pong))
+	ctx := context.Background()
+	t.Cleanup(func() {
+		for _, d := range s.Daemons {
+			_ = d.Stop(ctx)
+		}
+	})
+
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":       "app",
+		"command":    []any{"sleep", "100"},
+		"workdir":    t.TempDir(),
+		"depends_on": []any{"cache"},
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	for _, name := range []string{"db", "cache", "app"} {
+		if status, _ := s.Daemons[name].Status(); status != daemonize.DaemonStatusRunning {
+			t.Errorf("daemon %s status = %s, want running", name, status)
+		}
+	}
+	if !s.Daemons["db"].StartedAt().Before(s.Daemons["cache"].StartedAt()) {
+		t.Errorf("cache started at %v, not after its dependency db at %v", s.Daemons["cache"].StartedAt(), s.Daemons["db"].StartedAt())
+	}
+
+	result, text = callTool(t, s, "daemonize_start", map[string]any{
+		"name":       "web",
+		"command":    []any{"sleep", "100"},
+		"workdir":    t.TempDir(),
+		"depends_on": []any{"ping"},
+	})
+	if !result.IsError {
+		t.Fatalf("daemonize_start depending on a cycle succeeded: %s", text)
+	}
+	if !strings.Contains(text, "dependency cycle") {
+		t.Errorf("error %q does not report the dependency cycle", text)
+	}
+	for _, name := range []string{"ping", "pong"} {
+		if status, _ := s.Daemons[name].Status(); status != daemonize.DaemonStatusStopped {
+			t.Errorf("daemon %s status = %s, want stopped", name, status)
+		}
+	}
+}
+
+// TestMetrics ensures the metrics endpoint counts daemons by status and reports restarts.
+func TestMetrics(t *testing.T) {
+	stopped := daemonize.NewDaemon("idle", []string{"sleep", "100"}, t.TempDir())
+	s := daemonize.New(daemonize.WithDaemon(stopped))
+	ctx := context.Background()
+	for _, name := range []string{"web", "worker"} {
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":    name,
+			"command": []any{"sleep", "100"},
+			"workdir": t.TempDir(),
+		})
+		if result.IsError {
+			t.Fatalf("daemonize_start %s failed: %s", name, text)
+		}
+	}
+	if result, text := callTool(t, s, "daemonize_restart", map[string]any{"name": "web"}); result.IsError {
+		t.Fatalf("daemonize_restart failed: %s", text)
+	}
+	t.Cleanup(func() {
+		for _, d := range s.Daemons {
+			_ = d.Stop(ctx)
+		}
+	})
+
+	ts := httptest.NewServer(s.MetricsHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("GET metrics error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading metrics error: %v", err)
+	}
+	for _, want := range []string{
+		`daemonize_daemons{status="running"} 2`,
+		`daemonize_daemons{status="stopped"} 1`,
+		`daemonize_daemon_restarts_total{name="web"} 1`,
+		`daemonize_daemon_uptime_seconds{name="worker"} `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+// TestStartRelativeLogfile ensures a relative logfile is created under the workdir of the daemon.
+func TestStartRelativeLogfile(t *testing.T) {
+	s := daemonize.New()
+	workdir := t.TempDir()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "echo",
+		"command": []any{"echo", "hello"},
+		"workdir": workdir,
+		"logfile": "echo.log",
+	})
+	if result.IsError {
+		t.Fatalf("start failed: %s", text)
+	}
+	d := s.Daemons["echo"]
+	d.Wait()
+	data, err := os.ReadFile(filepath.Join(workdir, "echo.log"))
+	if err != nil {
+		t.Fatalf("logfile not under workdir: %v", err)
+	}
+	if string(data) != "hello\n" {
+		t.Errorf("logfile = %q, want %q", data, "hello\n")
+	}
+	if lines, _ := d.Logger.PeekLines(0, 10); len(lines) != 1 || lines[0] != "hello" {
+		t.Errorf("PeekLines() = %q, want [hello]", lines)
+	}
+}
+
+// TestStartLogfileOutsideWorkdir ensures a relative logfile escaping the workdir is rejected.
+func TestStartLogfileOutsideWorkdir(t *testing.T) {
+	s := daemonize.New()
+	for _, logfile := range []string{"../echo.log", "~/echo.log"} {
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":    "echo",
+			"command": []any{"echo", "hello"},
+			"workdir": t.TempDir(),
+			"logfile": logfile,
+		})
+		if !result.IsError || !strings.Contains(text, "logfile") {
+			t.Errorf("start with logfile %q = %q, want a logfile error", logfile, text)
+		}
+	}
+}
+
+// TestListForcedStop ensures a daemon ignoring SIGINT is reported as killed on stop.
+func TestListForcedStop(t *testing.T) {
+	s := daemonize.New()
+	d := daemonize.NewDaemon("stubborn", []string{"sh", "-c", "trap '' INT; echo ready; exec sleep 100"}, t.TempDir())
+	d.StopSignals = []syscall.Signal{syscall.SIGINT}
+	d.Clock = &fakeClock{fires: 1}
+	ctx := context.Background()
+	if err := s.StartDaemon(ctx, d); err != nil {
+		t.Fatalf("StartDaemon error: %v", err)
+	}
+	for i := 0; d.Logger.Lines() == 0; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for the daemon to ignore SIGINT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := d.Stop(ctx); !errors.Is(err, daemonize.ErrGracefulShutdownTimeout) {
+		t.Fatalf("Stop error = %v, want ErrGracefulShutdownTimeout", err)
+	}
+	if !d.LastStopForced() || d.LastStopSignal() != syscall.SIGKILL {
+		t.Errorf("LastStopForced() = %v, LastStopSignal() = %v, want a forced stop with SIGKILL", d.LastStopForced(), d.LastStopSignal())
+	}
+	_, text := callTool(t, s, "daemonize_list", nil)
+	if !strings.Contains(text, "killed with SIGKILL on stop") {
+		t.Errorf("daemonize_list = %q, want the forced stop", text)
+	}
+	_, text = callTool(t, s, "daemonize_list", map[string]any{"format": "json"})
+	var records []daemonize.DaemonRecord
+	if err := json.Unmarshal([]byte(text), &records); err != nil {
+		t.Fatalf("failed to decode daemonize_list: %v", err)
+	}
+	if len(records) != 1 || !records[0].StopForced || records[0].StopSignal != "SIGKILL" {
+		t.Errorf("daemonize_list records = %+v, want a forced stop with SIGKILL", records)
+	}
+}
+
+// TestStartEnvFile ensures variables of an env_file reach the daemon and inline env overrides them.
+func TestStartEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, ".env")
+	content := `# database settings
+DB_HOST=localhost
+export DB_PORT=5432 # default port
+
+GREETING="hello \"world\""
+LITERAL='$HOME stays'
+MODE=development
+`
+	if err := os.WriteFile(envFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":     "envfile",
+		"command":  []any{"sh", "-c", `echo "$DB_HOST|$DB_PORT|$GREETING|$LITERAL|$MODE"`},
+		"workdir":  dir,
+		"env_file": envFile,
+		"env":      []any{"MODE=production"},
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["envfile"]
+	_ = d.Wait()
+	lines, _ := d.Logger.PeekLines(0, 10)
+	want := `localhost|5432|hello "world"|$HOME stays|production`
+	if len(lines) != 1 || lines[0] != want {
+		t.Errorf("output = %q, want %q", lines, want)
+	}
+}
+
+// TestStartEnvFileInvalid ensures a malformed or missing env_file fails the start.
+func TestStartEnvFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envFile, []byte("OK=1\nQUOTE=\"unterminated\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := daemonize.New()
+	for file, want := range map[string]string{
+		envFile:                      ".env:2: unterminated double quote",
+		filepath.Join(dir, "absent"): "no such file",
+		"relative.env":               "env_file must be absolute",
+	} {
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":     "envfile",
+			"command":  []any{"true"},
+			"workdir":  dir,
+			"env_file": file,
+		})
+		if !result.IsError || !strings.Contains(text, want) {
+			t.Errorf("start with env_file %s = %q, want an error containing %q", file, text, want)
+		}
+	}
+}
+
+// TestPing ensures daemonize_ping reports running, stopped and unknown daemons tersely.
+func TestPing(t *testing.T) {
+	s := daemonize.New()
+	for _, c := range []struct{ name, command string }{{"running", "sleep 100"}, {"stopped", "true"}} {
+		result, text := callTool(t, s, "daemonize_start", map[string]any{
+			"name":    c.name,
+			"command": strings.Fields(c.command),
+			"workdir": t.TempDir(),
+		})
+		if result.IsError {
+			t.Fatalf("daemonize_start %s failed: %s", c.name, text)
+		}
+	}
+	t.Cleanup(func() { _ = s.Daemons["running"].Stop(context.Background()) })
+	_ = s.Daemons["stopped"].Wait()
+	for name, want := range map[string]string{"running": "running", "stopped": "stopped", "absent": "not-found"} {
+		result, text := callTool(t, s, "daemonize_ping", map[string]any{"name": name})
+		if result.IsError || text != want {
+			t.Errorf("daemonize_ping %s = %q, want %q", name, text, want)
+		}
+	}
+}
+
+// TestListCommandArgs ensures daemonize_list keeps the boundaries of arguments containing spaces.
+func TestListCommandArgs(t *testing.T) {
+	s := daemonize.New()
+	command := []string{"sh", "-c", "exec sleep 100", "arg with spaces"}
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":    "spaced",
+		"command": command,
+		"workdir": t.TempDir(),
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	t.Cleanup(func() { _ = s.Daemons["spaced"].Stop(context.Background()) })
+	_, text = callTool(t, s, "daemonize_list", map[string]any{"format": "json"})
+	var records []daemonize.DaemonRecord
+	if err := json.Unmarshal([]byte(text), &records); err != nil {
+		t.Fatalf("failed to decode daemonize_list: %v", err)
+	}
+	if len(records) != 1 || !slices.Equal(records[0].Command, command) {
+		t.Errorf("daemonize_list records = %+v, want command %q", records, command)
+	}
+	_, text = callTool(t, s, "daemonize_list", nil)
+	if want := `sh -c 'exec sleep 100' 'arg with spaces'`; !strings.Contains(text, want) {
+		t.Errorf("daemonize_list = %q, want it to contain %q", text, want)
+	}
+}
+
+// TestStartLoginShell ensures login_shell sources the profile before running command_line.
+func TestStartLoginShell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	home := t.TempDir()
+	if err := os.WriteFile(filepath.Join(home, ".bash_profile"), []byte("export FROM_PROFILE=sourced\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":         "login",
+		"command_line": `echo "profile: $FROM_PROFILE"`,
+		"login_shell":  true,
+		"workdir":      home,
+		"env":          []any{"HOME=" + home},
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["login"]
+	_ = d.Wait()
+	if last, ok := d.Logger.Last(); !ok || last.Text != "profile: sourced" {
+		t.Errorf("Last() = %q, want the variable set by the profile", last.Text)
+	}
+
+	result, text = callTool(t, s, "daemonize_start", map[string]any{
+		"name":        "argv",
+		"command":     []any{"true"},
+		"login_shell": true,
+		"workdir":     home,
+	})
+	if !result.IsError || !strings.Contains(text, "login_shell requires command_line") {
+		t.Errorf("daemonize_start with command and login_shell = %q, want an error", text)
+	}
+}
+
+// TestLogsLineNumbersAfterEviction ensures lines keep their numbers in the full history once earlier lines are evicted.
+func TestLogsLineNumbersAfterEviction(t *testing.T) {
+	d := daemonize.NewDaemon("logs", []string{"true"}, t.TempDir())
+	// The memory logger keeps 1024 lines, so the first 6 are evicted.
+	for i := range 1030 {
+		fmt.Fprintf(d.Logger, "line %d\n", i+1)
+	}
+	if got := d.Logger.FirstLineNumber(); got != 7 {
+		t.Fatalf("FirstLineNumber() = %d, want 7", got)
+	}
+	s := daemonize.New(daemonize.WithDaemon(d))
+	_, text := callTool(t, s, "daemonize_logs", map[string]any{
+		"name":   "logs",
+		"offset": 0,
+		"limit":  2,
+	})
+	if want := "Daemon logs (lines 7-8 of 1030, 6 earlier lines dropped):\n  7: line 7\n  8: line 8\n"; text != want {
+		t.Errorf("daemonize_logs window = %q, want %q", text, want)
+	}
+	_, text = callTool(t, s, "daemonize_logs", map[string]any{
+		"name":   "logs",
+		"offset": 1028,
+		"limit":  10,
+	})
+	if want := "Daemon logs (lines 1029-1030 of 1030, 6 earlier lines dropped):\n  1029: line 1029\n  1030: line 1030\n"; text != want {
+		t.Errorf("daemonize_logs window at offset 1028 = %q, want %q", text, want)
+	}
+	_, text = callTool(t, s, "daemonize_logs", map[string]any{
+		"name":    "logs",
+		"tail":    10,
+		"pattern": `^line 102[68]$`,
+	})
+	if want := "Daemon logs (6 earlier lines dropped):\n  1026: line 1026\n  1028: line 1028\n"; text != want {
+		t.Errorf("daemonize_logs tail = %q, want %q", text, want)
+	}
+}
+
+// TestStartMaxRuntime ensures a daemon is stopped once its maximum runtime elapses.
+func TestStartMaxRuntime(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":                "timeboxed",
+		"command":             []string{"sleep", "100"},
+		"workdir":             t.TempDir(),
+		"max_runtime_seconds": 0.5,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["timeboxed"]
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	if at := d.StopAt(); at.IsZero() {
+		t.Error("StopAt() is zero while running")
+	}
+	_, text = callTool(t, s, "daemonize_list", nil)
+	if !strings.Contains(text, "stopping at ") {
+		t.Errorf("daemonize_list = %q, want the time the daemon is stopped", text)
+	}
+	waitStatus(t, d, daemonize.DaemonStatusStopped)
+	if d.LastStopSignal() == 0 {
+		t.Error("daemon exited without being stopped")
+	}
+	if at := d.StopAt(); !at.IsZero() {
+		t.Errorf("StopAt() = %v after the daemon stopped, want zero", at)
+	}
+}
+
+// TestExec ensures a command run with daemonize_exec sees the workdir and environment of the daemon.
+func TestExec(t *testing.T) {
+	workdir := t.TempDir()
+	d := daemonize.NewDaemon("app", []string{"sleep", "100"}, workdir)
+	d.Env = []string{"APP_MODE=debug"}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	s := daemonize.New(daemonize.WithDaemon(d))
+	result, text := callTool(t, s, "daemonize_exec", map[string]any{
+		"name":         "app",
+		"command_line": `pwd; echo "$APP_MODE"`,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_exec error: %s", text)
+	}
+	want := "Command output:\n  1: " + workdir + "\n  2: debug\nCommand exited with code 0\n"
+	if text != want {
+		t.Errorf("daemonize_exec = %q, want %q", text, want)
+	}
+	if d.Logger.Lines() != 0 {
+		t.Errorf("daemon log has %d lines, want the output kept out of it", d.Logger.Lines())
+	}
+	result, _ = callTool(t, s, "daemonize_exec", map[string]any{"name": "absent", "command": []any{"true"}})
+	if !result.IsError {
+		t.Error("daemonize_exec of an unknown daemon succeeded")
+	}
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	result, text = callTool(t, s, "daemonize_exec", map[string]any{"name": "app", "command": []any{"true"}})
+	if !result.IsError || !strings.Contains(text, "daemon not running") {
+		t.Errorf("daemonize_exec of a stopped daemon = %q, want a not running error", text)
+	}
+}
+
+// TestLogsAll ensures daemonize_logs_all merges the lines of running daemons in the order they were written.
+func TestLogsAll(t *testing.T) {
+	s := daemonize.New()
+	if _, text := callTool(t, s, "daemonize_logs_all", nil); text != "No logs available\n" {
+		t.Errorf("daemonize_logs_all without daemons = %q", text)
+	}
+	ctx := context.Background()
+	var daemons []*daemonize.Daemon
+	for _, name := range []string{"api", "web"} {
+		d := daemonize.NewDaemon(name, []string{"sleep", "100"}, t.TempDir())
+		if err := s.StartDaemon(ctx, d); err != nil {
+			t.Fatalf("StartDaemon error: %v", err)
+		}
+		t.Cleanup(func() { _ = d.Stop(ctx) })
+		daemons = append(daemons, d)
+	}
+	api, web := daemons[0], daemons[1]
+	for _, w := range []struct {
+		d    *daemonize.Daemon
+		line string
+	}{{web, "web 1"}, {api, "api 1"}, {api, "api 2"}, {web, "web 2"}, {api, "api 3"}} {
+		fmt.Fprintln(w.d.Logger, w.line)
+		// Keep the timestamps of consecutive lines apart.
+		time.Sleep(2 * time.Millisecond)
+	}
+	_, text := callTool(t, s, "daemonize_logs_all", map[string]any{"tail": 4, "format": "json"})
+	var combined daemonize.CombinedLogs
+	if err := json.Unmarshal([]byte(text), &combined); err != nil {
+		t.Fatalf("failed to decode daemonize_logs_all: %v", err)
+	}
+	var got []string
+	for _, r := range combined.Lines {
+		got = append(got, r.Name+": "+r.Text)
+	}
+	if want := []string{"api: api 1", "api: api 2", "web: web 2", "api: api 3"}; !slices.Equal(got, want) {
+		t.Errorf("daemonize_logs_all lines = %q, want %q", got, want)
+	}
+	_, text = callTool(t, s, "daemonize_logs_all", map[string]any{"tail": 1})
+	if !strings.HasPrefix(text, "Combined logs:\n") || !strings.HasSuffix(text, " [api] api 3\n") {
+		t.Errorf("daemonize_logs_all = %q, want the last line prefixed with its daemon", text)
+	}
+	if api.Logger.Lines() != 3 {
+		t.Errorf("api log has %d lines after daemonize_logs_all, want 3", api.Logger.Lines())
+	}
+}
+
+// TestStartBackground ensures a background start returns before the daemon is ready and reports it as starting until then.
+func TestStartBackground(t *testing.T) {
+	s := daemonize.New()
+	begin := time.Now()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":         "slow",
+		"command_line": "sleep 0.5; echo ready; exec sleep 100",
+		"workdir":      t.TempDir(),
+		"ready_log":    "^ready$",
+		"background":   true,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	if elapsed := time.Since(begin); elapsed > 300*time.Millisecond {
+		t.Errorf("daemonize_start took %s, want it to return before readiness", elapsed)
+	}
+	d := s.Daemons["slow"]
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	if _, text := callTool(t, s, "daemonize_ping", map[string]any{"name": "slow"}); text != "running" {
+		t.Errorf("daemonize_ping = %q right after a background start, want running", text)
+	}
+	if status, _ := d.Status(); status != daemonize.DaemonStatusStarting {
+		t.Errorf("Status() = %q right after a background start, want %q", status, daemonize.DaemonStatusStarting)
+	}
+	waitStatus(t, d, daemonize.DaemonStatusRunning)
+}
+
+// TestStartBackgroundFailureClosesLogfile ensures the logfile of a daemon whose background start fails is closed.
+func TestStartBackgroundFailureClosesLogfile(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":                  "unready",
+		"command":               []string{"sleep", "100"},
+		"workdir":               t.TempDir(),
+		"logfile":               filepath.Join(t.TempDir(), "unready.log"),
+		"ready_log":             "^never$",
+		"ready_timeout_seconds": 0.1,
+		"background":            true,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["unready"]
+	waitPending(t, d)
+	if _, err := d.Logger.Write([]byte("late\n")); err == nil {
+		t.Error("logfile still writable after the background start failed")
+	}
+}
+
+// slowDependency returns a daemon that becomes ready after half a second,
+// which keeps the background start of a daemon depending on it pending.
+func slowDependency(t *testing.T) *daemonize.Daemon {
+	dep := daemonize.NewDaemon("dep", []string{"sh", "-c", "sleep 0.5; echo ready; exec sleep 100"}, t.TempDir())
+	dep.ReadyLog = regexp.MustCompile("^ready$")
+	t.Cleanup(func() { _ = dep.Stop(context.Background()) })
+	return dep
+}
+
+// TestStopPendingBackgroundStart ensures stopping a daemon whose background start is pending keeps it from being launched.
+func TestStopPendingBackgroundStart(t *testing.T) {
+	s := daemonize.New(daemonize.WithDaemon(slowDependency(t)))
+	d := daemonize.NewDaemon("main", []string{"sleep", "100"}, t.TempDir())
+	d.DependsOn = []string{"dep"}
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	s.StartDaemonBackground(context.Background(), d)
+	if err := d.Start(context.Background()); !errors.Is(err, daemonize.ErrDaemonAlreadyRunning) {
+		t.Errorf("Start error = %v while a background start is pending, want ErrDaemonAlreadyRunning", err)
+	}
+	if err := s.StopDaemon(context.Background(), "main"); err != nil {
+		t.Fatalf("StopDaemon error: %v", err)
+	}
+	if _, text := callTool(t, s, "daemonize_ping", map[string]any{"name": "main"}); text != "not-found" {
+		t.Errorf("daemonize_ping = %q after StopDaemon, want not-found", text)
+	}
+	waitPending(t, d)
+	if !d.StartedAt().IsZero() {
+		t.Error("daemon launched after its pending start was stopped")
+	}
+	if err := d.Failure(); err != nil {
+		t.Errorf("Failure() = %v, want none for a cancelled start", err)
+	}
+}
+
+// TestShutdownCancelsBackgroundStart ensures Shutdown keeps a daemon whose background start is pending from being launched.
+func TestShutdownCancelsBackgroundStart(t *testing.T) {
+	s := daemonize.New(daemonize.WithDaemon(slowDependency(t)))
+	d := daemonize.NewDaemon("main", []string{"sleep", "100"}, t.TempDir())
+	d.DependsOn = []string{"dep"}
+	t.Cleanup(func() { _ = d.Stop(context.Background()) })
+	s.StartDaemonBackground(context.Background(), d)
+	s.Shutdown(context.Background())
+	waitPending(t, d)
+	if !d.StartedAt().IsZero() {
+		t.Error("daemon launched after Shutdown")
+	}
+}
+
+// TestStartBackgroundFailure ensures a daemon whose background start fails stays listed with the reason.
+func TestStartBackgroundFailure(t *testing.T) {
+	s := daemonize.New()
+	result, text := callTool(t, s, "daemonize_start", map[string]any{
+		"name":                  "unready",
+		"command":               []string{"sleep", "100"},
+		"workdir":               t.TempDir(),
+		"ready_log":             "^never$",
+		"ready_timeout_seconds": 0.1,
+		"background":            true,
+	})
+	if result.IsError {
+		t.Fatalf("daemonize_start failed: %s", text)
+	}
+	d := s.Daemons["unready"]
+	waitPending(t, d)
+	var startErr *daemonize.StartError
+	if err := d.Failure(); !errors.As(err, &startErr) || !errors.Is(err, daemonize.ErrReadyTimeout) {
+		t.Errorf("Failure() = %v, want a StartError wrapping ErrReadyTimeout", err)
+	}
+	_, text = callTool(t, s, "daemonize_list", nil)
+	if !strings.Contains(text, "start failed: ") {
+		t.Errorf("daemonize_list = %q, want the start failure", text)
+	}
+}
@@ -0,0 +1,122 @@
+package daemonize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// startOrder sorts daemons so that every daemon comes after the daemons it
+// depends on. Daemons with an unknown dependency, a dependency that cannot be
+// ordered or in a dependency cycle are left out and reported in problems.
+func startOrder(daemons []*Daemon) (ordered []*Daemon, problems map[string]error) {
+	byName := make(map[string]*Daemon, len(daemons))
+	for _, d := range daemons {
+		byName[d.Name] = d
+	}
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int, len(daemons))
+	problems = make(map[string]error)
+	var visit func(d *Daemon) error
+	visit = func(d *Daemon) error {
+		switch state[d.Name] {
+		case visiting:
+			return fmt.Errorf("%w through %s", ErrDependencyCycle, d.Name)
+		case visited:
+			return problems[d.Name]
+		}
+		state[d.Name] = visiting
+		var err error
+		for _, name := range d.DependsOn {
+			dep, ok := byName[name]
+			if !ok {
+				err = fmt.Errorf("dependency %s is not a known daemon", name)
+				break
+			}
+			if derr := visit(dep); derr != nil {
+				err = derr
+				if !errors.Is(derr, ErrDependencyCycle) {
+					err = fmt.Errorf("dependency %s cannot be started", name)
+				}
+				break
+			}
+		}
+		state[d.Name] = visited
+		if err != nil {
+			problems[d.Name] = err
+			return err
+		}
+		ordered = append(ordered, d)
+		return nil
+	}
+	for _, d := range daemons {
+		_ = visit(d)
+	}
+	return ordered, problems
+}
+
+// startDependencies makes sure the daemons d depends on, directly or through
+// other dependencies, are running. Registered but stopped ones are started
+// after their own dependencies, in the order of startOrder, so that a
+// dependency cycle is rejected rather than followed.
+func (s *Server) startDependencies(ctx context.Context, d *Daemon) error {
+	daemons := []*Daemon{d}
+	for _, other := range s.daemons() {
+		if other.Name != d.Name {
+			daemons = append(daemons, other)
+		}
+	}
+	ordered, problems := startOrder(daemons)
+	if err := problems[d.Name]; err != nil {
+		return err
+	}
+	needed := dependencies(d, daemons)
+	for _, dep := range ordered {
+		if !needed[dep.Name] {
+			continue
+		}
+		status, err := dep.Status()
+		if err != nil {
+			return fmt.Errorf("dependency %s: %w", dep.Name, err)
+		}
+		if status.active() {
+			continue
+		}
+		next := dep.clone()
+		if err := next.Start(ctx); err != nil {
+			return fmt.Errorf("dependency %s could not be started: %w", dep.Name, err)
+		}
+		s.notifyStarted(next)
+		s.addDaemon(next)
+	}
+	return nil
+}
+
+// dependencies returns the names of the daemons among daemons that d depends
+// on, directly or through other dependencies.
+func dependencies(d *Daemon, daemons []*Daemon) map[string]bool {
+	byName := make(map[string]*Daemon, len(daemons))
+	for _, other := range daemons {
+		byName[other.Name] = other
+	}
+	needed := make(map[string]bool)
+	queue := slices.Clone(d.DependsOn)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if needed[name] {
+			continue
+		}
+		needed[name] = true
+		if dep, ok := byName[name]; ok {
+			queue = append(queue, dep.DependsOn...)
+		}
+	}
+	return needed
+}
@@ -0,0 +1,106 @@
+package daemonize
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// outputPollInterval is how often the output file of a detached daemon is
+// checked for new output.
+const outputPollInterval = 50 * time.Millisecond
+
+// outputFile is a file a detached daemon writes one of its streams to. The
+// server copies what is written to the log while it runs.
+type outputFile struct {
+	// w is handed to the daemon and closed in the server once it is launched.
+	w   *os.File
+	r   *os.File
+	dst io.Writer
+}
+
+// newOutputFile creates an output file for a stream of the named daemon in
+// the temporary directory, whose content is copied to dst.
+func newOutputFile(name string, dst io.Writer) (*outputFile, error) {
+	w, err := os.CreateTemp("", "mcp-daemonize-"+name+"-*.log")
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+	return &outputFile{w: w, r: r, dst: dst}, nil
+}
+
+// discard closes and removes an output file the daemon was not launched with.
+func (o *outputFile) discard() {
+	o.w.Close()
+	o.r.Close()
+	os.Remove(o.r.Name())
+}
+
+// follow copies the output to dst as it is written until exited is closed,
+// then copies the rest and removes the file, as its content is in the log by
+// then. The file is only left behind when the server exits first.
+func (o *outputFile) follow(exited <-chan struct{}) {
+	defer os.Remove(o.r.Name())
+	defer o.r.Close()
+	for {
+		if _, err := io.Copy(o.dst, o.r); err != nil {
+			slog.Debug("failed to read output file of detached daemon", slog.String("path", o.r.Name()), slog.Any("error", err))
+		}
+		select {
+		case <-exited:
+			// Copy what was written between the last copy and the exit.
+			_, _ = io.Copy(o.dst, o.r)
+			return
+		case <-time.After(outputPollInterval):
+		}
+	}
+}
+
+// outputFiles sets up cmd to write the streams of a detached daemon to output
+// files rather than pipes. A pipe breaks once the server exits, so that the
+// daemon would get SIGPIPE on its next write, while a file stays writable.
+// The streams are copied to stdout and stderr while the server runs.
+func (d *Daemon) outputFiles(cmd *exec.Cmd, stdout, stderr io.Writer) ([]*outputFile, error) {
+	out, err := newOutputFile(d.Name, stdout)
+	if err != nil {
+		return nil, err
+	}
+	// One file for both streams keeps the order they were written in.
+	cmd.Stdout, cmd.Stderr = out.w, out.w
+	if !d.TagStderr {
+		return []*outputFile{out}, nil
+	}
+	errOut, err := newOutputFile(d.Name, stderr)
+	if err != nil {
+		out.discard()
+		return nil, err
+	}
+	cmd.Stderr = errOut.w
+	return []*outputFile{out, errOut}, nil
+}
+
+// followOutputFiles starts copying the output files of a launched daemon to
+// its log. The returned WaitGroup is done once they are copied in full after
+// exited is closed.
+func followOutputFiles(files []*outputFile, exited <-chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, o := range files {
+		// The daemon holds its own copy of the descriptor.
+		o.w.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.follow(exited)
+		}()
+	}
+	return &wg
+}
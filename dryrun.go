@@ -0,0 +1,124 @@
+package daemonize
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// DryRun validates the daemon as Start would and resolves its executable in
+// the working directory and environment it would run with. It returns the
+// executable path and the environment without launching anything.
+func (d *Daemon) DryRun() (executable string, env []string, err error) {
+	if d.Nice < MinNice || d.Nice > MaxNice {
+		return "", nil, ErrInvalidNice
+	}
+	if d.Umask != "" && !validUmask(d.Umask) {
+		return "", nil, ErrInvalidUmask
+	}
+	if d.CPUs != "" {
+		if _, err := parseCPUList(d.CPUs); err != nil {
+			return "", nil, err
+		}
+	}
+	if _, err := d.credential(); err != nil {
+		return "", nil, err
+	}
+	if err := checkWorkdir(d.Workdir); err != nil {
+		return "", nil, err
+	}
+	env = d.environ()
+	executable, err = lookPath(d.Commands[0], d.Workdir, env)
+	if err != nil {
+		return "", nil, err
+	}
+	return executable, env, nil
+}
+
+// checkWorkdir reports an error if dir is not an existing directory.
+func checkWorkdir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("workdir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("workdir %s is not a directory", dir)
+	}
+	return nil
+}
+
+// environ is the environment the daemon is started with: that of the server
+// without its notify socket, overridden by Env.
+func (d *Daemon) environ() []string {
+	return append(withoutNotifySocket(os.Environ()), d.Env...)
+}
+
+// lookPath finds file as a process started in dir with env would. Unlike
+// exec.LookPath, it searches the PATH of env and resolves relative paths
+// against dir.
+func lookPath(file, dir string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		path := file
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if err := checkExecutable(path); err != nil {
+			return "", fmt.Errorf("%s: %w", file, err)
+		}
+		return path, nil
+	}
+	var pathEnv string
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			pathEnv = v
+		}
+	}
+	for _, p := range filepath.SplitList(pathEnv) {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		path := filepath.Join(p, file)
+		if checkExecutable(path) == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", file, exec.ErrNotFound)
+}
+
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0o111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+// dryRunStart reports what daemonize_start would run for d.
+func (s *Server) dryRunStart(d *Daemon) *mcp.CallToolResult {
+	for _, name := range d.DependsOn {
+		if _, ok := s.daemon(name); !ok {
+			return mcp.NewToolResultError(fmt.Sprintf("dry run of daemon %s failed: dependency %s is not a known daemon", d.Name, name))
+		}
+	}
+	executable, env, err := d.DryRun()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("dry run of daemon %s failed: %v", d.Name, err))
+	}
+	result := &strings.Builder{}
+	fmt.Fprintf(result, "Dry run of daemon %s succeeded; nothing was started.\n", d.Name)
+	fmt.Fprintf(result, "Executable: %s\n", executable)
+	fmt.Fprintf(result, "Workdir: %s\n", d.Workdir)
+	result.WriteString("Environment:\n")
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		fmt.Fprintf(result, "  %s=%s\n", key, redactEnv(key, value))
+	}
+	return mcp.NewToolResultText(result.String())
+}
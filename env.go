@@ -0,0 +1,86 @@
+package daemonize
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type EnvChangeKind string
+
+const (
+	EnvAdded   EnvChangeKind = "added"
+	EnvRemoved EnvChangeKind = "removed"
+	EnvChanged EnvChangeKind = "changed"
+)
+
+// EnvChange is a variable that differs between the environment a daemon was
+// launched with and the environment of its process.
+type EnvChange struct {
+	Key        string
+	Kind       EnvChangeKind
+	Configured string
+	Actual     string
+}
+
+// EnvDiff compares the environment the daemon was launched with against the
+// actual environment of its process, ordered by key. Values of sensitive
+// variables are redacted. Only supported on Linux.
+func (d *Daemon) EnvDiff() ([]EnvChange, error) {
+	pid := d.PID()
+	if pid == -1 {
+		return nil, ErrDaemonNotRunning
+	}
+	actual, err := processEnviron(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment of daemon %s: %w", d.Name, err)
+	}
+	d.stateMu.Lock()
+	configured := envMap(d.env)
+	d.stateMu.Unlock()
+	return diffEnv(configured, envMap(actual)), nil
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func diffEnv(configured, actual map[string]string) []EnvChange {
+	var changes []EnvChange
+	for k, v := range configured {
+		a, ok := actual[k]
+		switch {
+		case !ok:
+			changes = append(changes, EnvChange{Key: k, Kind: EnvRemoved, Configured: redactEnv(k, v)})
+		case a != v:
+			changes = append(changes, EnvChange{Key: k, Kind: EnvChanged, Configured: redactEnv(k, v), Actual: redactEnv(k, a)})
+		}
+	}
+	for k, a := range actual {
+		if _, ok := configured[k]; !ok {
+			changes = append(changes, EnvChange{Key: k, Kind: EnvAdded, Actual: redactEnv(k, a)})
+		}
+	}
+	slices.SortFunc(changes, func(a, b EnvChange) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return changes
+}
+
+// sensitiveEnvWords mark variables whose values must not be shown.
+var sensitiveEnvWords = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+func redactEnv(key, value string) string {
+	upper := strings.ToUpper(key)
+	for _, w := range sensitiveEnvWords {
+		if strings.Contains(upper, w) {
+			return "[redacted]"
+		}
+	}
+	return value
+}
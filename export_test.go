@@ -0,0 +1,26 @@
+package daemonize
+
+import "syscall"
+
+// SetGetpgid replaces the lookup of process groups until the returned
+// function is called.
+func SetGetpgid(f func(pid int) (int, error)) (restore func()) {
+	prev := getpgid
+	getpgid = f
+	return func() { getpgid = prev }
+}
+
+// SetKill replaces the sending of signals until the returned function is
+// called.
+func SetKill(f func(pid int, sig syscall.Signal) error) (restore func()) {
+	prev := kill
+	kill = f
+	return func() { kill = prev }
+}
+
+var ParseCPUList = parseCPUList
+
+// Pending reports whether a background start of d has not finished.
+func (d *Daemon) Pending() bool {
+	return d.pending.Load()
+}
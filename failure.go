@@ -0,0 +1,75 @@
+package daemonize
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SpawnError is the failure of a daemon whose program could not be
+// executed, e.g. because the binary is missing or not executable.
+type SpawnError struct {
+	Err error
+}
+
+func (e *SpawnError) Error() string { return e.Err.Error() }
+func (e *SpawnError) Unwrap() error { return e.Err }
+
+// ExitError is the failure of a daemon whose program ran and then exited
+// with a non-zero code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// StartError is the failure of a daemon started in the background whose start
+// failed for another reason than a spawn error or an exit, e.g. because it
+// did not become ready in time.
+type StartError struct {
+	Err error
+}
+
+func (e *StartError) Error() string { return e.Err.Error() }
+func (e *StartError) Unwrap() error { return e.Err }
+
+// Failure returns why the daemon failed: a *SpawnError if its program could
+// not be executed, an *ExitError if it exited with a non-zero code, a
+// *StartError if its background start failed otherwise, or nil.
+func (d *Daemon) Failure() error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.failure
+}
+
+// spawnFailed records err as a SpawnError and returns the error of Start.
+func (d *Daemon) spawnFailed(err error) error {
+	failure := &SpawnError{Err: err}
+	d.setFailure(failure)
+	return fmt.Errorf("failed to start daemon %s: %w", d.Name, failure)
+}
+
+func (d *Daemon) setFailure(err error) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	d.failure = err
+}
+
+// describeFailure tells apart a program that could not be executed from one
+// that ran and exited with a non-zero code, for daemonize_list.
+func describeFailure(err error) string {
+	var spawnErr *SpawnError
+	var exitErr *ExitError
+	var startErr *StartError
+	switch {
+	case errors.As(err, &spawnErr):
+		return "spawn failed: " + spawnErr.Error()
+	case errors.As(err, &exitErr):
+		return fmt.Sprintf("exited with code %d", exitErr.Code)
+	case errors.As(err, &startErr):
+		return "start failed: " + startErr.Error()
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,748 @@
+package daemonize
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FileLoggerOption func(*fileLogger)
+
+// WithRotateBytes starts a new log file once the current one holds at least
+// n bytes. The full file is renamed to path.1, shifting older segments to
+// path.2 and so on. Zero or a negative n never rotates, which is the default.
+func WithRotateBytes(n int64) FileLoggerOption {
+	return func(l *fileLogger) {
+		l.rotateBytes = n
+	}
+}
+
+// WithMaxSegments keeps at most n rotated segments, deleting the oldest
+// ones on rotation. Zero or a negative n keeps every segment, which is the
+// default.
+func WithMaxSegments(n int) FileLoggerOption {
+	return func(l *fileLogger) {
+		l.maxSegments = n
+	}
+}
+
+// WithCompression gzips rotated segments to path.N.gz. Reads decompress them
+// transparently.
+func WithCompression(compress bool) FileLoggerOption {
+	return func(l *fileLogger) {
+		l.compress = compress
+	}
+}
+
+// NewFileLogger returns a Logger that appends to the file at path, keeping
+// any lines and rotated segments already there. Lines read by ReadLine are
+// only hidden from later reads; reading never modifies the files.
+func NewFileLogger(path string, opts ...FileLoggerOption) (Logger, error) {
+	l := &fileLogger{path: path}
+	for _, opt := range opts {
+		opt(l)
+	}
+	for i := 1; ; i++ {
+		name := segmentName(path, i)
+		if _, err := os.Stat(name); err != nil {
+			name += ".gz"
+			if _, err := os.Stat(name); err != nil {
+				break
+			}
+		}
+		seg, err := countSegment(name)
+		if err != nil {
+			return nil, err
+		}
+		// Segments are kept oldest first.
+		l.segments = append([]segment{seg}, l.segments...)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	if l.active, err = countSegment(path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// segment is a log file with the size and newline count of its
+// uncompressed content.
+type segment struct {
+	name     string
+	size     int64
+	newlines int64
+	// last is the last byte of the content, if any.
+	last byte
+}
+
+func segmentName(path string, i int) string {
+	return path + "." + strconv.Itoa(i)
+}
+
+func countSegment(name string) (segment, error) {
+	seg := segment{name: name}
+	r, err := openSegment(name)
+	if err != nil {
+		return seg, err
+	}
+	defer r.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		seg.count(buf[:n])
+		if err == io.EOF {
+			return seg, nil
+		}
+		if err != nil {
+			return seg, err
+		}
+	}
+}
+
+func (s *segment) count(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	s.size += int64(len(p))
+	s.newlines += int64(bytes.Count(p, []byte{'\n'}))
+	s.last = p[len(p)-1]
+}
+
+// openSegment opens a segment for reading, decompressing a .gz one.
+func openSegment(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+type fileLogger struct {
+	mu          sync.Mutex
+	path        string
+	rotateBytes int64
+	maxSegments int
+	compress    bool
+	file        *os.File
+	// segments are the rotated segments, oldest first, and active is the
+	// file being written.
+	segments    []segment
+	active      segment
+	pending     string
+	lastWrite   time.Time
+	subscribers map[chan string]struct{}
+	// dropped counts the lines deleted with the oldest segments.
+	dropped int64
+	// history gives the offsets of the stored bytes for ReadBytes and the
+	// numbers of the stored lines since the log was opened.
+	history history
+	// hidden are the ranges consumed by ReadLine, oldest first.
+	hidden []hiddenRange
+	// last caches the text of the last line while lastKnown is set, so that
+	// Last does not read and decompress the segments every time.
+	last      string
+	lastKnown bool
+}
+
+var errLoggerClosed = errors.New("logger closed")
+
+func (l *fileLogger) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return 0, errLoggerClosed
+	}
+	open := l.endsOpen()
+	n, err := l.file.Write(p)
+	l.active.count(p[:n])
+	l.lastWrite = time.Now()
+	for s := string(p[:n]); s != ""; {
+		line, rest, terminated := strings.Cut(s, "\n")
+		s = rest
+		if l.lastKnown {
+			if open {
+				l.last += line
+			} else {
+				l.last = line
+			}
+			open = !terminated
+		}
+		if !terminated {
+			l.pending += line
+			break
+		}
+		l.publish(l.pending + line)
+		l.pending = ""
+	}
+	if err != nil {
+		return n, err
+	}
+	if l.rotateBytes > 0 && l.active.size >= l.rotateBytes {
+		if err := l.rotate(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// rotate renames the active file to path.1, shifting the older segments,
+// and starts a new active file. When that fails, the file at path is opened
+// again, so that the log keeps being written.
+func (l *fileLogger) rotate() error {
+	err := l.file.Close()
+	l.file = nil
+	if err == nil {
+		err = l.shift()
+	}
+	f, oerr := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if oerr != nil {
+		return errors.Join(err, oerr)
+	}
+	l.file = f
+	return err
+}
+
+// shift moves the active file to the rotated segments, deleting the oldest
+// ones beyond maxSegments.
+func (l *fileLogger) shift() error {
+	if l.maxSegments > 0 {
+		// Make room for the segment being rotated.
+		for len(l.segments) >= l.maxSegments {
+			n, newlines, err := l.unhide()
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(l.segments[0].name); err != nil {
+				return err
+			}
+			// A line continued in the next segment stays, without its head.
+			l.dropped += l.segments[0].newlines - newlines
+			l.history.removed(l.segments[0].size-n, l.segments[0].newlines-newlines)
+			l.segments = l.segments[1:]
+		}
+	}
+	// Rename the oldest segment first so that no name is overwritten.
+	for i, seg := range l.segments {
+		name := segmentName(l.path, len(l.segments)-i+1)
+		if strings.HasSuffix(seg.name, ".gz") {
+			name += ".gz"
+		}
+		if err := os.Rename(seg.name, name); err != nil {
+			return err
+		}
+		l.segments[i].name = name
+	}
+	rotated := l.active
+	rotated.name = segmentName(l.path, 1)
+	if err := os.Rename(l.path, rotated.name); err != nil {
+		return err
+	}
+	l.segments = append(l.segments, rotated)
+	l.active = segment{name: l.path}
+	if l.compress {
+		// A segment that fails to compress is kept as it is.
+		if err := gzipFile(rotated.name); err != nil {
+			return err
+		}
+		l.segments[len(l.segments)-1].name += ".gz"
+	}
+	return nil
+}
+
+// gzipFile compresses name to name.gz and removes name. On failure, name is
+// left in place and a partial name.gz is removed.
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (l *fileLogger) publish(line string) {
+	for ch := range l.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// all returns the rotated segments and the active file, oldest first.
+func (l *fileLogger) all() []segment {
+	return append(append([]segment(nil), l.segments...), l.active)
+}
+
+// lines returns the number of lines across all segments, without the
+// hidden ones. A last line without a newline counts as a line.
+func (l *fileLogger) lines() int64 {
+	var n int64
+	for _, seg := range l.all() {
+		n += seg.newlines
+	}
+	for _, h := range l.hidden {
+		n -= h.newlines
+	}
+	if l.endsOpen() {
+		n++
+	}
+	return n
+}
+
+// endsOpen reports whether the log ends with a line without a newline.
+func (l *fileLogger) endsOpen() bool {
+	if n := len(l.hidden); n > 0 && l.hidden[n-1].pos+l.hidden[n-1].size == l.stored() {
+		// The hidden range starts a line.
+		return false
+	}
+	var last byte
+	for _, seg := range l.all() {
+		if seg.size > 0 {
+			last = seg.last
+		}
+	}
+	return last != 0 && last != '\n'
+}
+
+// reader returns the whole log as one stream, oldest segment first and
+// without the hidden ranges, and a function that closes the segments.
+func (l *fileLogger) reader() (io.Reader, func(), error) {
+	var readers []io.Reader
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	for _, seg := range l.all() {
+		if seg.size == 0 {
+			continue
+		}
+		r, err := openSegment(seg.name)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		readers = append(readers, io.LimitReader(r, seg.size))
+		closers = append(closers, r)
+	}
+	r := &visibleReader{r: io.MultiReader(readers...), hidden: l.hidden}
+	return r, closeAll, nil
+}
+
+// scan calls f with every line from line offset on and the byte position
+// where the line starts, until f returns false. Lines may continue across
+// segments.
+func (l *fileLogger) scan(offset int64, f func(pos int64, line string) bool) error {
+	r, closeAll, err := l.reader()
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+	br := bufio.NewReader(r)
+	var pos, i int64
+	for {
+		s, err := br.ReadString('\n')
+		if s != "" {
+			if i >= offset && !f(pos, strings.TrimSuffix(s, "\n")) {
+				return nil
+			}
+			i++
+			pos += int64(len(s))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (l *fileLogger) ReadLine(offset int64) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset < 0 || offset >= l.lines() {
+		return nil, io.EOF
+	}
+	lines, err := l.consume(offset)
+	if err != nil {
+		return nil, err
+	}
+	return lineTexts(lines), nil
+}
+
+func (l *fileLogger) ReadNumbered(from int64) ([]NumberedLine, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offset := l.history.index(from, l.lines())
+	if offset >= l.lines() {
+		return nil, io.EOF
+	}
+	return l.consume(offset)
+}
+
+// consume returns the lines from line offset on with their numbers and
+// hides them from later reads. The files keep them.
+func (l *fileLogger) consume(offset int64) ([]NumberedLine, error) {
+	var lines []NumberedLine
+	cut := int64(-1)
+	err := l.scan(offset, func(pos int64, line string) bool {
+		if cut < 0 {
+			cut = pos
+		}
+		lines = append(lines, NumberedLine{Number: l.history.number(offset + int64(len(lines))), Text: line})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	size, stored := l.size(), l.lines()
+	newlines := stored - offset
+	if l.endsOpen() {
+		newlines--
+	}
+	l.hide(cut, newlines)
+	l.pending = ""
+	l.lastKnown = false
+	l.history.consumed(cut, size-cut, offset, stored-offset)
+	return lines, nil
+}
+
+// hiddenRange is a range of the files, in positions across all segments,
+// that was consumed by ReadLine and that reads skip.
+type hiddenRange struct {
+	pos, size, newlines int64
+}
+
+// hide hides the files from the read position pos on, which is the start
+// of a line, through their end. newlines counts the newlines read there.
+func (l *fileLogger) hide(pos, newlines int64) {
+	// Map pos past the ranges hidden before it.
+	i := 0
+	for ; i < len(l.hidden) && l.hidden[i].pos <= pos; i++ {
+		pos += l.hidden[i].size
+	}
+	// The ranges after pos are merged into the new one.
+	for _, h := range l.hidden[i:] {
+		newlines += h.newlines
+	}
+	l.hidden = append(l.hidden[:i], hiddenRange{pos: pos, size: l.stored() - pos, newlines: newlines})
+}
+
+// unhide drops the hidden ranges within the oldest segment, which is about
+// to be deleted, and returns the bytes and newlines they hid there.
+func (l *fileLogger) unhide() (n, newlines int64, err error) {
+	seg := l.segments[0]
+	var kept []hiddenRange
+	for _, h := range l.hidden {
+		switch {
+		case h.pos >= seg.size:
+			h.pos -= seg.size
+			kept = append(kept, h)
+		case h.pos+h.size <= seg.size:
+			n += h.size
+			newlines += h.newlines
+		default:
+			// The range continues in the next segment.
+			head, err := countRange(seg.name, h.pos, seg.size-h.pos)
+			if err != nil {
+				return 0, 0, err
+			}
+			n += seg.size - h.pos
+			newlines += head
+			kept = append(kept, hiddenRange{size: h.pos + h.size - seg.size, newlines: h.newlines - head})
+		}
+	}
+	l.hidden = kept
+	return n, newlines, nil
+}
+
+// countRange returns the newlines in n bytes from position pos of the
+// uncompressed content of a segment.
+func countRange(name string, pos, n int64) (int64, error) {
+	r, err := openSegment(name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if _, err := io.CopyN(io.Discard, r, pos); err != nil {
+		return 0, err
+	}
+	seg := segment{name: name}
+	buf := make([]byte, 32*1024)
+	lr := io.LimitReader(r, n)
+	for {
+		m, err := lr.Read(buf)
+		seg.count(buf[:m])
+		if err == io.EOF {
+			return seg.newlines, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// visibleReader reads r without the hidden ranges, which are given in
+// positions of r.
+type visibleReader struct {
+	r      io.Reader
+	pos    int64
+	hidden []hiddenRange
+}
+
+func (v *visibleReader) Read(p []byte) (int, error) {
+	for len(v.hidden) > 0 && v.pos >= v.hidden[0].pos {
+		if end := v.hidden[0].pos + v.hidden[0].size; v.pos < end {
+			n, err := io.CopyN(io.Discard, v.r, end-v.pos)
+			v.pos += n
+			if err != nil {
+				return 0, err
+			}
+		}
+		v.hidden = v.hidden[1:]
+	}
+	if len(v.hidden) > 0 {
+		p = p[:min(int64(len(p)), v.hidden[0].pos-v.pos)]
+	}
+	n, err := v.r.Read(p)
+	v.pos += int64(n)
+	return n, err
+}
+
+func (l *fileLogger) PeekLines(offset, limit int64) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset < 0 || offset >= l.lines() {
+		return nil, io.EOF
+	}
+	lines, err := l.peek(offset, limit)
+	return lineTexts(lines), err
+}
+
+func (l *fileLogger) PeekNumbered(from, limit int64) ([]NumberedLine, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offset := l.history.index(from, l.lines())
+	if offset >= l.lines() {
+		return nil, io.EOF
+	}
+	return l.peek(offset, limit)
+}
+
+// peek returns up to limit lines from line offset on with their numbers.
+func (l *fileLogger) peek(offset, limit int64) ([]NumberedLine, error) {
+	var lines []NumberedLine
+	err := l.scan(offset, func(_ int64, line string) bool {
+		if int64(len(lines)) >= limit {
+			return false
+		}
+		lines = append(lines, NumberedLine{Number: l.history.number(offset + int64(len(lines))), Text: line})
+		return true
+	})
+	return lines, err
+}
+
+func (l *fileLogger) Snapshot() ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ss := make([]string, 0, l.lines())
+	err := l.scan(0, func(_ int64, line string) bool {
+		ss = append(ss, line)
+		return true
+	})
+	return ss, err
+}
+
+func (l *fileLogger) ReadBytes(offset, n int64) ([]byte, int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset < 0 {
+		return nil, 0, io.EOF
+	}
+	pos, start := l.history.position(offset)
+	if pos >= l.size() {
+		return nil, 0, io.EOF
+	}
+	n = max(0, n)
+	if c := l.history.contiguous(pos); c >= 0 {
+		n = min(n, c)
+	}
+	r, closeAll, err := l.reader()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeAll()
+	if _, err := io.CopyN(io.Discard, r, pos); err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, n))
+	return data, start, err
+}
+
+// size returns the bytes stored across all segments, without the hidden
+// ones.
+func (l *fileLogger) size() int64 {
+	n := l.stored()
+	for _, h := range l.hidden {
+		n -= h.size
+	}
+	return n
+}
+
+// stored returns the bytes stored across all segments.
+func (l *fileLogger) stored() int64 {
+	var n int64
+	for _, seg := range l.all() {
+		n += seg.size
+	}
+	return n
+}
+
+func (l *fileLogger) Lines() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lines()
+}
+
+func (l *fileLogger) FirstLineNumber() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.history.number(0)
+}
+
+func (l *fileLogger) LastLineNumber() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.history.number(l.lines()) - 1
+}
+
+// Dropped returns the number of lines deleted with the oldest segments when
+// the maximum number of segments was exceeded.
+func (l *fileLogger) Dropped() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+func (l *fileLogger) Last() (LogLine, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.lines()
+	if n == 0 {
+		return LogLine{}, false
+	}
+	if !l.lastKnown {
+		if err := l.scan(n-1, func(_ int64, line string) bool {
+			l.last = line
+			return false
+		}); err != nil {
+			return LogLine{}, false
+		}
+		l.lastKnown = true
+	}
+	last := LogLine{Text: l.last}
+	last.Time = l.lastWrite
+	if last.Time.IsZero() {
+		// Written before the logger was opened.
+		if info, err := os.Stat(l.path); err == nil {
+			last.Time = info.ModTime()
+		}
+	}
+	return last, true
+}
+
+func (l *fileLogger) Clear() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.history.removed(l.size(), l.lines())
+	for _, seg := range l.segments {
+		if err := os.Remove(seg.name); err != nil {
+			return err
+		}
+	}
+	l.segments = nil
+	l.hidden = nil
+	l.pending = ""
+	l.lastKnown = false
+	l.active = segment{name: l.path}
+	if l.file == nil {
+		return os.Truncate(l.path, 0)
+	}
+	return l.file.Truncate(0)
+}
+
+func (l *fileLogger) Subscribe() (<-chan string, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := make(chan string, subscriberBuffer)
+	if l.subscribers == nil {
+		l.subscribers = make(map[chan string]struct{})
+	}
+	l.subscribers[ch] = struct{}{}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.subscribers, ch)
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// Close closes the log file. The lines stay on disk.
+func (l *fileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,53 @@
+package daemonize
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+type OutputFormat string
+
+const (
+	OutputFormatText OutputFormat = "text"
+	OutputFormatJSON OutputFormat = "json"
+)
+
+// DaemonRecord is a daemon as reported by daemonize_list in JSON format.
+type DaemonRecord struct {
+	Name        string       `json:"name"`
+	Command     []string     `json:"command"`
+	Executable  string       `json:"executable,omitempty"`
+	Workdir     string       `json:"workdir"`
+	Status      DaemonStatus `json:"status"`
+	PID         int          `json:"pid,omitempty"`
+	Health      HealthStatus `json:"health,omitempty"`
+	HealthError string       `json:"health_error,omitempty"`
+	Detached    bool         `json:"detached,omitempty"`
+	Restarts    int          `json:"restarts,omitempty"`
+	Failure     string       `json:"failure,omitempty"`
+	StopSignal  string       `json:"stop_signal,omitempty"`
+	StopForced  bool         `json:"stop_forced,omitempty"`
+	NextRestart time.Time    `json:"next_restart,omitzero"`
+	StopAt      time.Time    `json:"stop_at,omitzero"`
+	LastLog     *LogRecord   `json:"last_log,omitempty"`
+	LogBytes    int64        `json:"log_bytes,omitempty"`
+	LogError    string       `json:"log_error,omitempty"`
+}
+
+// LogRecord is a log line as reported in JSON format. Line is the 1-based
+// position in the log and Time is set when known.
+type LogRecord struct {
+	Line int64     `json:"line,omitempty"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time,omitzero"`
+}
+
+func jsonResult(v any) *mcp.CallToolResult {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return mcp.NewToolResultErrorFromErr("failed to encode result", err)
+	}
+	return mcp.NewToolResultText(string(b))
+}
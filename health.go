@@ -0,0 +1,94 @@
+package daemonize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+type HealthStatus string
+
+const (
+	HealthStatusNone      HealthStatus = ""
+	HealthStatusHealthy   HealthStatus = "healthy"
+	HealthStatusUnhealthy HealthStatus = "unhealthy"
+)
+
+const (
+	DefaultHealthInterval = 10 * time.Second
+	DefaultHealthRetries  = 3
+)
+
+var ErrWorkdirMissing = errors.New("working directory no longer exists")
+
+// Health returns the result of the health checks of the daemon. It is
+// HealthStatusNone until the first check completes or when no HealthCheck is
+// configured.
+func (d *Daemon) Health() HealthStatus {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.health
+}
+
+// HealthError returns the error of the last health check, or nil if it
+// passed or none has run.
+func (d *Daemon) HealthError() error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.healthErr
+}
+
+func (d *Daemon) runHealthChecks(ctx context.Context) {
+	interval := d.HealthInterval
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	retries := d.HealthRetries
+	if retries <= 0 {
+		retries = DefaultHealthRetries
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.doneCh():
+			return
+		case <-ticker.C:
+		}
+		err := d.checkHealth(ctx, interval)
+		d.stateMu.Lock()
+		prev := d.health
+		d.healthErr = err
+		if err == nil {
+			d.healthFailures = 0
+			d.health = HealthStatusHealthy
+		} else {
+			d.healthFailures++
+			if d.healthFailures >= retries {
+				d.health = HealthStatusUnhealthy
+			}
+		}
+		current := d.health
+		d.stateMu.Unlock()
+		if current != prev {
+			slog.InfoContext(ctx, "daemon health changed", slog.String("name", d.Name), slog.String("health", string(current)), slog.Any("error", err))
+		}
+	}
+}
+
+func (d *Daemon) checkHealth(ctx context.Context, timeout time.Duration) error {
+	// A removed workdir would otherwise surface as an obscure chdir error.
+	if _, err := os.Stat(d.Workdir); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrWorkdirMissing, d.Workdir)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, d.HealthCheck[0], d.HealthCheck[1:]...)
+	cmd.Dir = d.Workdir
+	return cmd.Run()
+}
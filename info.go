@@ -0,0 +1,57 @@
+package daemonize
+
+import "time"
+
+// DaemonInfo is a snapshot of the state of a daemon, as returned by
+// Daemon.Snapshot.
+type DaemonInfo struct {
+	Name    string
+	Command []string
+	Status  DaemonStatus
+	// PID is the process id of the running daemon, or -1.
+	PID int
+	// StartedAt is when the current or last process was launched, or the
+	// zero time if the daemon has not been started.
+	StartedAt time.Time
+	// Uptime is how long the process has been running, or zero when it is
+	// not.
+	Uptime time.Duration
+	// RestartCount is the number of restarts that led to this daemon, by
+	// daemonize_restart, auto_restart or Restart.
+	RestartCount int
+	// LastExitCode is the exit code of the last process once it has exited,
+	// or -1 while it runs or if it was terminated by a signal.
+	LastExitCode int
+}
+
+// Snapshot returns the state of the daemon in one call. It is taken under
+// the lock that Start and the exit of the process update the state with, so
+// that all of it belongs to the same run. A status that cannot be determined
+// is reported as stopped.
+func (d *Daemon) Snapshot() DaemonInfo {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	cmd := d.cmd.Load()
+	status, _ := d.status(cmd, d.done)
+	info := DaemonInfo{
+		Name:         d.Name,
+		Command:      d.Commands,
+		Status:       status,
+		PID:          -1,
+		StartedAt:    d.startedAt,
+		RestartCount: d.restarts,
+		LastExitCode: -1,
+	}
+	select {
+	case <-d.done:
+		info.LastExitCode = d.exitCode
+	default:
+		if cmd != nil && cmd.Process != nil {
+			info.PID = cmd.Process.Pid
+		}
+	}
+	if status.active() && !info.StartedAt.IsZero() {
+		info.Uptime = time.Since(info.StartedAt)
+	}
+	return info
+}
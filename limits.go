@@ -0,0 +1,36 @@
+package daemonize
+
+import (
+	"strconv"
+	"strings"
+)
+
+// limitArgs wraps args in a shell that applies the resource limits and umask
+// of the daemon before executing it, so they are in place from the first
+// instruction. The wrapper execs the command, keeping its pid.
+func (d *Daemon) limitArgs(args []string) []string {
+	var ulimits []string
+	if d.MaxMemoryBytes > 0 {
+		// ulimit -v takes KiB
+		ulimits = append(ulimits, "ulimit -v "+strconv.FormatInt(max(1, d.MaxMemoryBytes/1024), 10))
+	}
+	if d.MaxOpenFiles > 0 {
+		ulimits = append(ulimits, "ulimit -n "+strconv.FormatInt(d.MaxOpenFiles, 10))
+	}
+	if d.MaxCPUSeconds > 0 {
+		ulimits = append(ulimits, "ulimit -t "+strconv.FormatInt(d.MaxCPUSeconds, 10))
+	}
+	if d.MaxProcesses > 0 {
+		// dash names the process limit -p, while bash and BSD shells use -u.
+		n := strconv.FormatInt(d.MaxProcesses, 10)
+		ulimits = append(ulimits, "{ ulimit -u "+n+" 2>/dev/null || ulimit -p "+n+"; }")
+	}
+	if d.Umask != "" {
+		ulimits = append(ulimits, "umask "+d.Umask)
+	}
+	if len(ulimits) == 0 {
+		return args
+	}
+	script := strings.Join(ulimits, " && ") + ` && exec "$@"`
+	return append([]string{"/bin/sh", "-c", script, "sh"}, args...)
+}
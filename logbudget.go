@@ -0,0 +1,137 @@
+package daemonize
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// WithLogBudget bounds the text kept by the memory loggers of all daemons,
+// including the retained logs of removed daemons, to maxBytes in total. When
+// the budget is exceeded the oldest lines of the biggest logs are evicted
+// shortly after the write.
+// Zero or a negative maxBytes removes the limit, which is the default.
+func WithLogBudget(maxBytes int64) Option {
+	return func(s *Server) {
+		s.logBudget.max = maxBytes
+	}
+}
+
+// logBudget is shared by the memory loggers of a server. used grows with
+// every write and is recomputed from the loggers of the server whenever it
+// exceeds max, so that it never counts loggers the server dropped.
+type logBudget struct {
+	max       int64
+	used      atomic.Int64
+	enforcing atomic.Bool
+	mu        sync.Mutex
+	loggers   func() []*memoryLogger
+}
+
+// grow records n written bytes and enforces the budget if it is exceeded.
+// The budget is enforced in the background, since the writer may hold the
+// log lock of its daemon, which enforce takes to find the loggers.
+func (b *logBudget) grow(n int) {
+	if b.max <= 0 || b.used.Add(int64(n)) <= b.max {
+		return
+	}
+	if !b.enforcing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		for {
+			b.enforce()
+			b.enforcing.Store(false)
+			// Writes during enforce may have exceeded the budget again
+			// without starting another enforce.
+			if b.used.Load() <= b.max || !b.enforcing.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}()
+}
+
+// enforce evicts the oldest lines of the biggest logger until the loggers
+// fit in the budget.
+func (b *logBudget) enforce() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counted := b.used.Load()
+	loggers := b.loggers()
+	sizes := make([]int64, len(loggers))
+	var total int64
+	for i, m := range loggers {
+		sizes[i] = m.size()
+		total += sizes[i]
+	}
+	for total > b.max {
+		biggest := 0
+		for i := range sizes {
+			if sizes[i] > sizes[biggest] {
+				biggest = i
+			}
+		}
+		// Shrink the biggest logger down to the next biggest, or by what is
+		// left over the budget if that is less.
+		var next int64
+		for i := range sizes {
+			if i != biggest {
+				next = max(next, sizes[i])
+			}
+		}
+		freed := loggers[biggest].evict(max(1, min(total-b.max, sizes[biggest]-next)))
+		if freed == 0 {
+			break
+		}
+		sizes[biggest] -= freed
+		total -= freed
+	}
+	// Keep the bytes written meanwhile, which may or may not be in total.
+	b.used.Add(total - counted)
+}
+
+// usage returns the bytes of log text currently kept across daemons.
+func (b *logBudget) usage() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var total int64
+	for _, m := range b.loggers() {
+		total += m.size()
+	}
+	return total
+}
+
+// memoryLoggers returns the distinct memory loggers of the daemons and the
+// retained logs of the server.
+func (s *Server) memoryLoggers() []*memoryLogger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var loggers []*memoryLogger
+	add := func(l Logger) {
+		if m, ok := l.(*memoryLogger); ok && !slices.Contains(loggers, m) {
+			loggers = append(loggers, m)
+		}
+	}
+	for _, d := range s.Daemons {
+		add(d.logger())
+	}
+	for _, r := range s.retired {
+		add(r.logger)
+	}
+	return loggers
+}
+
+// LogBytes returns the bytes of log text kept across daemons, and the budget
+// set by WithLogBudget, which is zero when there is none.
+func (s *Server) LogBytes() (used, budget int64) {
+	return s.logBudget.usage(), max(0, s.logBudget.max)
+}
+
+// attachLogBudget makes the memory logger of d count towards the budget.
+func (s *Server) attachLogBudget(d *Daemon) {
+	if m, ok := d.logger().(*memoryLogger); ok {
+		m.mu.Lock()
+		m.budget = s.logBudget
+		m.mu.Unlock()
+	}
+}
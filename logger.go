@@ -2,56 +2,636 @@ package daemonize
 
 import (
 	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type Logger interface {
 	io.Writer
 	io.Closer
 	ReadLine(offset int64) (ss []string, err error)
+	// PeekLines returns up to limit lines starting at offset without
+	// removing them from the log.
+	PeekLines(offset, limit int64) (ss []string, err error)
+	// ReadBytes returns up to n bytes of the log starting at byte offset
+	// without removing them, and the offset they start at. The log reads as
+	// its lines, each ended by a newline except a last line that is still
+	// being written. Offsets count every byte written to the log, including
+	// bytes since evicted, cleared or read by ReadLine, so that a byte keeps
+	// its offset. Reading starts at the first byte still stored at or after
+	// offset and stops where bytes read by ReadLine are missing.
+	ReadBytes(offset, n int64) (data []byte, start int64, err error)
+	// Snapshot returns a copy of every line stored in the log, taken at once
+	// so that concurrent writes cannot leave it half updated.
+	Snapshot() ([]string, error)
 	Lines() int64
+	// FirstLineNumber returns the number of the line at offset 0 within the
+	// history of the log, counting from 1. Lines evicted from the start of
+	// the log, discarded by Clear or read by ReadLine stay counted, so that a
+	// stored line keeps its number.
+	FirstLineNumber() int64
+	// LastLineNumber returns the number of the last line written to the log,
+	// or 0 if none was.
+	LastLineNumber() int64
+	// ReadNumbered returns the lines from the first line numbered from or
+	// later on, or for a negative from the last -from lines, each with its
+	// number, and removes them from the log like ReadLine.
+	ReadNumbered(from int64) (lines []NumberedLine, err error)
+	// PeekNumbered returns up to limit lines selected by from as for
+	// ReadNumbered, each with its number, without removing them.
+	PeekNumbered(from, limit int64) (lines []NumberedLine, err error)
+	// Last returns the most recently stored line, if any.
+	Last() (line LogLine, ok bool)
+	// Clear discards all lines stored in the log.
+	Clear() error
+	// Subscribe returns a channel that receives every line stored after the
+	// call, and a function that cancels the subscription and closes the channel.
+	Subscribe() (lines <-chan string, cancel func())
 }
 
-func NewMemoryLogger() Logger {
-	lines := make([]string, 0, 1024)
-	return &memoryLogger{
-		lines:    lines,
-		maxLines: 1024,
+// LogLine is a stored log line with the time it was written.
+type LogLine struct {
+	Text string
+	Time time.Time
+}
+
+// NumberedLine is a stored log line with its number within the history of
+// the log, as returned by ReadNumbered and PeekNumbered.
+type NumberedLine struct {
+	Number int64
+	Text   string
+}
+
+// history maps positions in the bytes and lines stored by a log to offsets
+// and numbers within everything ever written to it, which stay valid as
+// bytes and lines are removed.
+type history struct {
+	// removedBytes and removedLines count the bytes and lines removed from
+	// the start of the log.
+	removedBytes int64
+	removedLines int64
+	// gaps are the bytes and lines read from the end of the log by ReadLine,
+	// in order, each at the stored position and line index where the ones
+	// written later continue.
+	gaps []historyGap
+}
+
+type historyGap struct {
+	pos   int64
+	bytes int64
+	line  int64
+	lines int64
+}
+
+// removed records that the first n stored bytes, holding the first lines
+// stored lines, were removed.
+func (h *history) removed(n, lines int64) {
+	h.removedBytes += n
+	h.removedLines += lines
+	i := 0
+	for ; i < len(h.gaps) && h.gaps[i].pos <= n; i++ {
+		h.removedBytes += h.gaps[i].bytes
+		h.removedLines += h.gaps[i].lines
+	}
+	h.gaps = slices.Delete(h.gaps, 0, i)
+	for i := range h.gaps {
+		h.gaps[i].pos -= n
+		h.gaps[i].line -= lines
 	}
 }
 
+// consumed records that the n stored bytes from pos on, the end of the
+// log, were read by ReadLine along with the lines stored from index line
+// on. Gaps among them become part of the new one.
+func (h *history) consumed(pos, n, line, lines int64) {
+	i := len(h.gaps)
+	for i > 0 && h.gaps[i-1].pos >= pos {
+		i--
+		n += h.gaps[i].bytes
+		lines += h.gaps[i].lines
+	}
+	h.gaps = append(h.gaps[:i], historyGap{pos: pos, bytes: n, line: line, lines: lines})
+}
+
+// position returns the stored position of the first byte still stored at
+// or after offset, and the offset of that byte.
+func (h *history) position(offset int64) (pos, start int64) {
+	base := h.removedBytes
+	pos = max(0, offset-base)
+	for _, g := range h.gaps {
+		if pos < g.pos {
+			break
+		}
+		base += g.bytes
+		pos = max(g.pos, offset-base)
+	}
+	return pos, base + pos
+}
+
+// contiguous returns how many stored bytes from pos on are followed by no
+// gap, or -1 if all of them are.
+func (h *history) contiguous(pos int64) int64 {
+	for _, g := range h.gaps {
+		if g.pos > pos {
+			return g.pos - pos
+		}
+	}
+	return -1
+}
+
+// number returns the number of the stored line at index i, counting from 1,
+// or for the number of stored lines the number the next line will get.
+func (h *history) number(i int64) int64 {
+	n := h.removedLines + 1 + i
+	for _, g := range h.gaps {
+		if g.line > i {
+			break
+		}
+		n += g.lines
+	}
+	return n
+}
+
+// index returns the index of the first of the stored lines selected by
+// from: the first line numbered from or later, or for a negative from the
+// last -from lines.
+func (h *history) index(from, stored int64) int64 {
+	if from < 0 {
+		return max(0, stored+from)
+	}
+	base := h.removedLines + 1
+	i := max(0, from-base)
+	for _, g := range h.gaps {
+		if i < g.line {
+			break
+		}
+		base += g.lines
+		i = max(g.line, from-base)
+	}
+	return min(i, stored)
+}
+
+// subscriberBuffer is the number of lines buffered per subscriber. Lines are
+// dropped for a subscriber whose buffer is full so that Write never blocks.
+const subscriberBuffer = 256
+
+// DefaultMaxLineBytes is the longest line kept by a memory logger unless
+// WithMaxLineBytes sets another limit.
+const DefaultMaxLineBytes = 64 * 1024
+
+// truncatedLineMarker is appended to a line cut at the maximum length. The
+// rest of the line continues on the next stored line.
+const truncatedLineMarker = " [line truncated]"
+
+type MemoryLoggerOption func(*memoryLogger)
+
+// WithMaxLineBytes limits stored lines to n bytes. Longer lines are cut with
+// a marker and continued on the next line. Zero or a negative n removes the
+// limit.
+func WithMaxLineBytes(n int) MemoryLoggerOption {
+	return func(m *memoryLogger) {
+		m.maxLineBytes = n
+	}
+}
+
+// WithRateLimit limits stored lines to rate lines per second while allowing
+// bursts of up to burst lines. Lines over the limit are dropped and counted
+// as suppressed.
+func WithRateLimit(rate float64, burst int) MemoryLoggerOption {
+	return func(m *memoryLogger) {
+		m.limiter = &tokenBucket{
+			rate:   rate,
+			burst:  float64(burst),
+			tokens: float64(burst),
+		}
+	}
+}
+
+func NewMemoryLogger(opts ...MemoryLoggerOption) Logger {
+	lines := make([]LogLine, 0, 1024)
+	m := &memoryLogger{
+		lines:        lines,
+		maxLines:     1024,
+		maxLineBytes: DefaultMaxLineBytes,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
 type memoryLogger struct {
-	lines    []string
-	maxLines int64
+	mu           sync.Mutex
+	lines        []LogLine
+	maxLines     int64
+	maxLineBytes int
+	limiter      *tokenBucket
+	suppressed   int64
+	subscribers  map[chan string]struct{}
+	// open is set while the last line has not been terminated by a newline,
+	// so that the next write continues it.
+	open bool
+	// carriage is set while the open line ends with a carriage return, so
+	// that the next text replaces it.
+	carriage bool
+	// suppressing is set while the line being written was suppressed by the
+	// rate limit, so that the next write drops its rest too.
+	suppressing bool
+	// budget is the log budget of the server the logger belongs to, if any.
+	budget *logBudget
+	// dropped counts the lines evicted to stay within maxLines or the log
+	// budget, as opposed to read or cleared.
+	dropped int64
+	// history gives the offsets of the stored bytes for ReadBytes and the
+	// numbers of the stored lines.
+	history history
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
 }
 
 func (m *memoryLogger) Write(p []byte) (n int, err error) {
-	line := string(p)
-	if len(line) > 0 && line[len(line)-1] == '\n' {
-		line = line[:len(line)-1]
+	// A zero-length write carries no output; storing it would add an empty line.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if budget := m.write(p); budget != nil {
+		// The budget is checked without the lock, as it locks every logger.
+		budget.grow(len(p))
+	}
+	return len(p), nil
+}
+
+// write stores p and returns the budget it counts towards, if any.
+func (m *memoryLogger) write(p []byte) *logBudget {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	stored := false
+	for s := string(p); s != ""; {
+		line, rest, terminated := strings.Cut(s, "\n")
+		s = rest
+		// The rate limit is charged once per line, as it starts, so that an
+		// open line is never cut.
+		if !m.open && !m.suppressing && m.limiter != nil && !m.limiter.allow(now) {
+			m.suppressed++
+			m.suppressing = true
+		}
+		if m.suppressing {
+			// The rest of a suppressed line is dropped with it.
+			m.suppressing = !terminated
+			continue
+		}
+		stored = true
+		// A carriage return moves back to the start of the line, so only the
+		// text after the last one remains visible, as on a terminal. One
+		// before the newline ends the line as it is, while one at the end of
+		// a write only takes effect once the next text arrives.
+		overwrite := m.carriage && line != ""
+		trimmed := strings.TrimSuffix(line, "\r")
+		m.carriage = !terminated && trimmed != line
+		line = trimmed
+		if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+			line = line[i+1:]
+			overwrite = true
+		}
+		switch {
+		case m.open && overwrite:
+			m.lines[len(m.lines)-1] = LogLine{Text: line, Time: now}
+		case m.open:
+			last := &m.lines[len(m.lines)-1]
+			last.Text += line
+			last.Time = now
+		default:
+			m.append(LogLine{Text: line, Time: now})
+		}
+		m.splitLong(now)
+		m.open = !terminated
+		if terminated {
+			m.publish(m.lines[len(m.lines)-1].Text)
+		}
+	}
+	if !stored {
+		return nil
 	}
+	return m.budget
+}
+
+func (m *memoryLogger) append(line LogLine) {
 	m.lines = append(m.lines, line)
 	if int64(len(m.lines)) > m.maxLines {
+		// Clear the dropped entry so its text can be collected before the
+		// backing array is reallocated.
+		m.history.removed(int64(len(m.lines[0].Text))+1, 1)
+		m.lines[0] = LogLine{}
 		m.lines = m.lines[1:]
+		m.dropped++
 	}
-	return len(p), nil
+}
+
+// splitLong cuts the last line at maxLineBytes, so that output without
+// newlines cannot grow a line without bound.
+func (m *memoryLogger) splitLong(now time.Time) {
+	if m.maxLineBytes <= 0 {
+		return
+	}
+	for {
+		text := m.lines[len(m.lines)-1].Text
+		if len(text) <= m.maxLineBytes {
+			return
+		}
+		cut := m.maxLineBytes
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = m.maxLineBytes
+		}
+		m.lines[len(m.lines)-1].Text = text[:cut] + truncatedLineMarker
+		m.publish(m.lines[len(m.lines)-1].Text)
+		m.append(LogLine{Text: text[cut:], Time: now})
+	}
+}
+
+// size returns the bytes of text stored.
+func (m *memoryLogger) size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, l := range m.lines {
+		n += int64(len(l.Text))
+	}
+	return n
+}
+
+// evict discards the oldest lines until at least n bytes of text are freed
+// or the log is empty, and returns the bytes freed.
+func (m *memoryLogger) evict(n int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var freed int64
+	i := 0
+	for ; i < len(m.lines) && freed < n; i++ {
+		freed += int64(len(m.lines[i].Text))
+	}
+	m.history.removed(m.bytePos(int64(i)), int64(i))
+	clear(m.lines[:i])
+	m.lines = m.lines[i:]
+	m.dropped += int64(i)
+	if len(m.lines) == 0 {
+		m.open = false
+		m.carriage = false
+	}
+	return freed
+}
+
+// publish sends a completed line to the subscribers without blocking.
+func (m *memoryLogger) publish(line string) {
+	for ch := range m.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+func (m *memoryLogger) Subscribe() (<-chan string, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan string, subscriberBuffer)
+	if m.subscribers == nil {
+		m.subscribers = make(map[chan string]struct{})
+	}
+	m.subscribers[ch] = struct{}{}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			delete(m.subscribers, ch)
+			close(ch)
+		})
+	}
+	return ch, cancel
 }
 
 func (m *memoryLogger) ReadLine(offset int64) (ss []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if offset < 0 || offset >= int64(len(m.lines)) {
 		return nil, io.EOF
 	}
 	if offset >= int64(len(m.lines)) {
 		return nil, nil
 	}
-	ss = m.lines[offset:]
-	m.lines = m.lines[:offset]
+	ss = texts(m.lines[offset:])
+	m.consume(offset)
 	return ss, nil
 }
 
+// consume removes the stored lines from index offset on.
+func (m *memoryLogger) consume(offset int64) {
+	pos := m.bytePos(offset)
+	stored := int64(len(m.lines))
+	m.history.consumed(pos, m.bytePos(stored)-pos, offset, stored-offset)
+	clear(m.lines[offset:])
+	m.lines = m.lines[:offset]
+	m.open = false
+	m.carriage = false
+}
+
+func (m *memoryLogger) ReadNumbered(from int64) ([]NumberedLine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	offset := m.history.index(from, int64(len(m.lines)))
+	if offset >= int64(len(m.lines)) {
+		return nil, io.EOF
+	}
+	lines := m.numbered(offset, int64(len(m.lines)))
+	m.consume(offset)
+	return lines, nil
+}
+
+func (m *memoryLogger) PeekNumbered(from, limit int64) ([]NumberedLine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	offset := m.history.index(from, int64(len(m.lines)))
+	if offset >= int64(len(m.lines)) {
+		return nil, io.EOF
+	}
+	return m.numbered(offset, min(offset+max(0, limit), int64(len(m.lines)))), nil
+}
+
+// numbered returns the stored lines from index from up to index to with
+// their numbers.
+func (m *memoryLogger) numbered(from, to int64) []NumberedLine {
+	lines := make([]NumberedLine, 0, to-from)
+	for i := from; i < to; i++ {
+		lines = append(lines, NumberedLine{Number: m.history.number(i), Text: m.lines[i].Text})
+	}
+	return lines
+}
+
+func (m *memoryLogger) PeekLines(offset, limit int64) (ss []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if offset < 0 || offset >= int64(len(m.lines)) {
+		return nil, io.EOF
+	}
+	end := min(offset+max(0, limit), int64(len(m.lines)))
+	return texts(m.lines[offset:end]), nil
+}
+
+func (m *memoryLogger) Snapshot() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return texts(m.lines), nil
+}
+
+func (m *memoryLogger) ReadBytes(offset, n int64) ([]byte, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if offset < 0 {
+		return nil, 0, io.EOF
+	}
+	from, start := m.history.position(offset)
+	if from >= m.bytePos(int64(len(m.lines))) {
+		return nil, 0, io.EOF
+	}
+	to := from + max(0, n)
+	if c := m.history.contiguous(from); c >= 0 {
+		to = min(to, from+c)
+	}
+	var buf []byte
+	var pos int64
+	for i := range m.lines {
+		line := m.lineBytes(i)
+		end := pos + int64(len(line))
+		if end > from && pos < to {
+			buf = append(buf, line[max(0, from-pos):min(int64(len(line)), to-pos)]...)
+		}
+		pos = end
+	}
+	return buf, start, nil
+}
+
+// lineBytes returns the stored line at index i as it reads in the log, with
+// a newline unless it is the last line and still being written.
+func (m *memoryLogger) lineBytes(i int) string {
+	if i < len(m.lines)-1 || !m.open {
+		return m.lines[i].Text + "\n"
+	}
+	return m.lines[i].Text
+}
+
+// bytePos returns the position of the stored line at index i, or of the end
+// of the log for the number of lines, among the bytes the log reads as.
+func (m *memoryLogger) bytePos(i int64) int64 {
+	var pos int64
+	for j := range int(i) {
+		pos += int64(len(m.lineBytes(j)))
+	}
+	return pos
+}
+
+// lineTexts returns the texts of numbered lines.
+func lineTexts(lines []NumberedLine) []string {
+	ss := make([]string, len(lines))
+	for i, l := range lines {
+		ss[i] = l.Text
+	}
+	return ss
+}
+
+func texts(lines []LogLine) []string {
+	ss := make([]string, len(lines))
+	for i, l := range lines {
+		ss[i] = l.Text
+	}
+	return ss
+}
+
 func (m *memoryLogger) Lines() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return int64(len(m.lines))
 }
 
+func (m *memoryLogger) FirstLineNumber() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.history.number(0)
+}
+
+func (m *memoryLogger) LastLineNumber() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.history.number(int64(len(m.lines))) - 1
+}
+
+func (m *memoryLogger) Last() (LogLine, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.lines) == 0 {
+		return LogLine{}, false
+	}
+	return m.lines[len(m.lines)-1], true
+}
+
+func (m *memoryLogger) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.history.removed(m.bytePos(int64(len(m.lines))), int64(len(m.lines)))
+	// Clear the entries so that their text can be collected.
+	clear(m.lines)
+	m.lines = m.lines[:0]
+	m.open = false
+	m.carriage = false
+	return nil
+}
+
+// LastLines returns up to n of the most recently stored lines with the times
+// they were written, oldest first.
+func (m *memoryLogger) LastLines(n int64) []LogLine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.lines[max(0, int64(len(m.lines))-n):])
+}
+
+// Suppressed returns the number of lines dropped by the rate limit.
+func (m *memoryLogger) Suppressed() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.suppressed
+}
+
+// Dropped returns the number of lines evicted from the start of the log to
+// make room for newer ones.
+func (m *memoryLogger) Dropped() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dropped
+}
+
 func (m *memoryLogger) Close() error {
 	return nil
 }
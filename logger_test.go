@@ -0,0 +1,652 @@
+package daemonize_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	daemonize "github.com/mackee/mcp-daemonize"
+)
+
+// TestMemoryLoggerRateLimit verifies that a burst passes the rate limit while a sustained flood is throttled.
+func TestMemoryLoggerRateLimit(t *testing.T) {
+	logger := daemonize.NewMemoryLogger(daemonize.WithRateLimit(1, 10))
+	for i := range 10 {
+		fmt.Fprintf(logger, "burst %d\n", i)
+	}
+	if got := logger.Lines(); got != 10 {
+		t.Fatalf("after burst Lines() = %d, want 10", got)
+	}
+	for i := range 100 {
+		fmt.Fprintf(logger, "flood %d\n", i)
+	}
+	// At 1 line per second, at most one token can refill during the flood.
+	if got := logger.Lines(); got > 11 {
+		t.Errorf("after flood Lines() = %d, want at most 11", got)
+	}
+	sl, ok := logger.(interface{ Suppressed() int64 })
+	if !ok {
+		t.Fatal("memory logger does not report suppressed lines")
+	}
+	if got := sl.Suppressed(); got < 99 {
+		t.Errorf("Suppressed() = %d, want at least 99", got)
+	}
+}
+
+// TestMemoryLoggerRateLimitPerLine verifies that the rate limit counts the lines of a single write and never cuts an open line.
+func TestMemoryLoggerRateLimitPerLine(t *testing.T) {
+	logger := daemonize.NewMemoryLogger(daemonize.WithRateLimit(0.001, 3))
+	sl := logger.(interface{ Suppressed() int64 })
+	var flood strings.Builder
+	for i := range 10 {
+		fmt.Fprintf(&flood, "line %d\n", i)
+	}
+	fmt.Fprint(logger, flood.String())
+	if got := logger.Lines(); got != 3 {
+		t.Errorf("after one write of 10 lines Lines() = %d, want 3", got)
+	}
+	if got := sl.Suppressed(); got != 7 {
+		t.Errorf("after one write of 10 lines Suppressed() = %d, want 7", got)
+	}
+
+	logger = daemonize.NewMemoryLogger(daemonize.WithRateLimit(0.001, 1))
+	sl = logger.(interface{ Suppressed() int64 })
+	fmt.Fprint(logger, "open")
+	// The open line is completed, while the next lines are suppressed whole.
+	fmt.Fprint(logger, " end\nnext")
+	fmt.Fprint(logger, " half\nlast\n")
+	lines, err := logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(lines, []string{"open end"}) {
+		t.Errorf("PeekLines() = %q, want [\"open end\"]", lines)
+	}
+	if got := sl.Suppressed(); got != 2 {
+		t.Errorf("Suppressed() = %d, want 2", got)
+	}
+}
+
+// TestMemoryLoggerSubscribe verifies that subscribers receive written lines in order.
+func TestMemoryLoggerSubscribe(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	fmt.Fprintln(logger, "before")
+	lines, cancel := logger.Subscribe()
+	defer cancel()
+	for i := range 5 {
+		fmt.Fprintf(logger, "line %d\n", i)
+	}
+	for i := range 5 {
+		want := fmt.Sprintf("line %d", i)
+		if got := <-lines; got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	}
+	cancel()
+	if _, ok := <-lines; ok {
+		t.Error("channel still open after cancel")
+	}
+	// Writing after cancel must not panic or block.
+	fmt.Fprintln(logger, "after")
+}
+
+// TestMemoryLoggerEmptyWrite verifies that zero-length writes are ignored while whitespace-only lines are kept.
+func TestMemoryLoggerEmptyWrite(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	n, err := logger.Write([]byte{})
+	if err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("Write returned %d, want 0", n)
+	}
+	if got := logger.Lines(); got != 0 {
+		t.Errorf("after empty write Lines() = %d, want 0", got)
+	}
+	n, err = logger.Write([]byte("  \n"))
+	if err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Write returned %d, want 3", n)
+	}
+	lines, err := logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	if len(lines) != 1 || lines[0] != "  " {
+		t.Errorf("PeekLines returned %q, want [\"  \"]", lines)
+	}
+}
+
+// TestMemoryLoggerCarriageReturn verifies that a progress line rewritten with carriage returns keeps only its final frame.
+func TestMemoryLoggerCarriageReturn(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	fmt.Fprintln(logger, "starting")
+	fmt.Fprint(logger, "progress 0%")
+	for i := 10; i <= 100; i += 10 {
+		fmt.Fprintf(logger, "\rprogress %d%%", i)
+	}
+	fmt.Fprint(logger, "\n")
+	fmt.Fprint(logger, "crlf\r\n")
+	lines, err := logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	want := []string{"starting", "progress 100%", "crlf"}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("PeekLines returned %q, want %q", lines, want)
+	}
+}
+
+// TestMemoryLoggerTrailingCarriageReturn verifies that frames ending in a carriage return are replaced by the next frame.
+func TestMemoryLoggerTrailingCarriageReturn(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	for _, frame := range []string{"progress 10%\r", "progress 20%\r", "done\n", "kept\r\n"} {
+		fmt.Fprint(logger, frame)
+	}
+	lines, err := logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	want := []string{"done", "kept"}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("PeekLines returned %q, want %q", lines, want)
+	}
+}
+
+// TestMemoryLoggerMaxLineBytes verifies that a long line without newlines is split at the cap with a marker.
+func TestMemoryLoggerMaxLineBytes(t *testing.T) {
+	logger := daemonize.NewMemoryLogger(daemonize.WithMaxLineBytes(10))
+	fmt.Fprint(logger, strings.Repeat("x", 25))
+	lines, err := logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatalf("PeekLines error: %v", err)
+	}
+	want := []string{
+		strings.Repeat("x", 10) + " [line truncated]",
+		strings.Repeat("x", 10) + " [line truncated]",
+		strings.Repeat("x", 5),
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("PeekLines returned %q, want %q", lines, want)
+	}
+}
+
+// TestMemoryLoggerReadBytes verifies that byte windows span lines and stop at the end of the log.
+func TestMemoryLoggerReadBytes(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	fmt.Fprint(logger, "alpha\nbravo\ncharlie")
+	tests := []struct {
+		offset, n int64
+		want      string
+	}{
+		{0, 5, "alpha"},
+		{3, 6, "ha\nbra"},
+		{6, 100, "bravo\ncharlie"},
+		{12, 3, "cha"},
+	}
+	for _, tt := range tests {
+		got, start, err := logger.ReadBytes(tt.offset, tt.n)
+		if err != nil {
+			t.Errorf("ReadBytes(%d, %d) error: %v", tt.offset, tt.n, err)
+			continue
+		}
+		if string(got) != tt.want || start != tt.offset {
+			t.Errorf("ReadBytes(%d, %d) = %q at %d, want %q", tt.offset, tt.n, got, start, tt.want)
+		}
+	}
+	if _, _, err := logger.ReadBytes(19, 10); err != io.EOF {
+		t.Errorf("ReadBytes past the end error = %v, want io.EOF", err)
+	}
+	// Once the last line is terminated, its newline is readable too.
+	fmt.Fprint(logger, "\n")
+	if got, _, _ := logger.ReadBytes(12, 100); string(got) != "charlie\n" {
+		t.Errorf("ReadBytes(12, 100) = %q, want %q", got, "charlie\n")
+	}
+	if lines := logger.Lines(); lines != 3 {
+		t.Errorf("Lines() = %d after ReadBytes, want 3", lines)
+	}
+}
+
+// TestMemoryLoggerReadBytesHistory verifies that byte offsets keep counting bytes that were evicted or read by ReadLine.
+func TestMemoryLoggerReadBytesHistory(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	// The memory logger keeps 1024 lines, so lines 0000 and 0001 are evicted
+	// and every line k starts at offset 5k.
+	for i := range 1026 {
+		fmt.Fprintf(logger, "%04d\n", i)
+	}
+	tests := []struct {
+		offset, n int64
+		want      string
+		start     int64
+	}{
+		{10, 4, "0002", 10},
+		// Reading evicted bytes starts at the oldest byte still stored.
+		{0, 4, "0002", 10},
+		{5120, 100, "1024\n1025\n", 5120},
+	}
+	for _, tt := range tests {
+		got, start, err := logger.ReadBytes(tt.offset, tt.n)
+		if err != nil || string(got) != tt.want || start != tt.start {
+			t.Errorf("ReadBytes(%d, %d) = %q at %d, %v, want %q at %d", tt.offset, tt.n, got, start, err, tt.want, tt.start)
+		}
+	}
+	// The last line is read by ReadLine, so the next line starts after its
+	// bytes and a read stops before them.
+	if _, err := logger.ReadLine(1023); err != nil {
+		t.Fatalf("ReadLine error: %v", err)
+	}
+	fmt.Fprint(logger, "next\n")
+	tests = []struct {
+		offset, n int64
+		want      string
+		start     int64
+	}{
+		{5120, 100, "1024\n", 5120},
+		{5125, 100, "next\n", 5130},
+	}
+	for _, tt := range tests {
+		got, start, err := logger.ReadBytes(tt.offset, tt.n)
+		if err != nil || string(got) != tt.want || start != tt.start {
+			t.Errorf("after ReadLine ReadBytes(%d, %d) = %q at %d, %v, want %q at %d", tt.offset, tt.n, got, start, err, tt.want, tt.start)
+		}
+	}
+	if err := logger.Clear(); err != nil {
+		t.Fatalf("Clear error: %v", err)
+	}
+	fmt.Fprint(logger, "last\n")
+	if got, start, err := logger.ReadBytes(0, 100); err != nil || string(got) != "last\n" || start != 5135 {
+		t.Errorf("after Clear ReadBytes(0, 100) = %q at %d, %v, want %q at 5135", got, start, err, "last\n")
+	}
+}
+
+// TestFileLoggerReadBytesHistory verifies that the byte offsets of a file logger keep counting bytes read by ReadLine or cleared.
+func TestFileLoggerReadBytesHistory(t *testing.T) {
+	logger, err := daemonize.NewFileLogger(filepath.Join(t.TempDir(), "daemon.log"))
+	if err != nil {
+		t.Fatalf("NewFileLogger error: %v", err)
+	}
+	defer logger.Close()
+	fmt.Fprint(logger, "alpha\nbravo\n")
+	if _, err := logger.ReadLine(1); err != nil {
+		t.Fatalf("ReadLine error: %v", err)
+	}
+	fmt.Fprint(logger, "charlie\n")
+	tests := []struct {
+		offset int64
+		want   string
+		start  int64
+	}{
+		{0, "alpha\n", 0},
+		{6, "charlie\n", 12},
+	}
+	for _, tt := range tests {
+		got, start, err := logger.ReadBytes(tt.offset, 100)
+		if err != nil || string(got) != tt.want || start != tt.start {
+			t.Errorf("ReadBytes(%d, 100) = %q at %d, %v, want %q at %d", tt.offset, got, start, err, tt.want, tt.start)
+		}
+	}
+	if err := logger.Clear(); err != nil {
+		t.Fatalf("Clear error: %v", err)
+	}
+	fmt.Fprint(logger, "delta\n")
+	if got, start, err := logger.ReadBytes(0, 100); err != nil || string(got) != "delta\n" || start != 20 {
+		t.Errorf("after Clear ReadBytes(0, 100) = %q at %d, %v, want %q at 20", got, start, err, "delta\n")
+	}
+}
+
+// TestFileLoggerRotationFailure verifies that the log keeps being written after a rotation fails.
+func TestFileLoggerRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	logger, err := daemonize.NewFileLogger(path, daemonize.WithRotateBytes(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	// A directory in place of the first segment makes the rotation fail.
+	if err := os.Mkdir(path+".1", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprintln(logger, "first line to rotate"); err == nil {
+		t.Fatal("Write succeeded although the rotation failed")
+	}
+	if err := os.Remove(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprintln(logger, "second"); err != nil {
+		t.Fatalf("Write after the failed rotation error: %v", err)
+	}
+	got, err := logger.PeekLines(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first line to rotate", "second"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("PeekLines() = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("segment not rotated once possible: %v", err)
+	}
+}
+
+// TestFileLoggerLast verifies that the last line follows writes, reads and clears.
+func TestFileLoggerLast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := daemonize.NewFileLogger(path, daemonize.WithRotateBytes(32), daemonize.WithCompression(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	steps := []struct {
+		do   func()
+		want string
+	}{
+		{func() {}, "earlier"},
+		{func() { fmt.Fprint(logger, "par") }, "par"},
+		{func() { fmt.Fprint(logger, "tial\nnext line\n") }, "next line"},
+		{func() { fmt.Fprint(logger, "rotated across segments\n") }, "rotated across segments"},
+		{func() { _, _ = logger.ReadLine(logger.Lines() - 1) }, "next line"},
+	}
+	for i, step := range steps {
+		step.do()
+		if last, ok := logger.Last(); !ok || last.Text != step.want {
+			t.Errorf("step %d: Last() = %q, %v, want %q", i, last.Text, ok, step.want)
+		}
+	}
+	if err := logger.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if last, ok := logger.Last(); ok {
+		t.Errorf("after Clear Last() = %q, want none", last.Text)
+	}
+}
+
+// TestFileLoggerCompression verifies that rotated segments are gzipped and that lines are read back across them.
+func TestFileLoggerCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	logger, err := daemonize.NewFileLogger(path, daemonize.WithRotateBytes(64), daemonize.WithCompression(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	var want []string
+	for i := range 20 {
+		line := fmt.Sprintf("line %02d", i)
+		want = append(want, line)
+		fmt.Fprintln(logger, line)
+	}
+	if _, err := os.Stat(path + ".1.gz"); err != nil {
+		t.Fatalf("rotated segment is not compressed: %v", err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("uncompressed segment left behind: %v", err)
+	}
+	if got := logger.Lines(); got != int64(len(want)) {
+		t.Fatalf("Lines() = %d, want %d", got, len(want))
+	}
+	got, err := logger.PeekLines(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("PeekLines() = %q, want %q", got, want)
+	}
+	// Reopening discovers the compressed segments.
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logger, err = daemonize.NewFileLogger(path, daemonize.WithRotateBytes(64), daemonize.WithCompression(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	got, err = logger.ReadLine(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want[5:], "\n") {
+		t.Fatalf("ReadLine(5) = %q, want %q", got, want[5:])
+	}
+	if got := logger.Lines(); got != 5 {
+		t.Fatalf("after ReadLine Lines() = %d, want 5", got)
+	}
+	fmt.Fprintln(logger, "after")
+	got, err = logger.PeekLines(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(want[:5:5], "after"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("PeekLines() after ReadLine = %q, want %q", got, want)
+	}
+}
+
+// TestFileLoggerRotation verifies that the file is rotated past the size threshold and only the newest segments are kept.
+func TestFileLoggerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	// Every line is 8 bytes, so each segment holds 4 lines.
+	logger, err := daemonize.NewFileLogger(path, daemonize.WithRotateBytes(32), daemonize.WithMaxSegments(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	var want []string
+	for i := range 18 {
+		line := fmt.Sprintf("line %02d", i)
+		want = append(want, line)
+		fmt.Fprintln(logger, line)
+	}
+	for _, name := range []string{path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatalf("rotated segment missing: %v", err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("segment beyond the maximum kept: %v", err)
+	}
+	// Two full segments and the 2 lines of the active file are retained.
+	want = want[8:]
+	if got := logger.Lines(); got != int64(len(want)) {
+		t.Fatalf("Lines() = %d, want %d", got, len(want))
+	}
+	got, err := logger.PeekLines(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("PeekLines() = %q, want %q", got, want)
+	}
+	if got, err := logger.Snapshot(); err != nil || strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Snapshot() = %q, %v, want %q", got, err, want)
+	}
+	if last, ok := logger.Last(); !ok || last.Text != "line 17" {
+		t.Fatalf("Last() = %q, %v, want %q", last.Text, ok, "line 17")
+	}
+}
+
+// TestFileLoggerReadKeepsFiles verifies that lines read by ReadNumbered are hidden from the logger but stay in the files, also once the segment holding them is deleted.
+func TestFileLoggerReadKeepsFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	// Every line is 8 bytes, so each segment holds 4 lines.
+	logger, err := daemonize.NewFileLogger(path, daemonize.WithRotateBytes(32), daemonize.WithMaxSegments(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	for i := range 6 {
+		fmt.Fprintf(logger, "line %02d\n", i)
+	}
+	lines, err := logger.ReadNumbered(-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []daemonize.NumberedLine{{4, "line 03"}, {5, "line 04"}, {6, "line 05"}}; !slices.Equal(lines, want) {
+		t.Fatalf("ReadNumbered(-3) = %v, want %v", lines, want)
+	}
+	for name, want := range map[string]string{
+		path:        "line 04\nline 05\n",
+		path + ".1": "line 00\nline 01\nline 02\nline 03\n",
+	} {
+		if data, err := os.ReadFile(name); err != nil || string(data) != want {
+			t.Fatalf("after read %s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	// The next rotation deletes the segment holding the first read line.
+	for i := 6; i < 10; i++ {
+		fmt.Fprintf(logger, "line %02d\n", i)
+	}
+	got, err := logger.PeekNumbered(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []daemonize.NumberedLine{{7, "line 06"}, {8, "line 07"}, {9, "line 08"}, {10, "line 09"}}; !slices.Equal(got, want) {
+		t.Errorf("after rotation PeekNumbered() = %v, want %v", got, want)
+	}
+	if got := logger.Lines(); got != 4 {
+		t.Errorf("after rotation Lines() = %d, want 4", got)
+	}
+	if got := logger.(interface{ Dropped() int64 }).Dropped(); got != 3 {
+		t.Errorf("after rotation Dropped() = %d, want 3", got)
+	}
+	if data, err := os.ReadFile(path + ".1"); err != nil || string(data) != "line 04\nline 05\nline 06\nline 07\n" {
+		t.Errorf("after rotation segment = %q, %v", data, err)
+	}
+}
+
+// TestMemoryLoggerFirstLineNumberAfterClear verifies that cleared lines keep counting towards line numbers.
+func TestMemoryLoggerFirstLineNumberAfterClear(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	for i := range 3 {
+		fmt.Fprintf(logger, "line %d\n", i+1)
+	}
+	if got := logger.FirstLineNumber(); got != 1 {
+		t.Fatalf("FirstLineNumber() = %d, want 1", got)
+	}
+	if err := logger.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(logger, "after clear")
+	if got := logger.FirstLineNumber(); got != 4 {
+		t.Errorf("after Clear FirstLineNumber() = %d, want 4", got)
+	}
+}
+
+// TestLoggerNumberedAfterReadLine verifies that lines read by ReadLine keep counting towards line numbers.
+func TestLoggerNumberedAfterReadLine(t *testing.T) {
+	file, err := daemonize.NewFileLogger(filepath.Join(t.TempDir(), "daemon.log"))
+	if err != nil {
+		t.Fatalf("NewFileLogger error: %v", err)
+	}
+	defer file.Close()
+	for name, logger := range map[string]daemonize.Logger{"memory": daemonize.NewMemoryLogger(), "file": file} {
+		t.Run(name, func(t *testing.T) {
+			fmt.Fprint(logger, "alpha\nbravo\ncharlie\n")
+			if _, err := logger.ReadLine(1); err != nil {
+				t.Fatalf("ReadLine error: %v", err)
+			}
+			fmt.Fprint(logger, "delta\n")
+			tests := []struct {
+				from, limit int64
+				want        string
+			}{
+				{0, 10, "[{1 alpha} {4 delta}]"},
+				{2, 10, "[{4 delta}]"},
+				{-1, 10, "[{4 delta}]"},
+				{5, 10, "[]"},
+			}
+			for _, tt := range tests {
+				got, _ := logger.PeekNumbered(tt.from, tt.limit)
+				if fmt.Sprint(got) != tt.want {
+					t.Errorf("PeekNumbered(%d, %d) = %v, want %s", tt.from, tt.limit, got, tt.want)
+				}
+			}
+			if got := logger.LastLineNumber(); got != 4 {
+				t.Errorf("LastLineNumber() = %d, want 4", got)
+			}
+			if got, err := logger.ReadNumbered(-1); err != nil || fmt.Sprint(got) != "[{4 delta}]" {
+				t.Errorf("ReadNumbered(-1) = %v, %v, want [{4 delta}]", got, err)
+			}
+			fmt.Fprint(logger, "echo\n")
+			if got, err := logger.ReadNumbered(0); err != nil || fmt.Sprint(got) != "[{1 alpha} {5 echo}]" {
+				t.Errorf("ReadNumbered(0) = %v, %v, want [{1 alpha} {5 echo}]", got, err)
+			}
+			fmt.Fprint(logger, "foxtrot\n")
+			if got := logger.FirstLineNumber(); got != 6 {
+				t.Errorf("FirstLineNumber() = %d, want 6", got)
+			}
+		})
+	}
+}
+
+// TestMemoryLoggerDropped verifies that lines evicted by an overflowing buffer are counted.
+func TestMemoryLoggerDropped(t *testing.T) {
+	// The memory logger keeps 1024 lines.
+	logger := daemonize.NewMemoryLogger()
+	dl, ok := logger.(interface{ Dropped() int64 })
+	if !ok {
+		t.Fatal("memory logger does not count dropped lines")
+	}
+	for i := range 1039 {
+		fmt.Fprintf(logger, "line %d\n", i+1)
+	}
+	if got := dl.Dropped(); got != 15 {
+		t.Errorf("Dropped() = %d, want 15", got)
+	}
+	// Lines read or cleared are not dropped.
+	if _, err := logger.ReadLine(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dl.Dropped(); got != 15 {
+		t.Errorf("after ReadLine and Clear Dropped() = %d, want 15", got)
+	}
+}
+
+// TestMemoryLoggerSnapshotWhileWriting verifies that snapshots taken during writes hold consecutive whole lines.
+func TestMemoryLoggerSnapshotWhileWriting(t *testing.T) {
+	logger := daemonize.NewMemoryLogger()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// More lines than the logger keeps, so that eviction runs too.
+		for i := range 5000 {
+			fmt.Fprintf(logger, "line %d\n", i+1)
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		lines, err := logger.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, line := range lines {
+			n, err := strconv.Atoi(strings.TrimPrefix(line, "line "))
+			if err != nil {
+				t.Fatalf("snapshot line %d = %q, want a whole line", i, line)
+			}
+			if i > 0 {
+				prev, _ := strconv.Atoi(strings.TrimPrefix(lines[i-1], "line "))
+				if n != prev+1 {
+					t.Fatalf("snapshot line %d = %q after %q, want consecutive lines", i, line, lines[i-1])
+				}
+			}
+		}
+	}
+	if lines, _ := logger.Snapshot(); len(lines) != 1024 || lines[1023] != "line 5000" {
+		t.Errorf("final snapshot has %d lines ending in %q, want 1024 ending in \"line 5000\"", len(lines), lines[len(lines)-1])
+	}
+}
@@ -0,0 +1,98 @@
+package daemonize
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WithMetricsAddr serves Prometheus metrics about the daemons at /metrics
+// on addr while the server runs. Metrics are not served by default.
+func WithMetricsAddr(addr string) Option {
+	return func(s *Server) {
+		s.metricsAddr = addr
+	}
+}
+
+// countRestart records that d was started to restart a daemon, for the
+// metrics and its RestartCount.
+func (s *Server) countRestart(d *Daemon) {
+	d.addRestart()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restarts == nil {
+		s.restarts = make(map[string]int64)
+	}
+	s.restarts[d.Name]++
+}
+
+// serveMetrics serves MetricsHandler on the metrics address, if one is set.
+func (s *Server) serveMetrics() {
+	if s.metricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	go func() {
+		if err := http.ListenAndServe(s.metricsAddr, mux); err != nil {
+			slog.Error("failed to serve metrics", slog.String("addr", s.metricsAddr), slog.Any("error", err))
+		}
+	}()
+}
+
+// MetricsHandler returns a handler writing the number of daemons by status,
+// the restart count and the uptime of each daemon and the bytes of log text
+// kept in the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts := map[DaemonStatus]int{
+			DaemonStatusStarting: 0,
+			DaemonStatusRunning:  0,
+			DaemonStatusStopped:  0,
+		}
+		uptimes := &strings.Builder{}
+		daemons := s.daemons()
+		for _, d := range daemons {
+			status, err := d.Status()
+			if err != nil {
+				slog.Debug("failed to get daemon status for metrics", slog.String("name", d.Name), slog.Any("error", err))
+				continue
+			}
+			counts[status]++
+			if status.active() {
+				fmt.Fprintf(uptimes, "daemonize_daemon_uptime_seconds{name=%s} %g\n", promLabel(d.Name), time.Since(d.StartedAt()).Seconds())
+			}
+		}
+		s.mu.Lock()
+		restarts := &strings.Builder{}
+		for _, d := range daemons {
+			fmt.Fprintf(restarts, "daemonize_daemon_restarts_total{name=%s} %d\n", promLabel(d.Name), s.restarts[d.Name])
+		}
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintln(w, "# HELP daemonize_daemons Number of daemons by status.")
+		fmt.Fprintln(w, "# TYPE daemonize_daemons gauge")
+		for _, status := range []DaemonStatus{DaemonStatusStarting, DaemonStatusRunning, DaemonStatusStopped} {
+			fmt.Fprintf(w, "daemonize_daemons{status=%s} %d\n", promLabel(string(status)), counts[status])
+		}
+		fmt.Fprintln(w, "# HELP daemonize_daemon_restarts_total Number of times a daemon was restarted.")
+		fmt.Fprintln(w, "# TYPE daemonize_daemon_restarts_total counter")
+		fmt.Fprint(w, restarts.String())
+		fmt.Fprintln(w, "# HELP daemonize_daemon_uptime_seconds Seconds since a running daemon was started.")
+		fmt.Fprintln(w, "# TYPE daemonize_daemon_uptime_seconds gauge")
+		fmt.Fprint(w, uptimes.String())
+		fmt.Fprintln(w, "# HELP daemonize_log_bytes Bytes of log text kept across daemons.")
+		fmt.Fprintln(w, "# TYPE daemonize_log_bytes gauge")
+		used, _ := s.LogBytes()
+		fmt.Fprintf(w, "daemonize_log_bytes %d\n", used)
+	})
+}
+
+// promLabel quotes a label value for the Prometheus text format.
+func promLabel(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
@@ -0,0 +1,62 @@
+package daemonize
+
+import "log/slog"
+
+// StateNotificationMethod is the method of the notification sent to every
+// client when a daemon starts or exits. The same transitions are POSTed to
+// the state webhook, if one is set.
+const StateNotificationMethod = "notifications/daemonize/state"
+
+// StateCrashed is reported in state notifications for a daemon that exited
+// with an error or within its MinUptime.
+const StateCrashed = "crashed"
+
+func (s *Server) notifyState(params map[string]any) {
+	s.mu.Lock()
+	ms := s.mcp
+	s.mu.Unlock()
+	if ms == nil {
+		return
+	}
+	ms.SendNotificationToAllClients(StateNotificationMethod, params)
+}
+
+// notifyStarted announces that d is running.
+func (s *Server) notifyStarted(d *Daemon) {
+	s.notifyState(map[string]any{
+		"name":   d.Name,
+		"status": DaemonStatusRunning,
+		"pid":    d.PID(),
+	})
+	s.postStateChange(d, StateChange{
+		Name:      d.Name,
+		OldStatus: string(DaemonStatusStopped),
+		NewStatus: string(DaemonStatusRunning),
+	})
+}
+
+// notifyExited announces how d exited. It is registered as an exit hook.
+func (s *Server) notifyExited(d *Daemon) {
+	record := d.exitRecord()
+	status := string(DaemonStatusStopped)
+	if record.Reason == ExitReasonFailed || record.Reason == ExitReasonEarlyExit {
+		status = StateCrashed
+	}
+	params := map[string]any{
+		"name":      d.Name,
+		"status":    status,
+		"reason":    record.Reason,
+		"exit_code": record.ExitCode,
+	}
+	if record.Signal != 0 {
+		params["signal"] = record.Signal.String()
+	}
+	slog.Debug("daemon state changed", slog.String("name", d.Name), slog.String("status", status))
+	s.notifyState(params)
+	s.postStateChange(d, StateChange{
+		Name:      d.Name,
+		OldStatus: string(DaemonStatusRunning),
+		NewStatus: status,
+		ExitCode:  &record.ExitCode,
+	})
+}
@@ -0,0 +1,650 @@
+package daemonize
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// ValidationError reports every problem found in the parameters of a tool
+// call, so that the caller can correct all of them at once.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// validator reads parameters from a tool call and collects the problems it
+// finds instead of stopping at the first one.
+type validator struct {
+	request  mcp.CallToolRequest
+	problems []string
+}
+
+func (v *validator) errorf(format string, args ...any) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) has(key string) bool {
+	_, ok := v.request.GetArguments()[key]
+	return ok
+}
+
+func (v *validator) requireString(key string) string {
+	if !v.has(key) {
+		v.errorf("%s required", key)
+		return ""
+	}
+	s, err := v.request.RequireString(key)
+	if err != nil {
+		v.errorf("%s must be a string", key)
+		return ""
+	}
+	if s == "" {
+		v.errorf("%s must not be empty", key)
+	}
+	return s
+}
+
+func (v *validator) optionalString(key string) string {
+	if !v.has(key) {
+		return ""
+	}
+	s, err := v.request.RequireString(key)
+	if err != nil {
+		v.errorf("%s must be a string", key)
+	}
+	return s
+}
+
+func (v *validator) requireStringSlice(key string) []string {
+	if !v.has(key) {
+		v.errorf("%s required", key)
+		return nil
+	}
+	ss := v.optionalStringSlice(key)
+	if ss != nil && len(ss) == 0 {
+		v.errorf("%s must not be empty", key)
+	}
+	return ss
+}
+
+func (v *validator) optionalStringSlice(key string) []string {
+	if !v.has(key) {
+		return nil
+	}
+	ss, err := v.request.RequireStringSlice(key)
+	if err != nil {
+		v.errorf("%s must be an array of strings", key)
+		return nil
+	}
+	return ss
+}
+
+// daemonNamePattern matches the names accepted for new daemons. Names are
+// used in resource URIs, so they are kept to a safe character set.
+var daemonNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// daemonName returns the name of a new daemon stored at key.
+func (v *validator) daemonName(key string) string {
+	name := v.requireString(key)
+	if name != "" && !daemonNamePattern.MatchString(name) {
+		v.errorf("%s must contain only letters, digits, '_', '.' and '-'", key)
+	}
+	return name
+}
+
+// command returns the argv given by either the command array or the
+// command_line string, which is run by /bin/sh.
+func (v *validator) command() []string {
+	switch hasCommand, hasLine := v.has("command"), v.has("command_line"); {
+	case hasCommand && hasLine:
+		v.errorf("only one of command or command_line allowed")
+		return nil
+	case hasLine:
+		if line := v.requireString("command_line"); line != "" {
+			if v.optionalBool("login_shell") {
+				// A login shell sources the profile, e.g. for nvm or rbenv.
+				return []string{"bash", "-lc", line}
+			}
+			return []string{"/bin/sh", "-c", line}
+		}
+		return nil
+	case hasCommand:
+		if v.optionalBool("login_shell") {
+			v.errorf("login_shell requires command_line instead of command")
+		}
+		return v.requireStringSlice("command")
+	default:
+		v.errorf("command or command_line required")
+		return nil
+	}
+}
+
+// optionalEnv returns the KEY=value strings stored at key.
+func (v *validator) optionalEnv(key string) []string {
+	env := v.optionalStringSlice(key)
+	for _, kv := range env {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			v.errorf("%s entry %q must be in KEY=value form", key, kv)
+		}
+	}
+	return env
+}
+
+// optionalSignals returns the signals named in the array stored at key.
+func (v *validator) optionalSignals(key string) []syscall.Signal {
+	names := v.optionalStringSlice(key)
+	if names == nil {
+		return nil
+	}
+	sigs := make([]syscall.Signal, 0, len(names))
+	for _, name := range names {
+		sig, ok := parseSignal(name)
+		if !ok {
+			v.errorf("%s entry %s is not supported; see daemonize_signals", key, name)
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+func (v *validator) requireNumber(key string) float64 {
+	if !v.has(key) {
+		v.errorf("%s required", key)
+		return 0
+	}
+	return v.optionalNumber(key)
+}
+
+// optionalNumber returns the non-negative number stored at key, or zero when
+// it is absent. Every numeric parameter of the tools is a count, size or
+// duration, so negative values are reported as problems.
+func (v *validator) optionalNumber(key string) float64 {
+	if !v.has(key) {
+		return 0
+	}
+	f, err := v.request.RequireFloat(key)
+	if err != nil {
+		v.errorf("%s must be a number", key)
+		return 0
+	}
+	if f < 0 {
+		v.errorf("%s must be non-negative", key)
+		return 0
+	}
+	return f
+}
+
+// optionalInt returns the integer stored at key, or zero when it is absent.
+// Unlike optionalNumber it accepts negative values.
+func (v *validator) optionalInt(key string) int {
+	if !v.has(key) {
+		return 0
+	}
+	i, err := v.request.RequireInt(key)
+	if err != nil {
+		v.errorf("%s must be an integer", key)
+	}
+	return i
+}
+
+func (v *validator) optionalSeconds(key string) time.Duration {
+	return time.Duration(v.optionalNumber(key) * float64(time.Second))
+}
+
+func (v *validator) optionalBool(key string) bool {
+	if !v.has(key) {
+		return false
+	}
+	b, err := v.request.RequireBool(key)
+	if err != nil {
+		v.errorf("%s must be a boolean", key)
+	}
+	return b
+}
+
+func (v *validator) optionalFormat(key string) OutputFormat {
+	switch f := OutputFormat(v.optionalString(key)); f {
+	case "", OutputFormatText:
+		return OutputFormatText
+	case OutputFormatJSON:
+		return f
+	default:
+		v.errorf("%s must be %q or %q", key, OutputFormatText, OutputFormatJSON)
+		return OutputFormatText
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// invalidParams is the tool result for parameters rejected by a validator.
+func invalidParams(err error) *mcp.CallToolResult {
+	return mcp.NewToolResultErrorFromErr("invalid parameters", err)
+}
+
+// nameParams are the parameters of the tools that only take a daemon name.
+type nameParams struct {
+	Name string
+}
+
+func parseNameParams(request mcp.CallToolRequest) (nameParams, error) {
+	v := &validator{request: request}
+	p := nameParams{Name: v.requireString("name")}
+	return p, v.err()
+}
+
+// stopParams are the parameters of daemonize_stop. A zero Timeout leaves
+// the stop timeout of the daemon in effect.
+type stopParams struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func parseStopParams(request mcp.CallToolRequest) (stopParams, error) {
+	v := &validator{request: request}
+	p := stopParams{
+		Name:    v.requireString("name"),
+		Timeout: v.optionalSeconds("timeout_seconds"),
+	}
+	return p, v.err()
+}
+
+type startParams struct {
+	Name           string
+	Command        []string
+	Workdir        string
+	Env            []string
+	EnvFile        string
+	StripANSI      bool
+	TagStderr      bool
+	ReadyTCP       string
+	ReadyLog       *regexp.Regexp
+	ReadyNotify    bool
+	ReadyTimeout   time.Duration
+	StartTimeout   time.Duration
+	HealthCheck    []string
+	HealthInterval time.Duration
+	HealthRetries  int
+	MinUptime      time.Duration
+	StartGrace     time.Duration
+	MaxRuntime     time.Duration
+	MaxMemoryBytes int64
+	MaxOpenFiles   int64
+	MaxCPUSeconds  int64
+	MaxProcesses   int64
+	Umask          string
+	StopSignals    []syscall.Signal
+	StopTimeout    time.Duration
+	Detached       bool
+	Nice           int
+	CPUs           string
+	User           string
+	Group          string
+	AutoRestart    bool
+	DependsOn      []string
+	StateWebhook   string
+	DryRun         bool
+	Background     bool
+	// Logfile is the absolute path of the file the output is written to,
+	// or empty to keep it in memory.
+	Logfile string
+	// ParentDeathSignal is 0 unless parent_death_signal is given.
+	ParentDeathSignal syscall.Signal
+}
+
+func parseStartParams(request mcp.CallToolRequest) (startParams, error) {
+	v := &validator{request: request}
+	p := startParams{
+		Name:           v.daemonName("name"),
+		Command:        v.command(),
+		Workdir:        v.requireString("workdir"),
+		Env:            v.optionalEnv("env"),
+		EnvFile:        v.optionalString("env_file"),
+		StripANSI:      v.optionalBool("strip_ansi"),
+		TagStderr:      v.optionalBool("tag_stderr"),
+		ReadyTCP:       v.optionalString("ready_tcp"),
+		ReadyNotify:    v.optionalBool("ready_notify"),
+		ReadyTimeout:   v.optionalSeconds("ready_timeout_seconds"),
+		StartTimeout:   v.optionalSeconds("start_timeout_seconds"),
+		HealthCheck:    v.optionalStringSlice("health_check"),
+		HealthInterval: v.optionalSeconds("health_interval_seconds"),
+		HealthRetries:  int(v.optionalNumber("health_retries")),
+		MinUptime:      v.optionalSeconds("min_uptime_seconds"),
+		StartGrace:     v.optionalSeconds("start_grace_seconds"),
+		MaxRuntime:     v.optionalSeconds("max_runtime_seconds"),
+		MaxMemoryBytes: int64(v.optionalNumber("max_memory_bytes")),
+		MaxOpenFiles:   int64(v.optionalNumber("max_open_files")),
+		MaxCPUSeconds:  int64(v.optionalNumber("max_cpu_seconds")),
+		MaxProcesses:   int64(v.optionalNumber("max_processes")),
+		Umask:          v.optionalString("umask"),
+		StopSignals:    v.optionalSignals("stop_signals"),
+		StopTimeout:    v.optionalSeconds("stop_timeout_seconds"),
+		Detached:       v.optionalBool("detached"),
+		Nice:           v.optionalInt("nice"),
+		CPUs:           v.optionalString("cpus"),
+		User:           v.optionalString("user"),
+		Group:          v.optionalString("group"),
+		AutoRestart:    v.optionalBool("auto_restart"),
+		DependsOn:      v.optionalStringSlice("depends_on"),
+		StateWebhook:   v.optionalString("state_webhook"),
+		DryRun:         v.optionalBool("dry_run"),
+		Background:     v.optionalBool("background"),
+		Logfile:        v.optionalString("logfile"),
+	}
+	if slices.Contains(p.DependsOn, p.Name) && p.Name != "" {
+		v.errorf("depends_on must not contain the daemon itself")
+	}
+	if p.Workdir != "" && !filepath.IsAbs(p.Workdir) {
+		v.errorf("workdir must be absolute")
+	}
+	if pattern := v.optionalString("ready_log"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.errorf("ready_log must be a valid regular expression: %v", err)
+		}
+		p.ReadyLog = re
+	}
+	if p.Umask != "" && !validUmask(p.Umask) {
+		v.errorf("umask must be an octal number between 000 and 777")
+	}
+	if p.Nice < MinNice || p.Nice > MaxNice {
+		v.errorf("nice must be between %d and %d", MinNice, MaxNice)
+	}
+	if name := v.optionalString("parent_death_signal"); name != "" {
+		sig, ok := parseSignal(name)
+		if !ok {
+			v.errorf("parent_death_signal %s is not supported; see daemonize_signals", name)
+		}
+		p.ParentDeathSignal = sig
+	}
+	if p.CPUs != "" {
+		if _, err := parseCPUList(p.CPUs); err != nil {
+			v.errorf("%v", err)
+		}
+	}
+	if p.StateWebhook != "" && !validWebhookURL(p.StateWebhook) {
+		v.errorf("state_webhook must be an http or https URL")
+	}
+	if p.EnvFile != "" && !filepath.IsAbs(p.EnvFile) {
+		v.errorf("env_file must be absolute")
+	}
+	if p.Logfile != "" && !filepath.IsAbs(p.Logfile) {
+		// A relative logfile is meant relative to workdir, not to the
+		// working directory of the server.
+		switch {
+		case strings.HasPrefix(p.Logfile, "~"):
+			v.errorf("logfile must not start with ~; use an absolute path")
+		case !filepath.IsLocal(p.Logfile):
+			v.errorf("a relative logfile must stay within workdir; use an absolute path")
+		case p.Workdir != "" && filepath.IsAbs(p.Workdir):
+			p.Logfile = filepath.Join(p.Workdir, p.Logfile)
+		}
+	}
+	return p, v.err()
+}
+
+// updateParams are the parameters of daemonize_update. Nil Command and Env
+// and an empty Workdir leave the daemon unchanged; SetEnv distinguishes an
+// empty env, which clears it, from an absent one.
+type updateParams struct {
+	Name    string
+	Command []string
+	Workdir string
+	Env     []string
+	SetEnv  bool
+}
+
+func parseUpdateParams(request mcp.CallToolRequest) (updateParams, error) {
+	v := &validator{request: request}
+	p := updateParams{
+		Name:    v.requireString("name"),
+		Workdir: v.optionalString("workdir"),
+		Env:     v.optionalEnv("env"),
+		SetEnv:  v.has("env"),
+	}
+	if v.has("command") || v.has("command_line") {
+		p.Command = v.command()
+	}
+	if p.Workdir != "" && !filepath.IsAbs(p.Workdir) {
+		v.errorf("workdir must be absolute")
+	}
+	if p.Command == nil && p.Workdir == "" && !p.SetEnv && len(v.problems) == 0 {
+		v.errorf("at least one of command, workdir or env required")
+	}
+	return p, v.err()
+}
+
+type restartParams struct {
+	Name  string
+	Delay time.Duration
+}
+
+func parseRestartParams(request mcp.CallToolRequest) (restartParams, error) {
+	v := &validator{request: request}
+	p := restartParams{
+		Name:  v.requireString("name"),
+		Delay: v.optionalSeconds("restart_delay_seconds"),
+	}
+	return p, v.err()
+}
+
+type signalParams struct {
+	Name   string
+	Signal syscall.Signal
+}
+
+func parseSignalParams(request mcp.CallToolRequest) (signalParams, error) {
+	v := &validator{request: request}
+	p := signalParams{Name: v.requireString("name")}
+	if name := v.requireString("signal"); name != "" {
+		sig, ok := parseSignal(name)
+		if !ok {
+			v.errorf("signal %s is not supported; see daemonize_signals", name)
+		}
+		p.Signal = sig
+	}
+	return p, v.err()
+}
+
+type runParams struct {
+	Command []string
+	Workdir string
+	Timeout time.Duration
+}
+
+func parseRunParams(request mcp.CallToolRequest) (runParams, error) {
+	v := &validator{request: request}
+	p := runParams{
+		Command: v.command(),
+		Workdir: v.requireString("workdir"),
+		Timeout: v.optionalSeconds("timeout_seconds"),
+	}
+	if p.Workdir != "" && !filepath.IsAbs(p.Workdir) {
+		v.errorf("workdir must be absolute")
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultRunTimeout
+	}
+	return p, v.err()
+}
+
+type execParams struct {
+	Name    string
+	Command []string
+	Timeout time.Duration
+}
+
+func parseExecParams(request mcp.CallToolRequest) (execParams, error) {
+	v := &validator{request: request}
+	p := execParams{
+		Name:    v.requireString("name"),
+		Command: v.command(),
+		Timeout: v.optionalSeconds("timeout_seconds"),
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultRunTimeout
+	}
+	return p, v.err()
+}
+
+type listParams struct {
+	Format OutputFormat
+}
+
+func parseListParams(request mcp.CallToolRequest) (listParams, error) {
+	v := &validator{request: request}
+	p := listParams{Format: v.optionalFormat("format")}
+	return p, v.err()
+}
+
+type logsParams struct {
+	Name    string
+	Tail    int64
+	Pattern *regexp.Regexp
+	Head    bool
+	Format  OutputFormat
+	// Window is set when offset or limit select the lines instead of tail.
+	Window bool
+	Offset int64
+	Limit  int64
+	// ByteWindow is set when byte_offset or byte_limit select raw bytes
+	// instead of lines.
+	ByteWindow bool
+	ByteOffset int64
+	ByteLimit  int64
+}
+
+// defaultLogsLimit is the number of lines returned by daemonize_logs when
+// only offset is given.
+const defaultLogsLimit = 100
+
+// defaultLogsByteLimit is the number of bytes returned by daemonize_logs
+// when only byte_offset is given.
+const defaultLogsByteLimit = 4096
+
+func parseLogsParams(request mcp.CallToolRequest) (logsParams, error) {
+	v := &validator{request: request}
+	p := logsParams{
+		Name:   v.requireString("name"),
+		Head:   v.optionalBool("head"),
+		Format: v.optionalFormat("format"),
+		Window: v.has("offset") || v.has("limit"),
+		Offset: int64(v.optionalNumber("offset")),
+		Limit:  int64(v.optionalNumber("limit")),
+
+		ByteWindow: v.has("byte_offset") || v.has("byte_limit"),
+		ByteOffset: int64(v.optionalNumber("byte_offset")),
+		ByteLimit:  int64(v.optionalNumber("byte_limit")),
+	}
+	switch {
+	case p.ByteWindow:
+		for _, key := range []string{"tail", "offset", "limit", "pattern", "head"} {
+			if v.has(key) {
+				v.errorf("%s cannot be combined with byte_offset or byte_limit", key)
+			}
+		}
+		if !v.has("byte_limit") {
+			p.ByteLimit = defaultLogsByteLimit
+		}
+	case p.Window:
+		if v.has("tail") {
+			v.errorf("tail cannot be combined with offset or limit")
+		}
+		if !v.has("limit") {
+			p.Limit = defaultLogsLimit
+		}
+	default:
+		p.Tail = int64(v.requireNumber("tail"))
+	}
+	if pattern := v.optionalString("pattern"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.errorf("pattern must be a valid regular expression: %v", err)
+		}
+		p.Pattern = re
+	}
+	return p, v.err()
+}
+
+type logsAllParams struct {
+	Tail   int64
+	Format OutputFormat
+}
+
+// defaultLogsAllTail is the number of lines returned by daemonize_logs_all
+// when tail is not given.
+const defaultLogsAllTail = 100
+
+func parseLogsAllParams(request mcp.CallToolRequest) (logsAllParams, error) {
+	v := &validator{request: request}
+	p := logsAllParams{
+		Tail:   int64(v.optionalNumber("tail")),
+		Format: v.optionalFormat("format"),
+	}
+	if !v.has("tail") {
+		p.Tail = defaultLogsAllTail
+	}
+	if p.Tail < 0 {
+		v.errorf("tail must not be negative")
+	}
+	return p, v.err()
+}
+
+type watchParams struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func parseWatchParams(request mcp.CallToolRequest) (watchParams, error) {
+	v := &validator{request: request}
+	p := watchParams{
+		Name:    v.requireString("name"),
+		Timeout: time.Duration(v.requireNumber("timeout_seconds") * float64(time.Second)),
+	}
+	return p, v.err()
+}
+
+type followParams struct {
+	Name     string
+	Duration time.Duration
+}
+
+func parseFollowParams(request mcp.CallToolRequest) (followParams, error) {
+	v := &validator{request: request}
+	p := followParams{
+		Name:     v.requireString("name"),
+		Duration: time.Duration(v.requireNumber("duration_seconds") * float64(time.Second)),
+	}
+	return p, v.err()
+}
+
+type tailFollowParams struct {
+	Name     string
+	Duration time.Duration
+	MaxLines int64
+}
+
+func parseTailFollowParams(request mcp.CallToolRequest) (tailFollowParams, error) {
+	v := &validator{request: request}
+	p := tailFollowParams{
+		Name:     v.requireString("name"),
+		Duration: time.Duration(v.requireNumber("duration_seconds") * float64(time.Second)),
+		MaxLines: int64(v.optionalNumber("max_lines")),
+	}
+	return p, v.err()
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package daemonize
+
+import "syscall"
+
+// setParentDeathSignal makes the kernel send sig to the daemon when the
+// thread that launched it exits. The runtime only ends threads locked by
+// LockOSThread, which the server never launches daemons from, so this is when
+// the server dies.
+func setParentDeathSignal(attr *syscall.SysProcAttr, sig syscall.Signal) {
+	attr.Pdeathsig = sig
+}
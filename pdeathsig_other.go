@@ -0,0 +1,8 @@
+//go:build !linux
+
+package daemonize
+
+import "syscall"
+
+// The parent death signal is only supported on Linux.
+func setParentDeathSignal(attr *syscall.SysProcAttr, sig syscall.Signal) {}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package daemonize
+
+import "syscall"
+
+// setProcessGroup makes the daemon lead a process group of its own, so that
+// it is signalled together with its descendants.
+func setProcessGroup(attr *syscall.SysProcAttr) {
+	attr.Setpgid = true
+}
+
+// getpgid looks up the process group of pid. Tests replace it to exercise
+// the fallback for platforms without process groups.
+var getpgid = syscall.Getpgid
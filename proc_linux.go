@@ -0,0 +1,191 @@
+//go:build linux
+
+package daemonize
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// groupProcesses returns the live members of the process group pgid ordered
+// leaves first, so that children come before their parents.
+func groupProcesses(pgid int) ([]int, error) {
+	procs, err := processTable()
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]int)
+	for pid, p := range procs {
+		if p.pgrp == pgid {
+			parents[pid] = p.ppid
+		}
+	}
+	return leavesFirst(parents), nil
+}
+
+// descendantProcesses returns the live descendants of pid ordered leaves
+// first, without pid itself.
+func descendantProcesses(pid int) ([]int, error) {
+	procs, err := processTable()
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]int)
+	for child, p := range procs {
+		// Walk up the ancestors, bounded in case of a cycle from pid reuse.
+		for ppid, n := p.ppid, 0; ppid > 0 && n < len(procs); ppid, n = procs[ppid].ppid, n+1 {
+			if ppid == pid {
+				parents[child] = p.ppid
+				break
+			}
+		}
+	}
+	return leavesFirst(parents), nil
+}
+
+type procEntry struct {
+	ppid int
+	pgrp int
+}
+
+// processTable returns the parent and process group of every live process.
+func processTable() (map[int]procEntry, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("read /proc: %w", err)
+	}
+	procs := make(map[int]procEntry)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			// the process exited while scanning
+			continue
+		}
+		// pid (comm) state ppid pgrp ...; comm may contain spaces and parens.
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		fields := bytes.Fields(stat[i+1:])
+		if len(fields) < 3 || string(fields[0]) == "Z" {
+			continue
+		}
+		ppid, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			continue
+		}
+		pgrp, err := strconv.Atoi(string(fields[2]))
+		if err != nil {
+			continue
+		}
+		procs[pid] = procEntry{ppid: ppid, pgrp: pgrp}
+	}
+	return procs, nil
+}
+
+// leavesFirst orders the pids of parents, which maps them to their parent,
+// so that children come before their parents.
+func leavesFirst(parents map[int]int) []int {
+	depths := make(map[int]int, len(parents))
+	for pid := range parents {
+		depth := 0
+		for p, ok := parents[pid]; ok && depth < len(parents); p, ok = parents[p] {
+			depth++
+		}
+		depths[pid] = depth
+	}
+	pids := make([]int, 0, len(parents))
+	for pid := range parents {
+		pids = append(pids, pid)
+	}
+	slices.SortFunc(pids, func(a, b int) int {
+		return depths[b] - depths[a]
+	})
+	return pids
+}
+
+// clockTicks is the kernel USER_HZ, which is 100 on all supported Linux
+// architectures.
+const clockTicks = 100
+
+// processStats samples the resident memory and the average CPU usage since
+// start of the process pid.
+func processStats(pid int) (ProcessStats, error) {
+	dir := "/proc/" + strconv.Itoa(pid)
+	statm, err := os.ReadFile(dir + "/statm")
+	if err != nil {
+		return ProcessStats{}, err
+	}
+	fields := bytes.Fields(statm)
+	if len(fields) < 2 {
+		return ProcessStats{}, fmt.Errorf("malformed %s/statm", dir)
+	}
+	pages, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return ProcessStats{}, fmt.Errorf("parse %s/statm: %w", dir, err)
+	}
+
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return ProcessStats{}, err
+	}
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return ProcessStats{}, fmt.Errorf("malformed %s/stat", dir)
+	}
+	// Fields after comm start at state (field 3); utime, stime, num_threads
+	// and starttime are fields 14, 15, 20 and 22.
+	fields = bytes.Fields(stat[i+1:])
+	if len(fields) < 20 {
+		return ProcessStats{}, fmt.Errorf("malformed %s/stat", dir)
+	}
+	var ticks [3]float64
+	for j, k := range []int{11, 12, 19} {
+		v, err := strconv.ParseFloat(string(fields[k]), 64)
+		if err != nil {
+			return ProcessStats{}, fmt.Errorf("parse %s/stat: %w", dir, err)
+		}
+		ticks[j] = v
+	}
+	uptime, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return ProcessStats{}, err
+	}
+	up, err := strconv.ParseFloat(string(bytes.Fields(uptime)[0]), 64)
+	if err != nil {
+		return ProcessStats{}, fmt.Errorf("parse /proc/uptime: %w", err)
+	}
+
+	threads, err := strconv.Atoi(string(fields[17]))
+	if err != nil {
+		return ProcessStats{}, fmt.Errorf("parse %s/stat: %w", dir, err)
+	}
+
+	stats := ProcessStats{RSS: pages * int64(os.Getpagesize()), Threads: threads}
+	if elapsed := up - ticks[2]/clockTicks; elapsed > 0 {
+		stats.CPUPercent = (ticks[0] + ticks[1]) / clockTicks / elapsed * 100
+	}
+	return stats, nil
+}
+
+// processEnviron returns the environment the process pid was executed with.
+func processEnviron(pid int) ([]string, error) {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ")
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	for kv := range bytes.SplitSeq(b, []byte{0}) {
+		if len(kv) > 0 {
+			env = append(env, string(kv))
+		}
+	}
+	return env, nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package daemonize
+
+import "errors"
+
+// groupProcesses is only supported on Linux; callers fall back to signalling
+// the whole process group.
+func groupProcesses(pgid int) ([]int, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func descendantProcesses(pid int) ([]int, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func processStats(pid int) (ProcessStats, error) {
+	return ProcessStats{}, errors.ErrUnsupported
+}
+
+func processEnviron(pid int) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,56 @@
+package daemonize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// logsResourceURI is the URI of the resource holding the logs of the named
+// daemon.
+func logsResourceURI(name string) string {
+	return "daemon://" + name + "/logs"
+}
+
+// addLogsResource exposes the logs of the named daemon as a resource of ms.
+func (s *Server) addLogsResource(ms *server.MCPServer, name string) {
+	resource := mcp.NewResource(logsResourceURI(name), name+" logs",
+		mcp.WithResourceDescription(fmt.Sprintf("Unread log lines of daemon %s", name)),
+		mcp.WithMIMEType("text/plain"),
+	)
+	ms.AddResource(resource, func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		return s.readLogsResource(name)
+	})
+}
+
+// readLogsResource returns the unread lines of the named daemon, like
+// daemonize_logs without a tail limit, also after the daemon was removed.
+func (s *Server) readLogsResource(name string) ([]mcp.ResourceContents, error) {
+	logger, ok := s.logger(name)
+	if !ok {
+		return nil, fmt.Errorf("daemon %s not found", name)
+	}
+	lines, err := logger.ReadLine(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read logs of daemon %s: %w", name, err)
+	}
+	for i, line := range lines {
+		lines[i] = s.displayLine(name, line)
+	}
+	text := ""
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n") + "\n"
+	}
+	return []mcp.ResourceContents{
+		mcp.TextResourceContents{
+			URI:      logsResourceURI(name),
+			MIMEType: "text/plain",
+			Text:     text,
+		},
+	}, nil
+}
@@ -0,0 +1,97 @@
+package daemonize
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	// InitialRestartBackoff is the delay before the first automatic restart
+	// of a crashed daemon. It doubles with every consecutive crash up to
+	// MaxRestartBackoff.
+	InitialRestartBackoff = time.Second
+	MaxRestartBackoff     = time.Minute
+	// RestartBackoffReset is how long a daemon must stay up for the backoff
+	// to start over from InitialRestartBackoff.
+	RestartBackoffReset = time.Minute
+)
+
+// Clock tells the time and waits for timeouts, so that tests can replace it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock replaces the clock used to schedule automatic restarts.
+func WithClock(c Clock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// nextBackoff returns the delay before restarting a daemon that crashed
+// after running for uptime, when prev was the delay before its last start.
+func nextBackoff(prev, uptime time.Duration) time.Duration {
+	if prev == 0 || uptime >= RestartBackoffReset {
+		return InitialRestartBackoff
+	}
+	return min(prev*2, MaxRestartBackoff)
+}
+
+// NextRestart returns when the daemon is going to be restarted, or the zero
+// time when no restart is pending.
+func (d *Daemon) NextRestart() time.Time {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.nextRestart
+}
+
+// autoRestart schedules a restart of d if it is an AutoRestart daemon that
+// exited without being stopped. It is registered as an exit hook.
+func (s *Server) autoRestart(d *Daemon) {
+	if !d.AutoRestart || d.stopRequested.Load() || s.ctx.Err() != nil {
+		return
+	}
+	d.stateMu.Lock()
+	backoff := nextBackoff(d.backoff, d.exitedAt.Sub(d.startedAt))
+	d.backoff = backoff
+	d.nextRestart = s.clock.Now().Add(backoff)
+	d.stateMu.Unlock()
+	slog.Info("daemon restart scheduled", slog.String("name", d.Name), slog.Duration("backoff", backoff))
+
+	go func() {
+		select {
+		case <-s.clock.After(backoff):
+		case <-s.ctx.Done():
+			slog.Info("daemon restart cancelled by shutdown", slog.String("name", d.Name))
+			d.stateMu.Lock()
+			d.nextRestart = time.Time{}
+			d.stateMu.Unlock()
+			return
+		}
+		// The daemon may have been stopped, removed or replaced meanwhile.
+		if current, ok := s.daemon(d.Name); !ok || current != d || d.stopRequested.Load() {
+			return
+		}
+		// Start may have relaunched it within its grace period.
+		if status, err := d.Status(); err == nil && status.active() {
+			return
+		}
+		next := d.clone()
+		next.backoff = backoff
+		// A restart launched while the server shuts down is stopped again.
+		if err := next.Start(s.ctx); err != nil {
+			slog.Error("failed to restart daemon", slog.String("name", d.Name), slog.Any("error", err))
+			s.autoRestart(d)
+			return
+		}
+		s.notifyStarted(next)
+		s.addDaemon(next)
+		s.countRestart(next)
+	}()
+}
@@ -0,0 +1,110 @@
+package daemonize
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// notifySocketEnv names the socket of the sd_notify protocol.
+const notifySocketEnv = "NOTIFY_SOCKET"
+
+// notifySystemd sends state to the service manager of the server over the
+// sd_notify protocol. It does nothing unless the server was given a notify
+// socket, as systemd does for services with Type=notify.
+func notifySystemd(state string) error {
+	path := os.Getenv(notifySocketEnv)
+	if path == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// withoutNotifySocket removes NOTIFY_SOCKET from env. The notify socket of
+// the server belongs to its service manager and is not passed to daemons.
+func withoutNotifySocket(env []string) []string {
+	return slices.DeleteFunc(env, func(kv string) bool {
+		return strings.HasPrefix(kv, notifySocketEnv+"=")
+	})
+}
+
+// notifyListener is a notify socket set up for a daemon with ReadyNotify.
+type notifyListener struct {
+	dir   string
+	conn  *net.UnixConn
+	ready chan struct{}
+}
+
+// listenNotify creates a notify socket in a new temporary directory and
+// watches it for READY=1.
+func (d *Daemon) listenNotify() (*notifyListener, error) {
+	dir, err := os.MkdirTemp("", "daemonize-notify-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if d.User != "" || d.Group != "" {
+		// The daemon runs as another user, who must be able to reach the socket.
+		if err := os.Chmod(dir, 0o711); err == nil {
+			err = os.Chmod(path, 0o666)
+		}
+		if err != nil {
+			conn.Close()
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	l := &notifyListener{dir: dir, conn: conn, ready: make(chan struct{})}
+	go l.watch(d.Name)
+	return l, nil
+}
+
+func (l *notifyListener) path() string {
+	return filepath.Join(l.dir, "notify.sock")
+}
+
+// watch closes ready on the first message with a READY=1 line.
+func (l *notifyListener) watch(name string) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := l.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			if string(line) == "READY=1" {
+				slog.Debug("daemon notified readiness", slog.String("name", name))
+				close(l.ready)
+				return
+			}
+		}
+	}
+}
+
+// Close stops watching and removes the socket.
+func (l *notifyListener) Close() error {
+	err := l.conn.Close()
+	if rerr := os.RemoveAll(l.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
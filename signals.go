@@ -0,0 +1,72 @@
+package daemonize
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// supportedSignals are the signals accepted by daemonize_signal.
+var supportedSignals = []struct {
+	name string
+	sig  syscall.Signal
+}{
+	{"SIGHUP", syscall.SIGHUP},
+	{"SIGINT", syscall.SIGINT},
+	{"SIGQUIT", syscall.SIGQUIT},
+	{"SIGKILL", syscall.SIGKILL},
+	{"SIGUSR1", syscall.SIGUSR1},
+	{"SIGUSR2", syscall.SIGUSR2},
+	{"SIGTERM", syscall.SIGTERM},
+	{"SIGCONT", syscall.SIGCONT},
+	{"SIGSTOP", syscall.SIGSTOP},
+	{"SIGTSTP", syscall.SIGTSTP},
+	{"SIGWINCH", syscall.SIGWINCH},
+}
+
+// signalName returns the name of sig such as SIGTERM.
+func signalName(sig syscall.Signal) string {
+	for _, ss := range supportedSignals {
+		if ss.sig == sig {
+			return ss.name
+		}
+	}
+	return sig.String()
+}
+
+// parseSignal looks up a supported signal by name, with or without the SIG
+// prefix and in any case, or by number.
+func parseSignal(s string) (syscall.Signal, bool) {
+	if n, err := strconv.Atoi(s); err == nil {
+		for _, ss := range supportedSignals {
+			if int(ss.sig) == n {
+				return ss.sig, true
+			}
+		}
+		return 0, false
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for _, ss := range supportedSignals {
+		if ss.name == name {
+			return ss.sig, true
+		}
+	}
+	return 0, false
+}
+
+// Signal sends sig to the process group of the daemon.
+func (d *Daemon) Signal(sig syscall.Signal) error {
+	select {
+	case <-d.doneCh():
+		return ErrDaemonNotRunning
+	default:
+	}
+	target, err := d.target()
+	if err != nil {
+		return err
+	}
+	return d.signal(target, sig)
+}
@@ -0,0 +1,53 @@
+package daemonize
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// ProcessStats is a resource usage sample of a daemon. RSS is the resident
+// memory in bytes, CPUPercent the average CPU usage since the processes
+// started and Threads the number of threads, all summed over the process
+// group.
+type ProcessStats struct {
+	RSS        int64
+	CPUPercent float64
+	Threads    int
+}
+
+// Stats samples the resource usage of the daemon's process group. It is only
+// supported on Linux and returns errors.ErrUnsupported elsewhere.
+func (d *Daemon) Stats() (ProcessStats, error) {
+	pid := d.PID()
+	if pid < 0 {
+		return ProcessStats{}, ErrDaemonNotRunning
+	}
+	pgid, err := getpgid(pid)
+	if err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return ProcessStats{}, ErrDaemonNotRunning
+		}
+		return ProcessStats{}, fmt.Errorf("pgid: %w", err)
+	}
+	pids, err := groupProcesses(pgid)
+	if err != nil {
+		return ProcessStats{}, err
+	}
+	var total ProcessStats
+	for _, pid := range pids {
+		stats, err := processStats(pid)
+		if err != nil {
+			// the process exited while sampling
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ESRCH) {
+				continue
+			}
+			return ProcessStats{}, err
+		}
+		total.RSS += stats.RSS
+		total.CPUPercent += stats.CPUPercent
+		total.Threads += stats.Threads
+	}
+	return total, nil
+}
@@ -0,0 +1,92 @@
+package daemonize
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// subscriptionKey identifies a log subscription of a client session.
+type subscriptionKey struct {
+	session string
+	name    string
+}
+
+func subscriptionKeyFromContext(ctx context.Context, name string) subscriptionKey {
+	key := subscriptionKey{name: name}
+	if session := server.ClientSessionFromContext(ctx); session != nil {
+		key.session = session.SessionID()
+	}
+	return key
+}
+
+func (s *Server) unsubscribe(key subscriptionKey) bool {
+	s.mu.Lock()
+	cancel, ok := s.subscriptions[key]
+	delete(s.subscriptions, key)
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (s *Server) handleSubscribeLogs(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	ms := server.ServerFromContext(ctx)
+	if ms == nil {
+		return mcp.NewToolResultError("notifications are not available for this session"), nil
+	}
+
+	key := subscriptionKeyFromContext(ctx, name)
+	s.mu.Lock()
+	if _, ok := s.subscriptions[key]; ok {
+		s.mu.Unlock()
+		return mcp.NewToolResultText("Already subscribed"), nil
+	}
+	lines, cancel := daemon.logger().Subscribe()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[subscriptionKey]func())
+	}
+	s.subscriptions[key] = cancel
+	s.mu.Unlock()
+
+	// The subscription outlives this request.
+	nctx := context.WithoutCancel(ctx)
+	go func() {
+		for line := range lines {
+			err := ms.SendNotificationToClient(nctx, "notifications/message", map[string]any{
+				"level":  mcp.LoggingLevelInfo,
+				"logger": name,
+				"data":   line,
+			})
+			if err != nil {
+				slog.DebugContext(nctx, "failed to push log line", slog.String("name", name), slog.Any("error", err))
+			}
+		}
+	}()
+	return mcp.NewToolResultText("Subscribed to logs"), nil
+}
+
+func (s *Server) handleUnsubscribeLogs(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	if !s.unsubscribe(subscriptionKeyFromContext(ctx, name)) {
+		return mcp.NewToolResultError(fmt.Sprintf("not subscribed to logs of daemon %s", name)), nil
+	}
+	return mcp.NewToolResultText("Unsubscribed from logs"), nil
+}
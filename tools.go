@@ -0,0 +1,1511 @@
+package daemonize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Tools returns the MCP tools served by s.
+func (s *Server) Tools() []server.ServerTool {
+	startTool := mcp.NewTool("daemonize_start",
+		mcp.WithDescription("Start a daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon; letters, digits, '_', '.' and '-' only"),
+		),
+		mcp.WithArray("command",
+			mcp.Description("Command to run as an argv array; preferred over command_line"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithString("command_line",
+			mcp.Description("Command line run by /bin/sh -c, e.g. for pipelines; used instead of command"),
+		),
+		mcp.WithBoolean("login_shell",
+			mcp.Description("Run command_line with bash -lc so that the login profile is sourced, e.g. for nvm or rbenv shims; not allowed with command"),
+		),
+		mcp.WithString("workdir",
+			mcp.Required(),
+			mcp.Description("Working directory of the daemon in absolute path"),
+		),
+		mcp.WithArray("env",
+			mcp.Description("Additional environment variables in KEY=value form"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithString("env_file",
+			mcp.Description("Absolute path of a .env file of KEY=VALUE lines added to the environment; variables in env override it"),
+		),
+		mcp.WithString("logfile",
+			mcp.Description("File the output is appended to instead of being kept in memory; a relative path is resolved against workdir"),
+		),
+		mcp.WithBoolean("strip_ansi",
+			mcp.Description("Remove ANSI escape sequences such as colors from the captured output"),
+		),
+		mcp.WithBoolean("tag_stderr",
+			mcp.Description("Capture stderr separately and prefix its lines with [stderr]; lines of the two streams may then be stored out of order, and a line is stored once it ends"),
+		),
+		mcp.WithString("ready_tcp",
+			mcp.Description("host:port that must accept TCP connections before the daemon is reported as started"),
+		),
+		mcp.WithString("ready_log",
+			mcp.Description("Regular expression an output line must match before the daemon is reported as started, e.g. \"listening on\""),
+		),
+		mcp.WithBoolean("ready_notify",
+			mcp.Description("Set NOTIFY_SOCKET for the daemon and wait for it to send READY=1 over the systemd sd_notify protocol before it is reported as started"),
+		),
+		mcp.WithNumber("ready_timeout_seconds",
+			mcp.Description("Maximum number of seconds to wait for readiness (default 30)"),
+		),
+		mcp.WithNumber("start_timeout_seconds",
+			mcp.Description("Maximum number of seconds the whole start may take, including readiness and minimum uptime; the daemon is stopped when exceeded"),
+		),
+		mcp.WithArray("health_check",
+			mcp.Description("Command run periodically in the working directory to check the daemon's health"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithNumber("health_interval_seconds",
+			mcp.Description("Number of seconds between health checks (default 10)"),
+		),
+		mcp.WithNumber("health_retries",
+			mcp.Description("Consecutive failed health checks before the daemon is unhealthy (default 3)"),
+		),
+		mcp.WithNumber("min_uptime_seconds",
+			mcp.Description("Fail the start if the daemon exits within this many seconds"),
+		),
+		mcp.WithNumber("start_grace_seconds",
+			mcp.Description("Seconds after the first launch during which a daemon that exits before becoming ready or within min_uptime_seconds is relaunched instead of failing the start"),
+		),
+		mcp.WithBoolean("background",
+			mcp.Description("Return as soon as the daemon is registered and launch it and wait for its readiness in the background; poll daemonize_ping or daemonize_list until it is running"),
+		),
+		mcp.WithNumber("max_runtime_seconds",
+			mcp.Description("Seconds after launch at which the daemon is stopped gracefully, for time-boxed jobs"),
+		),
+		mcp.WithNumber("max_memory_bytes",
+			mcp.Description("Address space limit of the daemon in bytes"),
+		),
+		mcp.WithNumber("max_open_files",
+			mcp.Description("Maximum number of open file descriptors of the daemon"),
+		),
+		mcp.WithNumber("max_cpu_seconds",
+			mcp.Description("CPU time limit of the daemon in seconds"),
+		),
+		mcp.WithNumber("max_processes",
+			mcp.Description("Maximum number of processes and threads of the daemon's user (RLIMIT_NPROC)"),
+		),
+		mcp.WithArray("stop_signals",
+			mcp.Description("Signals sent in turn when stopping, evenly spaced over the stop timeout, before SIGKILL (default [\"SIGINT\", \"SIGTERM\"])"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithNumber("stop_timeout_seconds",
+			mcp.Description("Seconds to wait for the daemon to exit when stopping before it is killed (default 10)"),
+		),
+		mcp.WithString("umask",
+			mcp.Description("File mode creation mask of the daemon as an octal string, e.g. \"027\""),
+		),
+		mcp.WithBoolean("detached",
+			mcp.Description("Leave the daemon running when the server exits"),
+		),
+		mcp.WithString("parent_death_signal",
+			mcp.Description("Signal the daemon receives from the kernel if the server dies, e.g. crashes (default SIGTERM, none for detached daemons; Linux only). Only the daemon's own process receives it, not processes it spawned; for command_line that is /bin/sh, so end the line with exec to have the workload receive it"),
+		),
+		mcp.WithNumber("nice",
+			mcp.Description("Scheduling priority of the daemon from -20 (highest) to 19 (lowest)"),
+		),
+		mcp.WithString("cpus",
+			mcp.Description("CPUs the daemon may run on, as a list of CPU numbers and ranges such as 0,2-3 (Linux only)"),
+		),
+		mcp.WithString("user",
+			mcp.Description("User name or uid to run the daemon as (requires the server to run as root)"),
+		),
+		mcp.WithString("group",
+			mcp.Description("Group name or gid to run the daemon as (requires the server to run as root)"),
+		),
+		mcp.WithBoolean("auto_restart",
+			mcp.Description("Restart the daemon when it exits on its own, backing off exponentially from 1s up to 60s"),
+		),
+		mcp.WithArray("depends_on",
+			mcp.Description("Names of daemons that must be running first; stopped ones are started"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithString("state_webhook",
+			mcp.Description("URL to POST a JSON payload to whenever the daemon starts or exits (overrides the server's -state-webhook)"),
+		),
+		mcp.WithBoolean("dry_run",
+			mcp.Description("Validate the parameters, resolve the executable and report the environment without starting anything"),
+		),
+	)
+	stopTool := mcp.NewTool("daemonize_stop",
+		mcp.WithDescription("Stop a daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithNumber("timeout_seconds",
+			mcp.Description("Seconds to wait for the daemon to exit before it is killed with SIGKILL (default: the daemon's stop timeout)"),
+		),
+	)
+	removeTool := mcp.NewTool("daemonize_remove",
+		mcp.WithDescription("Remove a stopped daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	updateTool := mcp.NewTool("daemonize_update",
+		mcp.WithDescription("Change the command, working directory or environment of a stopped daemon, keeping its name and logs"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithArray("command",
+			mcp.Description("New command to run"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithString("command_line",
+			mcp.Description("New command line run by /bin/sh -c; used instead of command"),
+		),
+		mcp.WithString("workdir",
+			mcp.Description("New working directory of the daemon in absolute path"),
+		),
+		mcp.WithArray("env",
+			mcp.Description("New additional environment variables in KEY=value form; an empty array clears them"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+	)
+	restartTool := mcp.NewTool("daemonize_restart",
+		mcp.WithDescription("Stop a daemon and start it again with the same configuration"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithNumber("restart_delay_seconds",
+			mcp.Description("Number of seconds to wait between stopping and starting, e.g. for a port to be released"),
+		),
+	)
+	signalTool := mcp.NewTool("daemonize_signal",
+		mcp.WithDescription("Send a signal to the process group of a daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithString("signal",
+			mcp.Required(),
+			mcp.Description("Signal name such as SIGHUP or HUP, or its number"),
+		),
+	)
+	signalsTool := mcp.NewTool("daemonize_signals",
+		mcp.WithDescription("List the signals accepted by daemonize_signal on this platform"),
+	)
+	stopAllTool := mcp.NewTool("daemonize_stop_all",
+		mcp.WithDescription("Stop all running daemons"),
+	)
+	startAllTool := mcp.NewTool("daemonize_start_all",
+		mcp.WithDescription("Start every stopped daemon, starting dependencies first"),
+	)
+	gcTool := mcp.NewTool("daemonize_gc",
+		mcp.WithDescription("Re-probe all daemons and remove the ones that were started and whose processes are gone"),
+	)
+	listTool := mcp.NewTool("daemonize_list",
+		mcp.WithDescription("List running daemons"),
+		mcp.WithString("format",
+			mcp.Description("Output format: text (default) or json"),
+			mcp.Enum(string(OutputFormatText), string(OutputFormatJSON)),
+		),
+	)
+	statsTool := mcp.NewTool("daemonize_stats",
+		mcp.WithDescription("Report memory and CPU usage of running daemons"),
+	)
+	pingTool := mcp.NewTool("daemonize_ping",
+		mcp.WithDescription("Check whether a daemon is alive; returns just running, stopped or not-found, which is cheaper to poll than daemonize_list"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	envDiffTool := mcp.NewTool("daemonize_env_diff",
+		mcp.WithDescription("Show how the actual environment of a daemon differs from the one it was launched with (Linux only)"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	logsTool := mcp.NewTool("daemonize_logs",
+		mcp.WithDescription("Get logs of a daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithNumber("tail",
+			mcp.Description("Number of lines to read from the end of the log, or from the start in head mode. Required unless offset or limit is given"),
+		),
+		mcp.WithNumber("offset",
+			mcp.Description("Number of lines to skip from the start of the log's history, so that the window starts at line offset+1; selects a window of lines together with limit without removing them"),
+		),
+		mcp.WithNumber("limit",
+			mcp.Description("Maximum number of lines in the window selected by offset (default 100)"),
+		),
+		mcp.WithString("pattern",
+			mcp.Description("Regular expression; only the tailed lines matching it are returned"),
+		),
+		mcp.WithNumber("byte_offset",
+			mcp.Description("Byte offset in the log's history to read raw bytes from, where every line ends with a newline; cannot be combined with line selection"),
+		),
+		mcp.WithNumber("byte_limit",
+			mcp.Description("Maximum number of bytes read from byte_offset (default 4096)"),
+		),
+		mcp.WithBoolean("head",
+			mcp.Description("Read the first lines of the log instead of the last ones"),
+		),
+		mcp.WithString("format",
+			mcp.Description("Output format: text (default) or json"),
+			mcp.Enum(string(OutputFormatText), string(OutputFormatJSON)),
+		),
+	)
+	logsAllTool := mcp.NewTool("daemonize_logs_all",
+		mcp.WithDescription("Get the most recent log lines of all running daemons merged in the order they were written, each prefixed with the name of its daemon"),
+		mcp.WithNumber("tail",
+			mcp.Description("Number of lines to return from the end of the merged logs (default 100)"),
+		),
+		mcp.WithString("format",
+			mcp.Description("Output format: text (default) or json"),
+			mcp.Enum(string(OutputFormatText), string(OutputFormatJSON)),
+		),
+	)
+	historyTool := mcp.NewTool("daemonize_history",
+		mcp.WithDescription("List recently exited daemons with their exit reasons"),
+	)
+	subscribeLogsTool := mcp.NewTool("daemonize_subscribe_logs",
+		mcp.WithDescription("Push new log lines of a daemon to the client as logging notifications until unsubscribed"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	unsubscribeLogsTool := mcp.NewTool("daemonize_unsubscribe_logs",
+		mcp.WithDescription("Stop pushing log lines of a daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	clearLogsTool := mcp.NewTool("daemonize_clear_logs",
+		mcp.WithDescription("Discard the captured logs of a daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	muteLogsTool := mcp.NewTool("daemonize_mute_logs",
+		mcp.WithDescription("Temporarily discard the output of a daemon, e.g. during a known noisy operation"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	unmuteLogsTool := mcp.NewTool("daemonize_unmute_logs",
+		mcp.WithDescription("Resume capturing the output of a muted daemon"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+	)
+	watchTool := mcp.NewTool("daemonize_watch",
+		mcp.WithDescription("Wait for a daemon to exit and collect its logs and exit status"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithNumber("timeout_seconds",
+			mcp.Required(),
+			mcp.Description("Maximum number of seconds to wait for the daemon to exit"),
+		),
+	)
+	runTool := mcp.NewTool("daemonize_run",
+		mcp.WithDescription("Run a command to completion and return its combined output and exit code"),
+		mcp.WithArray("command",
+			mcp.Description("Command to run as an argv array; preferred over command_line"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithString("command_line",
+			mcp.Description("Command line run by /bin/sh -c, e.g. for pipelines; used instead of command"),
+		),
+		mcp.WithString("workdir",
+			mcp.Required(),
+			mcp.Description("Working directory for the command"),
+		),
+		mcp.WithNumber("timeout_seconds",
+			mcp.Description("Maximum number of seconds to wait for the command (default 60)"),
+		),
+	)
+	execTool := mcp.NewTool("daemonize_exec",
+		mcp.WithDescription("Run a command to completion in the working directory and environment of a running daemon, e.g. for diagnostics, and return its combined output and exit code"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithArray("command",
+			mcp.Description("Command to run as an argv array; preferred over command_line"),
+			mcp.Items(map[string]any{
+				"type": "string",
+			}),
+		),
+		mcp.WithString("command_line",
+			mcp.Description("Command line run by /bin/sh -c, e.g. for pipelines; used instead of command"),
+		),
+		mcp.WithNumber("timeout_seconds",
+			mcp.Description("Maximum number of seconds to wait for the command (default 60)"),
+		),
+	)
+	followTool := mcp.NewTool("daemonize_follow",
+		mcp.WithDescription("Stream new log lines of a daemon to the client as logging notifications"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithNumber("duration_seconds",
+			mcp.Required(),
+			mcp.Description("Number of seconds to follow the log for"),
+		),
+	)
+	tailFollowTool := mcp.NewTool("daemonize_tail_follow",
+		mcp.WithDescription("Collect the log lines a daemon writes during a short window and return them"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the daemon"),
+		),
+		mcp.WithNumber("duration_seconds",
+			mcp.Required(),
+			mcp.Description("Number of seconds to collect new lines for"),
+		),
+		mcp.WithNumber("max_lines",
+			mcp.Description("Return as soon as this many lines have been collected"),
+		),
+	)
+
+	tools := []server.ServerTool{
+		{Tool: startTool, Handler: s.handleStart},
+		{Tool: stopTool, Handler: s.handleStop},
+		{Tool: updateTool, Handler: s.handleUpdate},
+		{Tool: restartTool, Handler: s.handleRestart},
+		{Tool: signalTool, Handler: s.handleSignal},
+		{Tool: signalsTool, Handler: s.handleSignals},
+		{Tool: stopAllTool, Handler: s.handleStopAll},
+		{Tool: startAllTool, Handler: s.handleStartAll},
+		{Tool: removeTool, Handler: s.handleRemove},
+		{Tool: gcTool, Handler: s.handleGC},
+		{Tool: listTool, Handler: s.handleList},
+		{Tool: pingTool, Handler: s.handlePing},
+		{Tool: statsTool, Handler: s.handleStats},
+		{Tool: envDiffTool, Handler: s.handleEnvDiff},
+		{Tool: logsTool, Handler: s.handleLogs},
+		{Tool: logsAllTool, Handler: s.handleLogsAll},
+		{Tool: historyTool, Handler: s.handleHistory},
+		{Tool: subscribeLogsTool, Handler: s.handleSubscribeLogs},
+		{Tool: unsubscribeLogsTool, Handler: s.handleUnsubscribeLogs},
+		{Tool: clearLogsTool, Handler: s.handleClearLogs},
+		{Tool: muteLogsTool, Handler: s.handleMuteLogs},
+		{Tool: unmuteLogsTool, Handler: s.handleUnmuteLogs},
+		{Tool: watchTool, Handler: s.handleWatch},
+		{Tool: runTool, Handler: s.handleRun},
+		{Tool: execTool, Handler: s.handleExec},
+		{Tool: followTool, Handler: s.handleFollow},
+		{Tool: tailFollowTool, Handler: s.handleTailFollow},
+	}
+	if s.maxResultBytes > 0 {
+		for i := range tools {
+			tools[i].Handler = s.limitResult(tools[i].Handler)
+		}
+	}
+	return tools
+}
+
+func (s *Server) handleStart(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseStartParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon := NewDaemon(name, p.Command, p.Workdir)
+	daemon.Env = p.Env
+	if p.EnvFile != "" {
+		env, err := readEnvFile(p.EnvFile)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to start daemon %s: env_file: %v", name, err)), nil
+		}
+		// Inline variables come last so that they override the file.
+		daemon.Env = append(env, p.Env...)
+	}
+	daemon.StripANSI = p.StripANSI
+	daemon.TagStderr = p.TagStderr
+	daemon.ReadyTCP = p.ReadyTCP
+	daemon.ReadyLog = p.ReadyLog
+	daemon.ReadyNotify = p.ReadyNotify
+	daemon.ReadyTimeout = p.ReadyTimeout
+	daemon.StartTimeout = p.StartTimeout
+	daemon.HealthCheck = p.HealthCheck
+	daemon.HealthInterval = p.HealthInterval
+	daemon.HealthRetries = p.HealthRetries
+	daemon.MinUptime = p.MinUptime
+	daemon.StartGrace = p.StartGrace
+	daemon.MaxRuntime = p.MaxRuntime
+	daemon.MaxMemoryBytes = p.MaxMemoryBytes
+	daemon.MaxOpenFiles = p.MaxOpenFiles
+	daemon.MaxCPUSeconds = p.MaxCPUSeconds
+	daemon.MaxProcesses = p.MaxProcesses
+	daemon.Umask = p.Umask
+	daemon.StopSignals = p.StopSignals
+	daemon.StopTimeout = p.StopTimeout
+	daemon.Detached = p.Detached
+	daemon.ParentDeathSignal = p.ParentDeathSignal
+	daemon.Nice = p.Nice
+	daemon.CPUs = p.CPUs
+	daemon.User = p.User
+	daemon.Group = p.Group
+	daemon.AutoRestart = p.AutoRestart
+	daemon.DependsOn = p.DependsOn
+	daemon.StateWebhook = p.StateWebhook
+	if p.DryRun {
+		return s.dryRunStart(daemon), nil
+	}
+	if p.Logfile != "" {
+		logger, err := NewFileLogger(p.Logfile)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to start daemon %s: logfile: %v", name, err)), nil
+		}
+		daemon.Logger = logger
+	}
+	if p.Background {
+		failed := func() {}
+		if p.Logfile != "" {
+			failed = func() { closeLogger(daemon) }
+		}
+		s.startBackground(ctx, daemon, failed)
+		return mcp.NewToolResultText(fmt.Sprintf("Daemon %s is starting in the background; check daemonize_ping or daemonize_list for its status", name)), nil
+	}
+	if err := s.StartDaemon(ctx, daemon); err != nil {
+		result := startFailure(daemon, err)
+		if p.Logfile != "" {
+			closeLogger(daemon)
+		}
+		return result, nil
+	}
+	return mcp.NewToolResultText("Daemon started successfully"), nil
+}
+
+// startFailureLines is the number of output lines included in the error of
+// a failed start.
+const startFailureLines = 20
+
+// startFailure is the result of a failed start. It includes the last output
+// of the daemon, which usually tells why it failed.
+func startFailure(d *Daemon, err error) *mcp.CallToolResult {
+	result := &strings.Builder{}
+	// Errors of Start already name the daemon.
+	msg, prefix := err.Error(), fmt.Sprintf("failed to start daemon %s: ", d.Name)
+	if !strings.HasPrefix(msg, prefix) {
+		msg = prefix + msg
+	}
+	result.WriteString(msg)
+	lines, _ := d.logger().PeekNumbered(-startFailureLines, startFailureLines)
+	if len(lines) > 0 {
+		result.WriteString("\nLast output:\n")
+		for _, line := range lines {
+			fmt.Fprintf(result, "  %d: %s\n", line.Number, line.Text)
+		}
+	}
+	return mcp.NewToolResultError(result.String())
+}
+
+func (s *Server) handleStop(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseStopParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	stopCtx := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		stopCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	err = s.StopDaemon(stopCtx, name)
+	switch {
+	case errors.Is(err, ErrDaemonNotFound):
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	case errors.Is(err, ErrDaemonNotRunning):
+		return mcp.NewToolResultText("Daemon already stopped"), nil
+	case p.Timeout > 0 && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		return mcp.NewToolResultText(fmt.Sprintf("Daemon did not stop within %s and was killed", p.Timeout)), nil
+	case err != nil:
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to stop daemon %s", name), err), nil
+	}
+	return mcp.NewToolResultText("Daemon stopped successfully"), nil
+}
+
+func (s *Server) handleUpdate(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseUpdateParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	status, err := daemon.Status()
+	if err != nil {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to get status of daemon %s", name), err), nil
+	}
+	if status.active() {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s is still running; stop it with daemonize_stop first", name)), nil
+	}
+	next := daemon.clone()
+	if p.Command != nil {
+		next.Commands = p.Command
+	}
+	if p.Workdir != "" {
+		next.Workdir = p.Workdir
+	}
+	if p.SetEnv {
+		next.Env = p.Env
+	}
+	if err := checkWorkdir(next.Workdir); err != nil {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to update daemon %s", name), err), nil
+	}
+	if err := s.replaceStopped(daemon, next); errors.Is(err, ErrDaemonAlreadyRunning) {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s is still running; stop it with daemonize_stop first", name)), nil
+	} else if err != nil {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to update daemon %s", name), err), nil
+	}
+	return mcp.NewToolResultText("Daemon updated successfully; restart it with daemonize_restart"), nil
+}
+
+func (s *Server) handleRestart(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseRestartParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	status, err := daemon.Status()
+	if err != nil {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to restart daemon %s", name), err), nil
+	}
+	if status.active() {
+		if err := daemon.Stop(ctx); err != nil {
+			return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to stop daemon %s", name), err), nil
+		}
+	}
+	if p.Delay > 0 {
+		timer := time.NewTimer(p.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return mcp.NewToolResultErrorFromErr("restart cancelled", ctx.Err()), nil
+		}
+	}
+	next := daemon.clone()
+	if err := next.Start(ctx); err != nil {
+		return startFailure(next, err), nil
+	}
+	s.notifyStarted(next)
+	s.addDaemon(next)
+	s.countRestart(next)
+	return mcp.NewToolResultText("Daemon restarted successfully"), nil
+}
+
+func (s *Server) handleSignal(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseSignalParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	if err := daemon.Signal(p.Signal); err != nil {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to signal daemon %s", name), err), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Sent %s to daemon %s", p.Signal, name)), nil
+}
+
+func (s *Server) handleSignals(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	result := &strings.Builder{}
+	result.WriteString("Supported signals:\n")
+	for _, ss := range supportedSignals {
+		fmt.Fprintf(result, "  - %s (%d)\n", ss.name, int(ss.sig))
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+// stopAllConcurrency bounds the number of daemons stopped in parallel by
+// daemonize_stop_all.
+const stopAllConcurrency = 4
+
+func (s *Server) handleStopAll(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	daemons := s.daemons()
+	if len(daemons) == 0 {
+		return mcp.NewToolResultText("No daemons running"), nil
+	}
+	errs := make([]error, len(daemons))
+	sem := make(chan struct{}, stopAllConcurrency)
+	var wg sync.WaitGroup
+	for i, d := range daemons {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := s.StopDaemon(ctx, d.Name); err != nil && !errors.Is(err, ErrDaemonNotRunning) {
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := &strings.Builder{}
+	result.WriteString("Stopped daemons:\n")
+	failed := false
+	for i, d := range daemons {
+		if errs[i] != nil {
+			failed = true
+			fmt.Fprintf(result, "  - %s: failed: %v\n", d.Name, errs[i])
+			continue
+		}
+		fmt.Fprintf(result, "  - %s: stopped\n", d.Name)
+	}
+	if failed {
+		return mcp.NewToolResultError(result.String()), nil
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+func (s *Server) handleStartAll(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	daemons := s.daemons()
+	if len(daemons) == 0 {
+		return mcp.NewToolResultText("No daemons defined"), nil
+	}
+	ordered, errs := startOrder(daemons)
+	outcomes := make(map[string]string, len(daemons))
+	for _, d := range ordered {
+		status, err := d.Status()
+		if err != nil {
+			errs[d.Name] = err
+			continue
+		}
+		if status.active() {
+			outcomes[d.Name] = "already running"
+			continue
+		}
+		if i := slices.IndexFunc(d.DependsOn, func(dep string) bool { return outcomes[dep] == "" }); i >= 0 {
+			errs[d.Name] = fmt.Errorf("dependency %s is not running", d.DependsOn[i])
+			continue
+		}
+		next := d.clone()
+		if err := next.Start(ctx); err != nil {
+			errs[d.Name] = err
+			continue
+		}
+		s.notifyStarted(next)
+		s.addDaemon(next)
+		outcomes[d.Name] = "started"
+	}
+
+	result := &strings.Builder{}
+	result.WriteString("Started daemons:\n")
+	for _, d := range daemons {
+		if err := errs[d.Name]; err != nil {
+			fmt.Fprintf(result, "  - %s: failed: %v\n", d.Name, err)
+			continue
+		}
+		fmt.Fprintf(result, "  - %s: %s\n", d.Name, outcomes[d.Name])
+	}
+	if len(errs) > 0 {
+		return mcp.NewToolResultError(result.String()), nil
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+func (s *Server) handleRemove(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	status, err := daemon.Status()
+	if err != nil {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to get status of daemon %s", name), err), nil
+	}
+	if status.active() {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s is still running; stop it with daemonize_stop first", name)), nil
+	}
+	s.removeDaemon(name)
+	return mcp.NewToolResultText("Daemon removed successfully"), nil
+}
+
+func (s *Server) handleGC(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	var removed []string
+	for _, d := range s.daemons() {
+		status, err := d.Status()
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to get status of daemon %s", d.Name), err), nil
+		}
+		// A daemon that was never started is a definition, not a leftover.
+		if status.active() || d.StartedAt().IsZero() {
+			continue
+		}
+		s.removeDaemon(d.Name)
+		removed = append(removed, d.Name)
+	}
+	if len(removed) == 0 {
+		return mcp.NewToolResultText("No stopped daemons to remove"), nil
+	}
+	result := &strings.Builder{}
+	result.WriteString("Removed daemons:\n")
+	for _, name := range removed {
+		fmt.Fprintf(result, "  - %s\n", name)
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+func (s *Server) handleList(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseListParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	daemons := s.daemons()
+	records := make([]DaemonRecord, 0, len(daemons))
+	for _, d := range daemons {
+		info := d.Snapshot()
+		r := DaemonRecord{
+			Name:       info.Name,
+			Command:    info.Command,
+			Executable: d.Executable(),
+			Workdir:    d.Workdir,
+			Status:     info.Status,
+			Health:     d.Health(),
+			Detached:   d.Detached,
+			Restarts:   info.RestartCount,
+		}
+		if info.PID > 0 {
+			r.PID = info.PID
+		}
+		if err := d.HealthError(); err != nil {
+			r.HealthError = err.Error()
+		}
+		if at := d.NextRestart(); !at.IsZero() {
+			r.NextRestart = at.In(s.location)
+		}
+		if at := d.StopAt(); !at.IsZero() {
+			r.StopAt = at.In(s.location)
+		}
+		if info.Status == DaemonStatusStopped {
+			r.Failure = describeFailure(d.Failure())
+			if sig := d.LastStopSignal(); sig != 0 {
+				r.StopSignal = signalName(sig)
+				r.StopForced = d.LastStopForced()
+			}
+		}
+		if last, ok := d.logger().Last(); ok {
+			r.LastLog = &LogRecord{Text: last.Text, Time: last.Time.In(s.location)}
+		}
+		if m, ok := d.logger().(*memoryLogger); ok {
+			r.LogBytes = m.size()
+		}
+		if err := d.LogError(); err != nil {
+			r.LogError = err.Error()
+		}
+		records = append(records, r)
+	}
+	if p.Format == OutputFormatJSON {
+		return jsonResult(records), nil
+	}
+
+	if len(records) == 0 {
+		return mcp.NewToolResultText("No daemons running"), nil
+	}
+	result := &strings.Builder{}
+	result.WriteString("Running daemons:\n")
+	for _, r := range records {
+		fmt.Fprintf(result, "  - %s[%s]:[%s]: %s", r.Name, quoteCommand(r.Command), r.Workdir, r.Status)
+		var notes []string
+		if r.PID > 0 {
+			notes = append(notes, fmt.Sprintf("pid %d", r.PID))
+		}
+		if r.Executable != "" && r.Executable != r.Command[0] {
+			notes = append(notes, "executable "+r.Executable)
+		}
+		if r.Health == HealthStatusUnhealthy && r.HealthError != "" {
+			notes = append(notes, fmt.Sprintf("%s: %s", r.Health, r.HealthError))
+		} else if r.Health != HealthStatusNone {
+			notes = append(notes, string(r.Health))
+		}
+		if r.Detached {
+			notes = append(notes, "detached")
+		}
+		if r.Restarts > 0 {
+			notes = append(notes, fmt.Sprintf("restarted %d times", r.Restarts))
+		}
+		if r.Failure != "" {
+			notes = append(notes, r.Failure)
+		}
+		if r.StopForced {
+			notes = append(notes, "killed with "+r.StopSignal+" on stop")
+		} else if r.StopSignal != "" {
+			notes = append(notes, "stopped with "+r.StopSignal)
+		}
+		if !r.NextRestart.IsZero() {
+			notes = append(notes, "restarting at "+r.NextRestart.Format(time.RFC3339))
+		}
+		if r.LogError != "" {
+			notes = append(notes, "log write failed: "+r.LogError)
+		}
+		if !r.StopAt.IsZero() {
+			remaining := max(time.Until(r.StopAt), 0).Round(time.Second)
+			notes = append(notes, fmt.Sprintf("stopping at %s, in %s", r.StopAt.Format(time.RFC3339), remaining))
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(result, " (%s)", strings.Join(notes, ", "))
+		}
+		if r.LastLog != nil {
+			fmt.Fprintf(result, " (last log at %s: %s)", r.LastLog.Time.Format(time.RFC3339), r.LastLog.Text)
+		}
+		result.WriteString("\n")
+	}
+	if used, budget := s.LogBytes(); budget > 0 {
+		fmt.Fprintf(result, "Log memory: %d of %d bytes\n", used, budget)
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+// handlePing reports the liveness of a daemon in a single word. A daemon
+// still waiting for readiness is alive, so it is reported as running.
+func (s *Server) handlePing(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	daemon, ok := s.daemon(p.Name)
+	if !ok {
+		return mcp.NewToolResultText("not-found"), nil
+	}
+	if daemon.Snapshot().Status.active() {
+		return mcp.NewToolResultText(string(DaemonStatusRunning)), nil
+	}
+	return mcp.NewToolResultText(string(DaemonStatusStopped)), nil
+}
+
+func (s *Server) handleStats(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	result := &strings.Builder{}
+	result.WriteString("Daemon resource usage:\n")
+	running := 0
+	for _, d := range s.daemons() {
+		stats, err := d.Stats()
+		if errors.Is(err, ErrDaemonNotRunning) {
+			continue
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			return mcp.NewToolResultError("resource usage is not supported on this platform"), nil
+		}
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to get resource usage of daemon %s", d.Name), err), nil
+		}
+		running++
+		fmt.Fprintf(result, "  - %s: rss %.1f MiB, cpu %.1f%%, threads %d\n", d.Name, float64(stats.RSS)/(1<<20), stats.CPUPercent, stats.Threads)
+	}
+	if running == 0 {
+		return mcp.NewToolResultText("No daemons running"), nil
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+func (s *Server) handleEnvDiff(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	changes, err := daemon.EnvDiff()
+	if errors.Is(err, errors.ErrUnsupported) {
+		return mcp.NewToolResultError("environment inspection is not supported on this platform"), nil
+	}
+	if err != nil {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to diff environment of daemon %s", name), err), nil
+	}
+	if len(changes) == 0 {
+		return mcp.NewToolResultText("Environment matches the launch environment"), nil
+	}
+	result := &strings.Builder{}
+	result.WriteString("Environment changes:\n")
+	for _, c := range changes {
+		switch c.Kind {
+		case EnvAdded:
+			fmt.Fprintf(result, "  + %s=%s\n", c.Key, c.Actual)
+		case EnvRemoved:
+			fmt.Fprintf(result, "  - %s=%s\n", c.Key, c.Configured)
+		case EnvChanged:
+			fmt.Fprintf(result, "  ~ %s: %s -> %s\n", c.Key, c.Configured, c.Actual)
+		}
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+func (s *Server) handleLogs(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseLogsParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	// The logs of a removed daemon stay readable for a while.
+	logger, ok := s.logger(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	if p.ByteWindow {
+		return s.logsBytes(logger, p), nil
+	}
+	if p.Window {
+		return s.logsWindow(name, logger, p), nil
+	}
+	tail, pattern := p.Tail, p.Pattern
+	if tail == 0 {
+		return noLogs(p.Format, "No logs available"), nil
+	}
+	var lines []NumberedLine
+	// Lines are numbered within the whole history of the log, so that
+	// they keep their numbers across calls when earlier lines are evicted.
+	if p.Head {
+		lines, err = logger.PeekNumbered(0, tail)
+	} else {
+		lines, err = logger.ReadNumbered(-tail)
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return noLogs(p.Format, "No logs available"), nil
+		}
+		return mcp.NewToolResultErrorFromErr("failed to read logs", err), nil
+	}
+	records := make([]LogRecord, 0, len(lines))
+	for _, line := range lines {
+		if pattern != nil && !pattern.MatchString(line.Text) {
+			continue
+		}
+		records = append(records, LogRecord{Line: line.Number, Text: s.displayLine(name, line.Text)})
+	}
+	if len(records) == 0 {
+		return noLogs(p.Format, "No matching logs"), nil
+	}
+	if p.Format == OutputFormatJSON {
+		return jsonResult(records), nil
+	}
+	result := &strings.Builder{}
+	if n := droppedLines(logger); n > 0 {
+		fmt.Fprintf(result, "Daemon logs (%d earlier lines dropped):\n", n)
+	} else {
+		result.WriteString("Daemon logs:\n")
+	}
+	for _, r := range records {
+		fmt.Fprintf(result, "  %d: %s\n", r.Line, r.Text)
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+// droppedLines returns the number of lines logger evicted to make room for
+// newer ones, or 0 if it does not count them.
+func droppedLines(logger Logger) int64 {
+	if l, ok := logger.(interface{ Dropped() int64 }); ok {
+		return l.Dropped()
+	}
+	return 0
+}
+
+// LogPage is a window of the log as reported by daemonize_logs in JSON format
+// when offset or limit is given. Total is the number of the last line in the
+// log, counted like offset over its whole history, and Dropped the number of
+// earlier lines evicted from it.
+type LogPage struct {
+	Total   int64       `json:"total"`
+	Dropped int64       `json:"dropped,omitempty"`
+	Lines   []LogRecord `json:"lines"`
+}
+
+// logsWindow returns the lines selected by the offset and limit of p without
+// removing them from the log. The offset skips lines of the whole history of
+// the log, so that the line after it is numbered offset+1; lines since gone
+// are skipped too. An offset past the end yields no lines.
+func (s *Server) logsWindow(name string, logger Logger, p logsParams) *mcp.CallToolResult {
+	// The lines are read with their numbers at once. The total is read after
+	// them, as line numbers only grow, so that it is never below the number
+	// of the last line returned.
+	lines, err := logger.PeekNumbered(p.Offset+1, p.Limit)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return mcp.NewToolResultErrorFromErr("failed to read logs", err)
+	}
+	total := logger.LastLineNumber()
+	page := LogPage{Total: total, Dropped: droppedLines(logger), Lines: []LogRecord{}}
+	for _, line := range lines {
+		if p.Pattern != nil && !p.Pattern.MatchString(line.Text) {
+			continue
+		}
+		page.Lines = append(page.Lines, LogRecord{Line: line.Number, Text: s.displayLine(name, line.Text)})
+	}
+	if p.Format == OutputFormatJSON {
+		return jsonResult(page)
+	}
+	if len(page.Lines) == 0 {
+		return mcp.NewToolResultText(fmt.Sprintf("No logs in range (%d lines total)", total))
+	}
+	result := &strings.Builder{}
+	fmt.Fprintf(result, "Daemon logs (lines %d-%d of %d", lines[0].Number, lines[len(lines)-1].Number, total)
+	if page.Dropped > 0 {
+		fmt.Fprintf(result, ", %d earlier lines dropped", page.Dropped)
+	}
+	result.WriteString("):\n")
+	for _, r := range page.Lines {
+		fmt.Fprintf(result, "  %d: %s\n", r.Line, r.Text)
+	}
+	return mcp.NewToolResultText(result.String())
+}
+
+// LogChunk is a byte window of the log as reported by daemonize_logs in JSON
+// format when byte_offset or byte_limit is given. Offset is where Data starts,
+// which is past the requested byte_offset when the bytes there are gone, and
+// NextOffset is the byte_offset that continues after Data.
+type LogChunk struct {
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"next_offset"`
+	Data       string `json:"data"`
+}
+
+// logsBytes returns the raw bytes selected by the byte offset and limit of
+// p without removing them from the log.
+func (s *Server) logsBytes(logger Logger, p logsParams) *mcp.CallToolResult {
+	if s.transform != nil || s.prefixName {
+		// The transform and prefix work on whole lines and would not apply
+		// to raw bytes.
+		return mcp.NewToolResultError("byte_offset and byte_limit are not available when the server transforms or prefixes logs")
+	}
+	data, start, err := logger.ReadBytes(p.ByteOffset, p.ByteLimit)
+	if errors.Is(err, io.EOF) {
+		start = p.ByteOffset
+	} else if err != nil {
+		return mcp.NewToolResultErrorFromErr("failed to read logs", err)
+	}
+	chunk := LogChunk{Offset: start, NextOffset: start + int64(len(data)), Data: string(data)}
+	if p.Format == OutputFormatJSON {
+		return jsonResult(chunk)
+	}
+	if len(data) == 0 {
+		return mcp.NewToolResultText("No logs available")
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Daemon log bytes %d-%d:\n%s", chunk.Offset, chunk.NextOffset, chunk.Data))
+}
+
+// noLogs is the result of daemonize_logs when no line is returned.
+func noLogs(format OutputFormat, text string) *mcp.CallToolResult {
+	if format == OutputFormatJSON {
+		return jsonResult([]LogRecord{})
+	}
+	return mcp.NewToolResultText(text)
+}
+
+// CombinedLogRecord is a log line of a daemon as reported by
+// daemonize_logs_all in JSON format.
+type CombinedLogRecord struct {
+	Name string    `json:"name"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// CombinedLogs is the result of daemonize_logs_all in JSON format. Untimed
+// names the running daemons whose logs are left out because their logger
+// does not keep the time of each line.
+type CombinedLogs struct {
+	Lines   []CombinedLogRecord `json:"lines"`
+	Untimed []string            `json:"untimed,omitempty"`
+}
+
+// combinedLogTimeLayout formats the times of daemonize_logs_all in text
+// format with a fixed width, so that the lines stay aligned.
+const combinedLogTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+func (s *Server) handleLogsAll(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseLogsAllParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	combined := CombinedLogs{Lines: []CombinedLogRecord{}}
+	for _, d := range s.daemons() {
+		if status, err := d.Status(); err != nil || !status.active() {
+			continue
+		}
+		// Only loggers that keep the time of each line can be merged.
+		logger, ok := d.logger().(interface{ LastLines(n int64) []LogLine })
+		if !ok {
+			combined.Untimed = append(combined.Untimed, d.Name)
+			continue
+		}
+		for _, line := range logger.LastLines(p.Tail) {
+			text := line.Text
+			if s.transform != nil {
+				text = s.transform(d.Name, text)
+			}
+			combined.Lines = append(combined.Lines, CombinedLogRecord{Name: d.Name, Text: text, Time: line.Time.In(s.location)})
+		}
+	}
+	// The sort is stable so that lines of a daemon written at the same time
+	// keep their order.
+	slices.SortStableFunc(combined.Lines, func(a, b CombinedLogRecord) int {
+		return a.Time.Compare(b.Time)
+	})
+	combined.Lines = combined.Lines[max(0, int64(len(combined.Lines))-p.Tail):]
+	if p.Format == OutputFormatJSON {
+		return jsonResult(combined), nil
+	}
+	result := &strings.Builder{}
+	if len(combined.Lines) == 0 {
+		result.WriteString("No logs available\n")
+	} else {
+		result.WriteString("Combined logs:\n")
+	}
+	for _, r := range combined.Lines {
+		fmt.Fprintf(result, "  %s [%s] %s\n", r.Time.Format(combinedLogTimeLayout), r.Name, r.Text)
+	}
+	if len(combined.Untimed) > 0 {
+		fmt.Fprintf(result, "Not included, as their logs have no timestamps: %s\n", strings.Join(combined.Untimed, ", "))
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+func (s *Server) handleHistory(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	history := s.History()
+	if len(history) == 0 {
+		return mcp.NewToolResultText("No daemons exited"), nil
+	}
+	result := &strings.Builder{}
+	result.WriteString("Exited daemons:\n")
+	for _, r := range history {
+		fmt.Fprintf(result, "  - %s: %s", r.Name, r.Reason)
+		if r.Signal != 0 {
+			fmt.Fprintf(result, " by signal %s", r.Signal)
+		} else {
+			fmt.Fprintf(result, " with code %d", r.ExitCode)
+		}
+		fmt.Fprintf(result, " after %s at %s\n", r.Duration.Round(time.Millisecond), r.ExitedAt.In(s.location).Format(time.RFC3339))
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+func (s *Server) handleClearLogs(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	if err := daemon.logger().Clear(); err != nil {
+		return mcp.NewToolResultErrorFromErr("failed to clear logs", err), nil
+	}
+	return mcp.NewToolResultText("Logs cleared successfully"), nil
+}
+
+func (s *Server) handleMuteLogs(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	daemon, ok := s.daemon(p.Name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", p.Name)), nil
+	}
+	if !daemon.Mute() {
+		return mcp.NewToolResultText("Logs already muted"), nil
+	}
+	return mcp.NewToolResultText("Logs muted successfully"), nil
+}
+
+func (s *Server) handleUnmuteLogs(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseNameParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	daemon, ok := s.daemon(p.Name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", p.Name)), nil
+	}
+	n, ok := daemon.Unmute()
+	if !ok {
+		return mcp.NewToolResultText("Logs not muted"), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Logs unmuted; muted %d lines", n)), nil
+}
+
+func (s *Server) handleWatch(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseWatchParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	timeout := p.Timeout
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	exited := false
+	select {
+	case <-daemon.doneCh():
+		exited = true
+	case <-timer.C:
+	case <-ctx.Done():
+		return mcp.NewToolResultErrorFromErr("watch cancelled", ctx.Err()), nil
+	}
+
+	lines, err := daemon.logger().ReadNumbered(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return mcp.NewToolResultErrorFromErr("failed to read logs", err), nil
+	}
+	result := &strings.Builder{}
+	result.WriteString("Daemon logs:\n")
+	for _, line := range lines {
+		fmt.Fprintf(result, "  %d: %s\n", line.Number, line.Text)
+	}
+	if exited {
+		fmt.Fprintf(result, "Daemon exited with code %d\n", daemon.ExitCode())
+	} else {
+		fmt.Fprintf(result, "Daemon still running after %s\n", timeout)
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
+
+// DefaultRunTimeout is the timeout of daemonize_run and daemonize_exec when
+// none is given.
+const DefaultRunTimeout = 60 * time.Second
+
+func (s *Server) handleRun(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseRunParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	// The command runs as an unregistered daemon so that it gets the same
+	// process group handling and output capture.
+	return s.runOnce(ctx, NewDaemon(p.Command[0], p.Command, p.Workdir), p.Timeout), nil
+}
+
+func (s *Server) handleExec(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseExecParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	daemon, ok := s.daemon(p.Name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", p.Name)), nil
+	}
+	// The workdir and environment of a stopped daemon may be stale.
+	if daemon.PID() == -1 {
+		return mcp.NewToolResultErrorFromErr(fmt.Sprintf("failed to exec in daemon %s", p.Name), ErrDaemonNotRunning), nil
+	}
+	d := NewDaemon(p.Command[0], p.Command, daemon.Workdir)
+	d.Env = daemon.Env
+	d.User = daemon.User
+	d.Group = daemon.Group
+	return s.runOnce(ctx, d, p.Timeout), nil
+}
+
+// runOnce starts the unregistered daemon d, waits up to timeout for it to
+// exit, stopping it otherwise, and returns its output and exit code.
+func (s *Server) runOnce(ctx context.Context, d *Daemon, timeout time.Duration) *mcp.CallToolResult {
+	if err := d.Start(context.WithoutCancel(ctx)); err != nil {
+		return mcp.NewToolResultErrorFromErr("failed to run command", err)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	exited := false
+	select {
+	case <-d.doneCh():
+		exited = true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	if !exited {
+		if err := d.Stop(context.WithoutCancel(ctx)); err != nil {
+			slog.ErrorContext(ctx, "failed to stop command", slog.String("command", quoteCommand(d.Commands)), slog.Any("error", err))
+		}
+	}
+
+	lines, err := d.logger().Snapshot()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return mcp.NewToolResultErrorFromErr("failed to read output", err)
+	}
+	result := &strings.Builder{}
+	result.WriteString("Command output:\n")
+	for i, line := range lines {
+		fmt.Fprintf(result, "  %d: %s\n", i+1, line)
+	}
+	switch {
+	case exited:
+		fmt.Fprintf(result, "Command exited with code %d\n", d.ExitCode())
+	case ctx.Err() != nil:
+		return mcp.NewToolResultErrorFromErr("run cancelled", ctx.Err())
+	default:
+		fmt.Fprintf(result, "Command timed out after %s\n", timeout)
+		return mcp.NewToolResultError(result.String())
+	}
+	return mcp.NewToolResultText(result.String())
+}
+
+func (s *Server) handleFollow(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseFollowParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+	ms := server.ServerFromContext(ctx)
+	if ms == nil {
+		return mcp.NewToolResultError("notifications are not available for this session"), nil
+	}
+
+	lines, cancel := daemon.logger().Subscribe()
+	defer cancel()
+	timer := time.NewTimer(p.Duration)
+	defer timer.Stop()
+
+	sent := 0
+	send := func(line string) error {
+		sent++
+		return ms.SendNotificationToClient(ctx, "notifications/message", map[string]any{
+			"level":  mcp.LoggingLevelInfo,
+			"logger": name,
+			"data":   line,
+		})
+	}
+	for {
+		select {
+		case line := <-lines:
+			if err := send(line); err != nil {
+				return mcp.NewToolResultErrorFromErr("failed to send log notification", err), nil
+			}
+		case <-daemon.doneCh():
+			// Deliver lines written just before the exit.
+			for drained := false; !drained; {
+				select {
+				case line := <-lines:
+					if err := send(line); err != nil {
+						return mcp.NewToolResultErrorFromErr("failed to send log notification", err), nil
+					}
+				default:
+					drained = true
+				}
+			}
+			return mcp.NewToolResultText(fmt.Sprintf("Followed %d lines until the daemon exited", sent)), nil
+		case <-timer.C:
+			return mcp.NewToolResultText(fmt.Sprintf("Followed %d lines", sent)), nil
+		case <-ctx.Done():
+			return mcp.NewToolResultErrorFromErr("follow cancelled", ctx.Err()), nil
+		}
+	}
+}
+
+func (s *Server) handleTailFollow(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	p, err := parseTailFollowParams(request)
+	if err != nil {
+		return invalidParams(err), nil
+	}
+	name := p.Name
+	daemon, ok := s.daemon(name)
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("daemon %s not found", name)), nil
+	}
+
+	// The subscription marks where the window starts: only lines stored
+	// after it are delivered.
+	lines, cancel := daemon.logger().Subscribe()
+	defer cancel()
+	timer := time.NewTimer(p.Duration)
+	defer timer.Stop()
+
+	var collected []string
+	full := func() bool {
+		return p.MaxLines > 0 && int64(len(collected)) >= p.MaxLines
+	}
+	for done := false; !done && !full(); {
+		select {
+		case line := <-lines:
+			collected = append(collected, line)
+		case <-daemon.doneCh():
+			// Collect lines written just before the exit.
+			for drained := false; !drained && !full(); {
+				select {
+				case line := <-lines:
+					collected = append(collected, line)
+				default:
+					drained = true
+				}
+			}
+			done = true
+		case <-timer.C:
+			done = true
+		case <-ctx.Done():
+			return mcp.NewToolResultErrorFromErr("tail follow cancelled", ctx.Err()), nil
+		}
+	}
+
+	if len(collected) == 0 {
+		return mcp.NewToolResultText(fmt.Sprintf("No new logs within %s", p.Duration)), nil
+	}
+	result := &strings.Builder{}
+	result.WriteString("New daemon logs:\n")
+	for i, line := range collected {
+		fmt.Fprintf(result, "  %d: %s\n", i+1, line)
+	}
+	return mcp.NewToolResultText(result.String()), nil
+}
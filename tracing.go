@@ -0,0 +1,51 @@
+package daemonize
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Span names of the traced daemon operations.
+const (
+	SpanStart = "daemonize.start"
+	SpanStop  = "daemonize.stop"
+)
+
+// WithTracer traces the start and stop of every daemon of the server that
+// has no Tracer of its own with an OpenTelemetry tracer. Daemons are not
+// traced by default.
+func WithTracer(t trace.Tracer) Option {
+	return func(s *Server) {
+		s.tracer = t
+	}
+}
+
+func (d *Daemon) tracer() trace.Tracer {
+	if d.Tracer == nil {
+		return noop.NewTracerProvider().Tracer("")
+	}
+	return d.Tracer
+}
+
+// startSpan starts a span for the named operation on the daemon. The
+// returned function records the duration and err, then ends the span.
+func (d *Daemon) startSpan(ctx context.Context, name string) (context.Context, trace.Span, func(err error)) {
+	ctx, span := d.tracer().Start(ctx, name, trace.WithAttributes(
+		attribute.String("daemon.name", d.Name),
+		attribute.String("daemon.command", quoteCommand(d.Commands)),
+	))
+	begin := time.Now()
+	return ctx, span, func(err error) {
+		span.SetAttributes(attribute.Float64("daemon.duration_seconds", time.Since(begin).Seconds()))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,45 @@
+package daemonize
+
+import (
+	"context"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// limitResult wraps h so that the text of its result is truncated to
+// s.maxResultBytes. Results in JSON format are left whole, as a cut would
+// make them invalid.
+func (s *Server) limitResult(h server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := h(ctx, request)
+		if err != nil || result == nil {
+			return result, err
+		}
+		if format, _ := request.GetArguments()["format"].(string); format == string(OutputFormatJSON) {
+			return result, nil
+		}
+		for i, c := range result.Content {
+			if tc, ok := c.(mcp.TextContent); ok {
+				tc.Text = truncateText(tc.Text, s.maxResultBytes)
+				result.Content[i] = tc
+			}
+		}
+		return result, nil
+	}
+}
+
+// truncateText cuts text to at most limit bytes at a rune boundary and
+// appends a notice with the original size.
+func truncateText(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n... output truncated (%d of %d bytes shown)", text[:cut], cut, len(text))
+}
@@ -0,0 +1,97 @@
+package daemonize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Delivery of state webhooks is best-effort: each attempt times out after
+// webhookTimeout, and a failed POST is retried webhookAttempts times in all,
+// webhookRetryDelay apart.
+const (
+	webhookTimeout    = 5 * time.Second
+	webhookAttempts   = 3
+	webhookRetryDelay = time.Second
+)
+
+// StateChange is the JSON payload POSTed to a state webhook.
+type StateChange struct {
+	Name      string    `json:"name"`
+	OldStatus string    `json:"old_status"`
+	NewStatus string    `json:"new_status"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WithStateWebhook POSTs a StateChange to url whenever a daemon without a
+// StateWebhook of its own starts or exits.
+func WithStateWebhook(url string) Option {
+	return func(s *Server) {
+		s.stateWebhook = url
+	}
+}
+
+// validWebhookURL reports whether u is an absolute http or https URL.
+func validWebhookURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// postStateChange sends change to the state webhook of d in the background.
+func (s *Server) postStateChange(d *Daemon, change StateChange) {
+	target := d.StateWebhook
+	if target == "" {
+		target = s.stateWebhook
+	}
+	if target == "" {
+		return
+	}
+	change.Timestamp = s.clock.Now()
+	body, err := json.Marshal(change)
+	if err != nil {
+		slog.Error("failed to encode state change", slog.String("name", d.Name), slog.Any("error", err))
+		return
+	}
+	go func() {
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(target, body)
+			if err == nil {
+				return
+			}
+			if attempt == webhookAttempts {
+				slog.Error("failed to deliver state webhook", slog.String("name", d.Name), slog.String("url", target), slog.Any("error", err))
+				return
+			}
+			slog.Debug("retrying state webhook", slog.String("name", d.Name), slog.Int("attempt", attempt), slog.Any("error", err))
+			<-s.clock.After(webhookRetryDelay)
+		}
+	}()
+}
+
+func postWebhook(target string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}